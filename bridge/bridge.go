@@ -1,15 +1,12 @@
 package bridge
 
 import (
+	"context"
+	"fmt"
 	"github.com/42wim/matterbridge/bridge/config"
-	"github.com/42wim/matterbridge/bridge/discord"
-	"github.com/42wim/matterbridge/bridge/gitter"
-	"github.com/42wim/matterbridge/bridge/irc"
-	"github.com/42wim/matterbridge/bridge/mattermost"
-	"github.com/42wim/matterbridge/bridge/rocketchat"
-	"github.com/42wim/matterbridge/bridge/slack"
-	"github.com/42wim/matterbridge/bridge/telegram"
-	"github.com/42wim/matterbridge/bridge/xmpp"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"github.com/42wim/matterbridge/paste"
+	"sort"
 	"strings"
 )
 
@@ -17,6 +14,64 @@ type Bridger interface {
 	Send(msg config.Message) error
 	Connect() error
 	JoinChannel(channel string) error
+	// Disconnect sends the queued messages, leaves and disconnects.
+	// It gives up sending when ctx is done.
+	Disconnect(ctx context.Context) error
+}
+
+// ChannelLister is implemented by bridges that can list the channels available
+// on their account. It is used to map the channels matching a pattern.
+type ChannelLister interface {
+	ListChannels() ([]string, error)
+}
+
+// ChannelCreator is implemented by bridges that can create channels.
+// CreateChannel creates channel if it does not exist yet.
+type ChannelCreator interface {
+	CreateChannel(channel string) error
+}
+
+// EventFilter is implemented by bridges that can skip receiving the events no
+// gateway relays, eg typing notifications costing an API call each.
+// FilterEvents is called before Connect.
+type EventFilter interface {
+	FilterEvents(relayed func(event string) bool)
+}
+
+// Factory creates the bridge of account with its settings cfg.
+// The messages received by the bridge are sent to the gateway on c.
+type Factory func(cfg config.Protocol, account string, c chan config.Message) Bridger
+
+var factories = make(map[string]Factory)
+
+// Register makes a protocol available, its accounts are configured in
+// [name.account] sections and validated with info. Packages providing a
+// bridge call it in their init function, so they can be enabled with a blank
+// import.
+// It panics when name is registered twice.
+func Register(name string, factory Factory, info config.ProtocolInfo) {
+	if _, ok := factories[name]; ok {
+		panic("bridge: protocol " + name + " registered twice")
+	}
+	factories[name] = factory
+	config.RegisterProtocol(name, info)
+}
+
+// Protocols returns the names of the registered protocols.
+func Protocols() []string {
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	// loopback is registered here, the bridges use it when DryRun is set
+	Register("loopback", func(cfg config.Protocol, account string, c chan config.Message) Bridger {
+		return bloopback.New(cfg, account, c)
+	}, config.ProtocolInfo{AutoCreate: true})
 }
 
 type Bridge struct {
@@ -25,44 +80,40 @@ type Bridge struct {
 	Name     string
 	Account  string
 	Protocol string
+	paste    *paste.Server
 }
 
-func New(cfg *config.Config, bridge *config.Bridge, c chan config.Message) *Bridge {
+func New(cfg *config.Config, bridge *config.Bridge, c chan config.Message) (*Bridge, error) {
 	b := new(Bridge)
 	accInfo := strings.Split(bridge.Account, ".")
+	if len(accInfo) != 2 {
+		return nil, fmt.Errorf("invalid account %q, it must look like protocol.name (eg irc.freenode)", bridge.Account)
+	}
 	protocol := accInfo[0]
 	name := accInfo[1]
 	b.Name = name
 	b.Protocol = protocol
 	b.Account = bridge.Account
 
-	// override config from environment
-	config.OverrideCfgFromEnv(cfg, protocol, name)
-	switch protocol {
-	case "mattermost":
-		b.Config = cfg.Mattermost[name]
-		b.Bridger = bmattermost.New(cfg.Mattermost[name], bridge.Account, c)
-	case "irc":
-		b.Config = cfg.IRC[name]
-		b.Bridger = birc.New(cfg.IRC[name], bridge.Account, c)
-	case "gitter":
-		b.Config = cfg.Gitter[name]
-		b.Bridger = bgitter.New(cfg.Gitter[name], bridge.Account, c)
-	case "slack":
-		b.Config = cfg.Slack[name]
-		b.Bridger = bslack.New(cfg.Slack[name], bridge.Account, c)
-	case "xmpp":
-		b.Config = cfg.Xmpp[name]
-		b.Bridger = bxmpp.New(cfg.Xmpp[name], bridge.Account, c)
-	case "discord":
-		b.Config = cfg.Discord[name]
-		b.Bridger = bdiscord.New(cfg.Discord[name], bridge.Account, c)
-	case "telegram":
-		b.Config = cfg.Telegram[name]
-		b.Bridger = btelegram.New(cfg.Telegram[name], bridge.Account, c)
-	case "rocketchat":
-		b.Config = cfg.Rocketchat[name]
-		b.Bridger = brocketchat.New(cfg.Rocketchat[name], bridge.Account, c)
+	factory, ok := factories[protocol]
+	if !ok {
+		return nil, fmt.Errorf("account %s uses unknown protocol %q (supported protocols: %s)", bridge.Account, protocol, strings.Join(Protocols(), ", "))
+	}
+	b.Config, _ = cfg.Account(bridge.Account)
+	b.Bridger = factory(b.Config, bridge.Account, c)
+	if f, ok := b.Bridger.(EventFilter); ok {
+		f.FilterEvents(func(event string) bool { return cfg.RelaysEvent(bridge.Account, event) })
+	}
+	if cfg.General.DryRun {
+		// keep the account config, but do not connect
+		b.Bridger = bloopback.New(b.Config, bridge.Account, c)
+	}
+	if b.Config.Multiline == "upload" {
+		var err error
+		b.paste, err = getPaste(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: starting the paste server failed: %s", bridge.Account, err)
+		}
 	}
-	return b
+	return b, nil
 }
@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// a protocol without field in config.Config, as registered by a third-party package
+	Register("fake", func(cfg config.Protocol, account string, c chan config.Message) Bridger {
+		return bloopback.New(cfg, account, c)
+	}, config.ProtocolInfo{})
+}
+
+func loadConfig(t *testing.T, content string) (*config.Config, []error) {
+	f, err := ioutil.TempFile("", "matterbridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+	return config.LoadConfig(f.Name())
+}
+
+func TestRegister(t *testing.T) {
+	cfg, errs := loadConfig(t, `
+[fake.test]
+Nick="bot"
+
+[[gateway]]
+name="test"
+enable=true
+    [[gateway.inout]]
+    account="fake.test"
+    channel="general"
+`)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	br, err := New(cfg, &config.Bridge{Account: "fake.test"}, make(chan config.Message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := br.Bridger.(*bloopback.Bloopback); !ok || br.Config.Nick != "bot" || br.Protocol != "fake" {
+		t.Errorf("unexpected bridge %#v", br)
+	}
+}
+
+func TestRegisterUnknownSetting(t *testing.T) {
+	_, errs := loadConfig(t, `
+[fake.test]
+Nickname="bot"
+`)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), `unknown setting "fake.test.Nickname"`) {
+		t.Errorf("expected an unknown setting, got %v", errs)
+	}
+}
+
+func TestUnknownProtocol(t *testing.T) {
+	_, err := New(&config.Config{}, &config.Bridge{Account: "nope.test"}, make(chan config.Message))
+	if err == nil || !strings.Contains(err.Error(), `unknown protocol "nope"`) || !strings.Contains(err.Error(), "fake") {
+		t.Errorf("expected an unknown protocol error, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"strings"
+)
+
+// Capable is implemented by bridges that declare their capabilities. The
+// messages sent to them are formatted accordingly: the username is prefixed to
+// the text when the protocol can not show it, actions fall back to italics and
+// messages are split in lines and parts that fit in the limit.
+// Messages to bridges that do not implement it are sent as is.
+type Capable interface {
+	Capabilities() helper.Capabilities
+}
+
+// Commander is implemented by bridges that answer commands (eg !users) sent
+// from other bridges. Command is called instead of Send for messages starting
+// with "!".
+type Commander interface {
+	Command(msg *config.Message) string
+}
+
+// Capabilities returns the capabilities of the bridge, ok is false when it
+// does not declare them.
+func (b *Bridge) Capabilities() (caps helper.Capabilities, ok bool) {
+	c, ok := b.Bridger.(Capable)
+	if !ok {
+		return caps, false
+	}
+	return c.Capabilities(), true
+}
+
+// format returns the messages to send for msg to a protocol with capabilities caps.
+func format(msg config.Message, caps helper.Capabilities) []config.Message {
+	if msg.Event == config.EVENT_USER_TYPING {
+		return []config.Message{msg}
+	}
+	if msg.Event == config.EVENT_USER_ACTION && !caps.Actions {
+		switch caps.Markup {
+		case helper.MarkupMarkdown:
+			msg.Text = "_" + msg.Text + "_"
+			msg.Event = ""
+		case helper.MarkupIRC:
+			msg.Text = "\x1d" + msg.Text + "\x1d"
+			msg.Event = ""
+		}
+	}
+	prefix := ""
+	if !caps.Username {
+		prefix = msg.Username + caps.Separator
+	}
+	lines := []string{msg.Text}
+	if !caps.Multiline {
+		lines = strings.Split(msg.Text, "\n")
+	}
+	limit := caps.Limit
+	limit.Markup = caps.Markup
+	var msgs []config.Message
+	for _, line := range lines {
+		for _, text := range helper.Split(line, prefix, limit) {
+			m := msg
+			m.Text = text
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
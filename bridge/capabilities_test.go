@@ -0,0 +1,89 @@
+package bridge
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"reflect"
+	"testing"
+)
+
+// capable is a loopback bridge declaring capabilities.
+type capable struct {
+	*bloopback.Bloopback
+	caps     helper.Capabilities
+	commands []string
+}
+
+func (b *capable) Capabilities() helper.Capabilities {
+	return b.caps
+}
+
+func (b *capable) Command(msg *config.Message) string {
+	b.commands = append(b.commands, msg.Text)
+	return ""
+}
+
+func texts(msgs []config.Message) []string {
+	var res []string
+	for _, msg := range msgs {
+		res = append(res, msg.Event+":"+msg.Text)
+	}
+	return res
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  config.Message
+		caps helper.Capabilities
+		want []string
+	}{
+		{"username", config.Message{Username: "<nick> ", Text: "hello"},
+			helper.Capabilities{Username: true}, []string{":hello"}},
+		{"prefix", config.Message{Username: "<nick> ", Text: "hello"},
+			helper.Capabilities{}, []string{":<nick> hello"}},
+		{"separator", config.Message{Username: "<nick>", Text: "hello"},
+			helper.Capabilities{Separator: " "}, []string{":<nick> hello"}},
+		{"lines", config.Message{Username: "<nick> ", Text: "one\ntwo"},
+			helper.Capabilities{}, []string{":<nick> one", ":<nick> two"}},
+		{"multiline", config.Message{Username: "<nick> ", Text: "one\ntwo"},
+			helper.Capabilities{Multiline: true}, []string{":<nick> one\ntwo"}},
+		{"split", config.Message{Username: "<nick> ", Text: "aaaaaaaaaaaaaaaaaaaaa bbbbbbbbbbbbbbbbbbbbb"},
+			helper.Capabilities{Limit: helper.Limit{Max: 30}},
+			[]string{":<nick> aaaaaaaaaaaaaaaaaaaaa", ":<nick> bbbbbbbbbbbbbbbbbbbbb"}},
+		{"action", config.Message{Username: "<nick> ", Text: "waves", Event: config.EVENT_USER_ACTION},
+			helper.Capabilities{Actions: true}, []string{config.EVENT_USER_ACTION + ":<nick> waves"}},
+		{"action italics", config.Message{Username: "<nick> ", Text: "waves", Event: config.EVENT_USER_ACTION},
+			helper.Capabilities{Markup: helper.MarkupMarkdown}, []string{":<nick> _waves_"}},
+		{"typing", config.Message{Username: "<nick> ", Event: config.EVENT_USER_TYPING},
+			helper.Capabilities{}, []string{config.EVENT_USER_TYPING + ":"}},
+	}
+	for _, test := range tests {
+		if got := texts(format(test.msg, test.caps)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.want, got)
+		}
+	}
+}
+
+func TestSendCapabilities(t *testing.T) {
+	lb := bloopback.New(config.Protocol{}, "fake.test", nil)
+	b := &Bridge{Account: "fake.test", Bridger: &capable{Bloopback: lb}}
+	b.Send(config.Message{Account: "irc.test", Username: "<nick> ", Text: "one\ntwo"})
+	b.Send(config.Message{Account: "irc.test", Username: "<nick> ", Text: "!users"})
+	if got := texts(lb.Sent()); !reflect.DeepEqual(got, []string{":<nick> one", ":<nick> two"}) {
+		t.Errorf("unexpected messages %q", got)
+	}
+	if got := b.Bridger.(*capable).commands; !reflect.DeepEqual(got, []string{"!users"}) {
+		t.Errorf("unexpected commands %q", got)
+	}
+
+	// bridges without capabilities get the message as is
+	lb = bloopback.New(config.Protocol{}, "fake.test", nil)
+	b = &Bridge{Account: "fake.test", Bridger: lb}
+	msg := config.Message{Account: "irc.test", Username: "<nick> ", Text: "one\ntwo"}
+	b.Send(msg)
+	if sent := lb.Sent(); len(sent) != 1 || !reflect.DeepEqual(sent[0], msg) {
+		t.Errorf("unexpected messages %#v", sent)
+	}
+}
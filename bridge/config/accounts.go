@@ -0,0 +1,199 @@
+package config
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ProtocolInfo describes a protocol to the validation of the config.
+type ProtocolInfo struct {
+	// Required returns the settings an account with the settings cfg must
+	// have, it can be nil.
+	Required func(cfg Protocol) []string
+	// AutoCreate is true if the bridges of the protocol can create the
+	// channels (see the AutoCreate option of the gateway accounts).
+	AutoCreate bool
+	// Settings returns a pointer to a new struct for the settings of the
+	// protocol that are not in Protocol, it can be nil. The accounts are
+	// decoded into it as well and it is kept in Protocol.Settings, its keys
+	// are not reported as unknown.
+	Settings func() interface{}
+	// Check returns the errors of the settings cfg of an account, a
+	// SettingError is reported at its setting. It can be nil.
+	Check func(cfg Protocol) []error
+}
+
+// SettingError is an error of a setting of an account, see ProtocolInfo.Check.
+type SettingError struct {
+	Setting string
+	Err     error
+}
+
+func (e *SettingError) Error() string {
+	return "invalid " + e.Setting + ": " + e.Err.Error()
+}
+
+// section is the raw section of an account.
+type section struct {
+	md   toml.MetaData
+	prim toml.Primitive
+}
+
+// decodeMu serializes the decoding of the sections, PrimitiveDecode updates
+// the MetaData shared by every section.
+var decodeMu sync.Mutex
+
+// Decode decodes the settings of the account into v, a pointer to a struct
+// or a map. If v has the type of Settings it is set to a copy of Settings,
+// with its references resolved and the environment applied; otherwise the
+// section of the account is decoded as it is in the file.
+func (p Protocol) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("decode needs a non-nil pointer, not %T", v)
+	}
+	if p.Settings != nil && reflect.TypeOf(p.Settings) == rv.Type() {
+		rv.Elem().Set(reflect.ValueOf(p.Settings).Elem())
+		return nil
+	}
+	if p.section == nil {
+		return nil
+	}
+	decodeMu.Lock()
+	defer decodeMu.Unlock()
+	return p.section.md.PrimitiveDecode(p.section.prim, v)
+}
+
+// Decode decodes the settings of account ("protocol.name") into v, see
+// Protocol.Decode.
+func (cfg *Config) Decode(account string, v interface{}) error {
+	protoCfg, ok := cfg.Account(account)
+	if !ok {
+		return fmt.Errorf("account %s is not configured", account)
+	}
+	return protoCfg.Decode(v)
+}
+
+var (
+	// registered protocols (see bridge.Register)
+	protocols   = make(map[string]ProtocolInfo)
+	protocolsMu sync.RWMutex
+)
+
+// RegisterProtocol makes the [protocol.name] sections of the config known,
+// they are decoded in Config.Protocols.
+func RegisterProtocol(protocol string, info ProtocolInfo) {
+	protocolsMu.Lock()
+	defer protocolsMu.Unlock()
+	protocols[strings.ToLower(protocol)] = info
+}
+
+// Require returns a ProtocolInfo.Required function requiring fields.
+func Require(fields ...string) func(cfg Protocol) []string {
+	return func(Protocol) []string {
+		return fields
+	}
+}
+
+// protocolInfo returns the info of protocol, ok is false if it is not registered.
+func protocolInfo(protocol string) (info ProtocolInfo, ok bool) {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	info, ok = protocols[strings.ToLower(protocol)]
+	return info, ok
+}
+
+// Protocols returns the names of the registered protocols.
+func Protocols() []string {
+	protocolsMu.RLock()
+	defer protocolsMu.RUnlock()
+	var names []string
+	for protocol := range protocols {
+		names = append(names, protocol)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// decodeProtocols decodes the sections of the registered protocols into
+// cfg.Protocols, with the Settings of their ProtocolInfo.
+func (cfg *Config) decodeProtocols(cfgfile string) (toml.MetaData, error) {
+	var sections map[string]toml.Primitive
+	md, err := toml.DecodeFile(cfgfile, &sections)
+	if err != nil {
+		return md, err
+	}
+	decodeMu.Lock()
+	defer decodeMu.Unlock()
+	for name, prim := range sections {
+		info, ok := protocolInfo(name)
+		if !ok {
+			continue
+		}
+		var prims map[string]toml.Primitive
+		if err := md.PrimitiveDecode(prim, &prims); err != nil {
+			return md, err
+		}
+		accounts := make(map[string]Protocol)
+		for account, prim := range prims {
+			var protoCfg Protocol
+			if err := md.PrimitiveDecode(prim, &protoCfg); err != nil {
+				return md, err
+			}
+			if info.Settings != nil {
+				protoCfg.Settings = info.Settings()
+				if err := md.PrimitiveDecode(prim, protoCfg.Settings); err != nil {
+					return md, err
+				}
+			}
+			protoCfg.section = &section{md: md, prim: prim}
+			accounts[account] = protoCfg
+		}
+		if cfg.Protocols == nil {
+			cfg.Protocols = make(map[string]map[string]Protocol)
+		}
+		cfg.Protocols[strings.ToLower(name)] = accounts
+	}
+	return md, nil
+}
+
+// Account returns the settings of account ("protocol.name").
+func (cfg *Config) Account(account string) (Protocol, bool) {
+	accInfo := strings.SplitN(account, ".", 2)
+	if len(accInfo) != 2 {
+		return Protocol{}, false
+	}
+	protoCfg, ok := cfg.Protocols[strings.ToLower(accInfo[0])][accInfo[1]]
+	return protoCfg, ok
+}
+
+// SetAccount sets the settings of account ("protocol.name").
+func (cfg *Config) SetAccount(account string, protoCfg Protocol) {
+	accInfo := strings.SplitN(account, ".", 2)
+	if len(accInfo) != 2 {
+		return
+	}
+	protocol := strings.ToLower(accInfo[0])
+	if cfg.Protocols == nil {
+		cfg.Protocols = make(map[string]map[string]Protocol)
+	}
+	if cfg.Protocols[protocol] == nil {
+		cfg.Protocols[protocol] = make(map[string]Protocol)
+	}
+	cfg.Protocols[protocol][accInfo[1]] = protoCfg
+}
+
+// Accounts returns every configured account by its "protocol.name".
+func (cfg *Config) Accounts() map[string]Protocol {
+	accounts := make(map[string]Protocol)
+	for protocol, protoCfgs := range cfg.Protocols {
+		for name, protoCfg := range protoCfgs {
+			accounts[protocol+"."+name] = protoCfg
+		}
+	}
+	return accounts
+}
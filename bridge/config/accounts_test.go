@@ -0,0 +1,74 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type acmeSettings struct {
+	Channel string
+	Retries int
+}
+
+func TestDecode(t *testing.T) {
+	RegisterProtocol("acme", ProtocolInfo{Required: Require("Token", "Channel"),
+		Settings: func() interface{} { return &acmeSettings{} }})
+	RegisterProtocol("plugin", ProtocolInfo{})
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgfile := filepath.Join(dir, "matterbridge.toml")
+	err = ioutil.WriteFile(cfgfile, []byte(`[acme.test]
+Token="env:MATTERBRIDGE_TEST_TOKEN"
+Channel="env:MATTERBRIDGE_TEST_CHANNEL"
+Unknown="x"
+
+[plugin.test]
+Token="secret"
+Color="blue"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("MATTERBRIDGE_TEST_TOKEN", "s3cret")
+	os.Setenv("MATTERBRIDGE_TEST_CHANNEL", "general")
+	os.Setenv("MATTERBRIDGE_ACME_TEST_RETRIES", "3")
+	defer os.Unsetenv("MATTERBRIDGE_TEST_TOKEN")
+	defer os.Unsetenv("MATTERBRIDGE_TEST_CHANNEL")
+	defer os.Unsetenv("MATTERBRIDGE_ACME_TEST_RETRIES")
+	cfg, errs := LoadConfig(cfgfile)
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), `unknown setting "acme.test.Unknown"`) ||
+		!strings.Contains(errs[1].Error(), `unknown setting "plugin.test.Color"`) {
+		t.Fatalf("expected the unknown settings to be reported, got %v", errs)
+	}
+
+	var settings acmeSettings
+	if err := cfg.Decode("acme.test", &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings.Channel != "general" || settings.Retries != 3 {
+		t.Errorf("expected the resolved settings with the environment, got %+v", settings)
+	}
+	var raw map[string]interface{}
+	if err := cfg.Decode("acme.test", &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["Channel"] != "env:MATTERBRIDGE_TEST_CHANNEL" || raw["Unknown"] != "x" {
+		t.Errorf("expected the section as it is in the file, got %v", raw)
+	}
+	var plugin struct{ Color string }
+	if err := cfg.Decode("plugin.test", &plugin); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.Color != "blue" {
+		t.Errorf("expected Color blue, got %q", plugin.Color)
+	}
+	if err := cfg.Decode("acme.missing", &settings); err == nil {
+		t.Error("expected an error for an account that is not configured")
+	}
+}
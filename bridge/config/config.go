@@ -1,59 +1,164 @@
 package config
 
 import (
-	"github.com/BurntSushi/toml"
+	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	EVENT_JOIN_LEAVE = "join_leave"
+	EVENT_JOIN_LEAVE   = "join_leave"
+	EVENT_USER_ACTION  = "user_action" // /me, Text is the action without the nick
+	EVENT_NICK_CHANGE  = "nick_change"
+	EVENT_KICK         = "kick"
+	EVENT_TOPIC_CHANGE = "topic_change"
+	EVENT_AWAY         = "away"
+	EVENT_USER_TYPING  = "user_typing" // Text is empty
+	EVENT_NOTICE       = "notice"      // notice of the server, the platform or a bot
 )
 
+// Events are the events a gateway can relay with its Events setting.
+// Join/leave events are relayed when the destination has ShowJoinPart.
+var Events = []string{EVENT_USER_ACTION, EVENT_NICK_CHANGE, EVENT_KICK, EVENT_TOPIC_CHANGE, EVENT_AWAY,
+	EVENT_USER_TYPING, EVENT_NOTICE}
+
+// DefaultEvents are relayed by gateways without Events setting.
+var DefaultEvents = []string{EVENT_USER_ACTION, EVENT_NOTICE}
+
+// RelayEvent returns true if a gateway with the Events setting events relays event.
+func RelayEvent(events []string, event string) bool {
+	if event == "" || event == EVENT_JOIN_LEAVE {
+		return true
+	}
+	if events == nil {
+		events = DefaultEvents
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// RelaysEvent returns true if an enabled gateway relays event from account.
+func (cfg *Config) RelaysEvent(account string, event string) bool {
+	for _, gw := range cfg.Gateway {
+		if !gw.Enable || !RelayEvent(gw.Events, event) {
+			continue
+		}
+		for _, br := range append(gw.In, gw.InOut...) {
+			if br.Account == account {
+				return true
+			}
+		}
+	}
+	for _, gw := range cfg.SameChannelGateway {
+		if !gw.Enable || !RelayEvent(gw.Events, event) {
+			continue
+		}
+		for _, a := range gw.Accounts {
+			if a == account {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type Message struct {
-	Text     string
-	Channel  string
-	Username string
-	Avatar   string
-	Account  string
-	Event    string
+	Text        string
+	Channel     string
+	Username    string
+	DisplayName string
+	Avatar      string
+	Account     string
+	Event       string
+	Nicks       []string  // join_leave, away: the users of the event
+	Color       string    // color chosen by the user ("#rrggbb"), twitch
+	Timestamp   time.Time // when the message was sent, set by the source bridge
+	Origin      *Origin   // set on messages relayed by another matterbridge instance
+}
+
+// Origin describes where a message relayed by another matterbridge instance was
+// received, so it can be formatted as if it was received locally.
+type Origin struct {
+	Account  string   // account of the source bridge (eg irc.freenode)
+	Protocol string   // protocol of the source bridge
+	Bridge   string   // name of the source bridge
+	Label    string   // Label of the source bridge
+	Channel  string   // channel the message was sent on
+	Gateway  string   // gateway of the source instance
+	Path     []string // instances the message was relayed by, to prevent loops
 }
 
 type Protocol struct {
-	BindAddress            string // mattermost, slack
-	IconURL                string // mattermost, slack
-	IgnoreNicks            string // all protocols
-	Jid                    string // xmpp
-	Login                  string // mattermost
-	Muc                    string // xmpp
-	Name                   string // all protocols
-	Nick                   string // all protocols
-	NickFormatter          string // mattermost, slack
-	NickServNick           string // IRC
-	NickServPassword       string // IRC
-	NicksPerRow            int    // mattermost, slack
-	NoTLS                  bool   // mattermost
-	Password               string // IRC,mattermost,XMPP
-	PrefixMessagesWithNick bool   // mattemost, slack
-	Protocol               string //all protocols
-	MessageQueue           int    // IRC, size of message queue for flood control
-	MessageDelay           int    // IRC, time in millisecond to wait between messages
-	RemoteNickFormat       string // all protocols
-	Server                 string // IRC,mattermost,XMPP,discord
-	ShowJoinPart           bool   // all protocols
-	SkipTLSVerify          bool   // IRC, mattermost
-	Team                   string // mattermost
-	Token                  string // gitter, slack, discord
-	URL                    string // mattermost, slack
-	UseAPI                 bool   // mattermost, slack
-	UseSASL                bool   // IRC
-	UseTLS                 bool   // IRC
+	AwayAfter              int      // general, minutes without messages after which an away event is sent
+	BindAddress            string   // mattermost, slack, matterbridge, email (SMTP listener), webhook
+	ChannelRefresh         int      // general, seconds between looking for new channels matching a pattern
+	ColorNicks             bool     // IRC, XMPP
+	ColorPalette           []int    // IRC, XMPP
+	DelayedThreshold       int      // all protocols, seconds after which a relayed message is marked as delayed
+	DryRun                 bool     // general, use loopback bridges instead of connecting
+	IconURL                string   // mattermost, slack
+	EventFormat            string   // all protocols
+	IgnoreNicks            string   // all protocols
+	Identities             []string // general, nicks of the same user on different accounts ("irc.freenode:alice slack.team:alice.s")
+	Jid                    string   // xmpp
+	JoinPartActive         int      // general and all protocols, only show joins/parts of users active in the last JoinPartActive minutes
+	JoinPartFormat         string   // all protocols
+	JoinPartWindow         int      // IRC, seconds to wait for more joins, parts and quits to coalesce
+	Label                  string   // all protocols
+	Login                  string   // mattermost, matrix, zulip (email of the bot), email (SMTP)
+	Muc                    string   // xmpp
+	Name                   string   // all protocols
+	Nick                   string   // all protocols
+	NickFormatter          string   // mattermost, slack
+	NickServNick           string   // IRC
+	NickServPassword       string   // IRC
+	NicksPerRow            int      // mattermost, slack
+	NoTLS                  bool     // mattermost, matterbridge
+	Password               string   // IRC,mattermost,XMPP,matrix,twitch (oauth token),email (SMTP)
+	PasteBindAddress       string   // general, address the paste server listens on
+	PasteRetention         int      // general, hours to keep pastes
+	PasteURL               string   // general, base URL of the paste server
+	PrefixMessagesWithNick bool     // mattemost, slack
+	Protocol               string   //all protocols
+	QuitMessage            string   // IRC, XMPP
+	MessageQueue           int      // IRC, size of message queue for flood control
+	MessageDelay           int      // IRC, time in millisecond to wait between messages
+	MessageLength          int      // IRC, discord, telegram, XMPP: maximum length of a message
+	Multiline              string   // IRC, XMPP: what to do with multiline messages ("", "join" or "upload")
+	MultilineMaxBytes      int      // IRC, XMPP: upload messages longer than this (Multiline="upload")
+	MultilineMaxLines      int      // IRC, XMPP: upload messages with more lines than this (Multiline="upload")
+	MultilineSeparator     string   // IRC, XMPP: separator between the lines (Multiline="join")
+	RemoteNickFormat       string   // all protocols
+	Server                 string   // IRC,mattermost,XMPP,discord,matterbridge,matrix,zulip,email (SMTP server)
+	ShowJoinPart           bool     // all protocols
+	ShutdownTimeout        int      // general, seconds to wait for queued messages on shutdown
+	SkipTLSVerify          bool     // IRC, mattermost, matterbridge
+	Team                   string   // mattermost
+	Token                  string   // gitter, slack, discord, matterbridge, matrix, zulip (API key), webhook (secret)
+	URL                    string   // mattermost, slack
+	UseAPI                 bool     // mattermost, slack
+	UseSASL                bool     // IRC
+	UseTLS                 bool     // IRC
+
+	// Settings of the protocol that are not above, see ProtocolInfo.Settings.
+	Settings interface{} `toml:"-"`
+	section  *section    // raw section of the account, see Decode
 }
 
 type ChannelOptions struct {
-	Key string // irc
+	Key              string // irc
+	AutoCreate       bool   // mattermost, slack, discord, xmpp: create the channel if it does not exist
+	EventFormat      string // all protocols
+	JoinPartFormat   string // all protocols
+	RemoteNickFormat string // all protocols
 }
 
 type Bridge struct {
@@ -65,6 +170,7 @@ type Bridge struct {
 type Gateway struct {
 	Name   string
 	Enable bool
+	Events []string // events to relay (default DefaultEvents)
 	In     []Bridge
 	Out    []Bridge
 	InOut  []Bridge
@@ -73,66 +179,93 @@ type Gateway struct {
 type SameChannelGateway struct {
 	Name     string
 	Enable   bool
+	Events   []string // events to relay (default DefaultEvents)
 	Channels []string
 	Accounts []string
 }
 
 type Config struct {
-	IRC                map[string]Protocol
-	Mattermost         map[string]Protocol
-	Slack              map[string]Protocol
-	Gitter             map[string]Protocol
-	Xmpp               map[string]Protocol
-	Discord            map[string]Protocol
-	Telegram           map[string]Protocol
-	Rocketchat         map[string]Protocol
+	Protocols          map[string]map[string]Protocol `toml:"-"` // accounts by protocol and name
 	General            Protocol
 	Gateway            []Gateway
 	SameChannelGateway []SameChannelGateway
 }
 
 func NewConfig(cfgfile string) *Config {
-	var cfg Config
-	if _, err := toml.DecodeFile(cfgfile, &cfg); err != nil {
-		log.Fatal(err)
+	cfg, errs := LoadConfig(cfgfile)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println(err)
+		}
+		log.Fatalf("config: %d problem(s) found in %s", len(errs), cfgfile)
 	}
-	return &cfg
+	return cfg
 }
 
 func OverrideCfgFromEnv(cfg *Config, protocol string, account string) {
-	var protoCfg Protocol
-	val := reflect.ValueOf(cfg).Elem()
-	// loop over the Config struct
-	for i := 0; i < val.NumField(); i++ {
-		typeField := val.Type().Field(i)
-		// look for the protocol map (both lowercase)
-		if strings.ToLower(typeField.Name) == protocol {
-			// get the Protocol struct from the map
-			data := val.Field(i).MapIndex(reflect.ValueOf(account))
-			protoCfg = data.Interface().(Protocol)
-			protoStruct := reflect.ValueOf(&protoCfg).Elem()
-			// loop over the found protocol struct
-			for i := 0; i < protoStruct.NumField(); i++ {
-				typeField := protoStruct.Type().Field(i)
-				// build our environment key (eg MATTERBRIDGE_MATTERMOST_WORK_LOGIN)
-				key := "matterbridge_" + protocol + "_" + account + "_" + typeField.Name
-				key = strings.ToUpper(key)
-				// search the environment
-				res := os.Getenv(key)
-				// if it exists and the current field is a string
-				// then update the current field
-				if res != "" {
-					fieldVal := protoStruct.Field(i)
-					if fieldVal.Kind() == reflect.String {
-						log.Printf("config: overriding %s from env with %s\n", key, res)
-						fieldVal.Set(reflect.ValueOf(res))
-					}
-				}
+	protoCfg, ok := cfg.Account(protocol + "." + account)
+	if !ok {
+		return
+	}
+	prefix := "matterbridge_" + protocol + "_" + account + "_"
+	overrideFromEnv(reflect.ValueOf(&protoCfg).Elem(), prefix)
+	// the settings of the protocol are overridden in place
+	if settings := reflect.ValueOf(protoCfg.Settings); settings.Kind() == reflect.Ptr && settings.Elem().Kind() == reflect.Struct {
+		overrideFromEnv(settings.Elem(), prefix)
+	}
+	cfg.SetAccount(protocol+"."+account, protoCfg)
+}
+
+// overrideFromEnv sets the fields of the struct protoStruct from the
+// environment keys prefix+field.
+func overrideFromEnv(protoStruct reflect.Value, prefix string) {
+	// loop over the found protocol struct
+	for i := 0; i < protoStruct.NumField(); i++ {
+		typeField := protoStruct.Type().Field(i)
+		if typeField.PkgPath != "" {
+			continue
+		}
+		// build our environment key (eg MATTERBRIDGE_MATTERMOST_WORK_LOGIN)
+		key := prefix + typeField.Name
+		key = strings.ToUpper(key)
+		// search the environment, KEY_FILE contains the name of a file with the value (docker secrets)
+		res := os.Getenv(key)
+		if file := os.Getenv(key + "_FILE"); file != "" {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				log.Printf("config: reading %s_FILE failed: %s\n", key, err)
+				continue
+			}
+			key += "_FILE"
+			res = strings.TrimRight(string(content), "\r\n")
+		}
+		if res == "" {
+			continue
+		}
+		// if it exists update the current field (string, bool or int)
+		fieldVal := protoStruct.Field(i)
+		switch fieldVal.Kind() {
+		case reflect.String:
+			fieldVal.SetString(res)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(res)
+			if err != nil {
+				log.Printf("config: ignoring %s: %s\n", key, err)
+				continue
+			}
+			fieldVal.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(res)
+			if err != nil {
+				log.Printf("config: ignoring %s: %s\n", key, err)
+				continue
 			}
-			// update the map with the modified Protocol (cfg.Protocol[account] = Protocol)
-			val.Field(i).SetMapIndex(reflect.ValueOf(account), reflect.ValueOf(protoCfg))
-			break
+			fieldVal.SetInt(int64(n))
+		default:
+			continue
 		}
+		// never log the value, it probably is a secret
+		log.Printf("config: overriding %s from env\n", key)
 	}
 }
 
@@ -0,0 +1,181 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// secretFields are always treated as secrets, even when set in plaintext.
+// URL is one of them because the webhook URLs contain their token.
+var secretFields = map[string]bool{"Password": true, "NickServPassword": true, "Token": true, "URL": true}
+
+var (
+	secrets   []string
+	secretsMu sync.RWMutex
+)
+
+// addSecret registers a value that must never be logged.
+func addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// Redact replaces the known secrets in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, "<redacted>", -1)
+	}
+	return s
+}
+
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(r.w, Redact(string(p)))
+	return len(p), err
+}
+
+// RedactWriter returns a writer that removes the known secrets before writing to w.
+// Use it as output for loggers.
+func RedactWriter(w io.Writer) io.Writer {
+	return redactWriter{w}
+}
+
+// ResolveSecret resolves a reference to a secret:
+// "file:/path" returns the content of the file, "env:NAME" the environment
+// variable NAME and "exec:command" the output of command.
+// Other values are returned unchanged. ok is true when value was a reference.
+func ResolveSecret(value string) (secret string, ok bool, err error) {
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		content, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", true, err
+		}
+		return strings.TrimRight(string(content), "\r\n"), true, nil
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, found := os.LookupEnv(name)
+		if !found {
+			return "", true, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, true, nil
+	case strings.HasPrefix(value, "exec:"):
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", strings.TrimPrefix(value, "exec:"))
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", true, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(out), "\r\n"), true, nil
+	}
+	return value, false, nil
+}
+
+// resolveSecrets resolves the secret references in every string of cfg and
+// registers the secrets so they are not logged.
+func (v *validator) resolveSecrets() {
+	v.walkStrings(reflect.ValueOf(v.cfg).Elem(), "")
+}
+
+func (v *validator) walkStrings(val reflect.Value, path string) {
+	join := func(name string) string {
+		if path == "" {
+			return strings.ToLower(name)
+		}
+		return path + "." + strings.ToLower(name)
+	}
+	switch val.Kind() {
+	case reflect.Struct:
+		for i := 0; i < val.NumField(); i++ {
+			field := val.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if field.Type.Kind() == reflect.String {
+				v.resolveField(val.Field(i), join(field.Name), secretFields[field.Name])
+				continue
+			}
+			if field.Tag.Get("toml") == "-" {
+				// not a section of the file, eg the accounts of Protocols
+				// or the Settings of an account
+				v.walkStrings(val.Field(i), path)
+				continue
+			}
+			v.walkStrings(val.Field(i), join(field.Name))
+		}
+	case reflect.Map:
+		for _, key := range val.MapKeys() {
+			// map values are not addressable, work on a copy
+			elem := reflect.New(val.Type().Elem()).Elem()
+			elem.Set(val.MapIndex(key))
+			v.walkStrings(elem, join(key.String()))
+			val.SetMapIndex(key, elem)
+		}
+	case reflect.Slice:
+		for i := 0; i < val.Len(); i++ {
+			v.walkStrings(val.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Interface, reflect.Ptr:
+		if !val.IsNil() {
+			v.walkStrings(val.Elem(), path)
+		}
+	}
+}
+
+func (v *validator) resolveField(field reflect.Value, path string, secret bool) {
+	value, ok, err := ResolveSecret(field.String())
+	if err != nil {
+		v.errorf(path, "%s: resolving secret failed: %s", path, err)
+		return
+	}
+	if ok || secret {
+		addSecret(value)
+	}
+	field.SetString(value)
+}
+
+// protocol has no methods, so it can be printed without calling GoString again.
+type protocol Protocol
+
+// GoString hides the secrets when a Protocol is printed with %#v.
+func (p Protocol) GoString() string {
+	return fmt.Sprintf("%#v", protocol(p.redacted()))
+}
+
+// String hides the secrets when a Protocol is printed with %v.
+func (p Protocol) String() string {
+	return fmt.Sprintf("%v", protocol(p.redacted()))
+}
+
+func (p Protocol) redacted() Protocol {
+	val := reflect.ValueOf(&p).Elem()
+	for name := range secretFields {
+		field := val.FieldByName(name)
+		if field.IsValid() && field.String() != "" {
+			field.SetString("<redacted>")
+		}
+	}
+	return p
+}
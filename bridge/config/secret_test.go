@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("MATTERBRIDGE_TEST_SECRET", "from-env")
+	defer os.Unsetenv("MATTERBRIDGE_TEST_SECRET")
+	for _, test := range []struct {
+		value, want string
+		ok, err     bool
+	}{
+		{"plain", "plain", false, false},
+		{"file:" + file, "from-file", true, false},
+		{"file:" + filepath.Join(dir, "missing"), "", true, true},
+		{"env:MATTERBRIDGE_TEST_SECRET", "from-env", true, false},
+		{"env:MATTERBRIDGE_TEST_UNSET", "", true, true},
+		{"exec:echo from-exec", "from-exec", true, false},
+		{"exec:exit 1", "", true, true},
+	} {
+		secret, ok, err := ResolveSecret(test.value)
+		if secret != test.want || ok != test.ok || (err != nil) != test.err {
+			t.Errorf("ResolveSecret(%q) = %q, %v, %v", test.value, secret, ok, err)
+		}
+	}
+}
+
+func TestLoadConfigSecrets(t *testing.T) {
+	RegisterProtocol("irc", ProtocolInfo{Required: Require("Server", "Nick")})
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfgfile := filepath.Join(dir, "matterbridge.toml")
+	os.Setenv("MATTERBRIDGE_TEST_TOKEN", "t0k3n-from-env")
+	defer os.Unsetenv("MATTERBRIDGE_TEST_TOKEN")
+	os.Setenv("MATTERBRIDGE_TEST_CHANNEL", "#from-env")
+	defer os.Unsetenv("MATTERBRIDGE_TEST_CHANNEL")
+	content := `[irc.test]
+Server="irc.example.com:6667"
+Nick="bot"
+Password="exec:echo s3cr3t-from-exec"
+NickServPassword="env:MATTERBRIDGE_TEST_TOKEN"
+RemoteNickFormat="exec:echo '[{{.Nick}}] '"
+URL="https://hooks.example.com/h00k"
+
+[[gateway]]
+name="test"
+enable=true
+[[gateway.inout]]
+account="irc.test"
+channel="env:MATTERBRIDGE_TEST_CHANNEL"
+[gateway.inout.options]
+key="k3y"
+`
+	if err := ioutil.WriteFile(cfgfile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, errs := LoadConfig(cfgfile)
+	if cfg == nil {
+		t.Fatal(errs)
+	}
+	irc, _ := cfg.Account("irc.test")
+	if irc.Password != "s3cr3t-from-exec" || irc.NickServPassword != "t0k3n-from-env" {
+		t.Errorf("credentials not resolved: %q %q", irc.Password, irc.NickServPassword)
+	}
+	if irc.RemoteNickFormat != "[{{.Nick}}] " || cfg.Gateway[0].InOut[0].Channel != "#from-env" {
+		t.Errorf("references not resolved: %q %q", irc.RemoteNickFormat, cfg.Gateway[0].InOut[0].Channel)
+	}
+
+	// the resolved secrets and the URLs are redacted, the channel keys are not
+	if key := cfg.Gateway[0].InOut[0].Options.Key; key != "k3y" {
+		t.Fatalf("unexpected channel key %q", key)
+	}
+	line := Redact("password s3cr3t-from-exec and token t0k3n-from-env to https://hooks.example.com/h00k, key k3y")
+	if line != "password <redacted> and token <redacted> to <redacted>, key k3y" {
+		t.Errorf("unexpected redacted line %q", line)
+	}
+	for _, s := range []string{fmt.Sprintf("%v", irc), fmt.Sprintf("%#v", irc)} {
+		if strings.Contains(s, "s3cr3t") || strings.Contains(s, "t0k3n") || strings.Contains(s, "h00k") ||
+			!strings.Contains(s, "irc.example.com") {
+			t.Errorf("secrets not hidden in %s", s)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package config
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ValidationError is a problem found in the configuration file.
+type ValidationError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// LoadConfig loads cfgfile and returns the configuration with every problem found in it.
+func LoadConfig(cfgfile string) (*Config, []error) {
+	var cfg Config
+	md, err := toml.DecodeFile(cfgfile, &cfg)
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", cfgfile, err)}
+	}
+	mdProtocols, err := cfg.decodeProtocols(cfgfile)
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: %s", cfgfile, err)}
+	}
+	content, err := ioutil.ReadFile(cfgfile)
+	if err != nil {
+		return nil, []error{err}
+	}
+	v := &validator{file: cfgfile, cfg: &cfg}
+	v.mapLines(md, strings.Split(string(content), "\n"))
+	// override config from environment
+	for account := range cfg.Accounts() {
+		accInfo := strings.Split(account, ".")
+		OverrideCfgFromEnv(&cfg, accInfo[0], accInfo[1])
+	}
+	v.resolveSecrets()
+	v.checkUndecoded(md, mdProtocols)
+	v.checkAccounts()
+	v.checkGateways()
+	return &cfg, v.errors
+}
+
+type validator struct {
+	file   string
+	cfg    *Config
+	lines  map[string]int // line numbers by lowercase key path, e.g. gateway[0].inout[1].account
+	errors []error
+}
+
+func (v *validator) errorf(key string, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{File: v.file, Line: v.line(key), Msg: fmt.Sprintf(format, args...)})
+}
+
+// line returns the line of key, or of its closest parent when key is not in the file.
+func (v *validator) line(key string) int {
+	key = strings.ToLower(key)
+	for key != "" {
+		if line, ok := v.lines[key]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i == -1 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0
+}
+
+// mapLines finds the line of every key in the document.
+// The keys of md are in document order, so the lines are searched sequentially.
+func (v *validator) mapLines(md toml.MetaData, lines []string) {
+	v.lines = make(map[string]int)
+	counters := make(map[string]int)
+	pos := 0
+	for _, key := range md.Keys() {
+		table := md.Type(key...) == "Hash" || md.Type(key...) == "ArrayHash"
+		for i := pos; i < len(lines); i++ {
+			if matchKey(lines[i], key, table) {
+				v.lines[indexedKey(md, key, counters)] = i + 1
+				pos = i + 1
+				break
+			}
+		}
+	}
+}
+
+// indexedKey returns key with the indexes of array tables, e.g. gateway[0].in[1].account.
+func indexedKey(md toml.MetaData, key toml.Key, counters map[string]int) string {
+	path := ""
+	for i := range key {
+		if path != "" {
+			path += "."
+		}
+		path += strings.ToLower(key[i])
+		if md.Type(key[:i+1]...) == "ArrayHash" {
+			if i == len(key)-1 {
+				counters[path]++
+			}
+			path += fmt.Sprintf("[%d]", counters[path]-1)
+		}
+	}
+	return path
+}
+
+// matchKey returns true if line defines key.
+func matchKey(line string, key toml.Key, table bool) bool {
+	line = strings.TrimSpace(line)
+	if table {
+		if !strings.HasPrefix(line, "[") {
+			return false
+		}
+		line = strings.Trim(line[:strings.LastIndex(line, "]")+1], "[] ")
+		return strings.EqualFold(line, strings.Join(key, "."))
+	}
+	i := strings.Index(line, "=")
+	if i == -1 {
+		return false
+	}
+	return strings.EqualFold(strings.Trim(strings.TrimSpace(line[:i]), `"`), key[len(key)-1])
+}
+
+// checkUndecoded reports the unknown settings. The sections of the registered
+// protocols are decoded in mdProtocols.
+func (v *validator) checkUndecoded(md toml.MetaData, mdProtocols toml.MetaData) {
+	var undecoded []toml.Key
+	for _, key := range md.Undecoded() {
+		if _, ok := protocolInfo(key[0]); !ok {
+			undecoded = append(undecoded, key)
+		}
+	}
+	for _, key := range mdProtocols.Undecoded() {
+		if _, ok := protocolInfo(key[0]); ok {
+			undecoded = append(undecoded, key)
+		}
+	}
+	reported := make(map[string]bool)
+	for _, key := range undecoded {
+		// only report the topmost unknown key
+		if reported[key[:len(key)-1].String()] {
+			reported[key.String()] = true
+			continue
+		}
+		reported[key.String()] = true
+		if !v.knownSection(key[0]) {
+			reported[key[0]] = true
+			v.errorf(key.String(), "unknown protocol or section %q (supported protocols: %s)", key[0], strings.Join(Protocols(), ", "))
+			continue
+		}
+		v.errorf(key.String(), "unknown setting %q", key.String())
+	}
+}
+
+// knownSection returns true if name is a top level section of the config.
+func (v *validator) knownSection(name string) bool {
+	field, ok := reflect.TypeOf(v.cfg).Elem().FieldByNameFunc(func(field string) bool {
+		return strings.EqualFold(field, name)
+	})
+	_, protocol := protocolInfo(name)
+	return ok && field.Tag.Get("toml") != "-" || protocol
+}
+
+func (v *validator) checkAccounts() {
+	accounts := v.cfg.Accounts()
+	names := make([]string, 0, len(accounts))
+	for account := range accounts {
+		names = append(names, account)
+	}
+	sort.Strings(names)
+	for _, account := range names {
+		protocol := accounts[account]
+		if protocol.BindAddress != "" {
+			v.checkBindAddress(account+".bindaddress", account, protocol.BindAddress)
+		}
+		if info, ok := protocolInfo(strings.Split(account, ".")[0]); ok && info.Check != nil {
+			for _, err := range info.Check(protocol) {
+				key := account
+				if serr, ok := err.(*SettingError); ok {
+					key += "." + strings.ToLower(serr.Setting)
+				}
+				v.errorf(key, "%s: %s", account, err)
+			}
+		}
+		v.checkTemplates(account, account, protocol)
+	}
+	if v.cfg.General.PasteBindAddress != "" {
+		v.checkBindAddress("general.pastebindaddress", "general", v.cfg.General.PasteBindAddress)
+	}
+	if _, err := helper.ParseIdentities(v.cfg.General.Identities); err != nil {
+		v.errorf("general.identities", "general: invalid Identities: %s", err)
+	}
+	v.checkTemplates("general", "general", v.cfg.General)
+}
+
+func (v *validator) checkBindAddress(key string, account string, address string) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		v.errorf(key, "%s: invalid BindAddress %q: %s", account, address, err)
+	}
+}
+
+// checkTemplates checks the formats of protocol, defined in the section key of the file.
+func (v *validator) checkTemplates(key string, section string, protocol Protocol) {
+	formats := map[string]string{"RemoteNickFormat": protocol.RemoteNickFormat,
+		"JoinPartFormat": protocol.JoinPartFormat, "EventFormat": protocol.EventFormat}
+	for _, name := range []string{"RemoteNickFormat", "JoinPartFormat", "EventFormat"} {
+		if _, err := helper.ParseTemplate(name, formats[name]); err != nil {
+			v.errorf(key+"."+strings.ToLower(name), "%s: invalid %s: %s", section, name, err)
+		}
+	}
+}
+
+// checkEvents checks the Events setting of gateway.
+func (v *validator) checkEvents(key string, gateway string, events []string) {
+	for _, event := range events {
+		known := false
+		for _, e := range Events {
+			known = known || e == event
+		}
+		if !known {
+			v.errorf(key, "gateway %s: unknown event %q (supported events: %s)", gateway, event, strings.Join(Events, ", "))
+		}
+	}
+}
+
+// checkAccount checks if account used at key exists and has its required settings.
+func (v *validator) checkAccount(key string, account string, checked map[string]bool) {
+	accInfo := strings.Split(account, ".")
+	if len(accInfo) != 2 || accInfo[0] == "" || accInfo[1] == "" {
+		v.errorf(key, "invalid account %q, it must look like protocol.name (eg irc.freenode)", account)
+		return
+	}
+	info, known := protocolInfo(accInfo[0])
+	protocol, ok := v.cfg.Account(account)
+	if !ok {
+		if !known {
+			v.errorf(key, "account %q uses unknown protocol %q (supported protocols: %s)", account, accInfo[0], strings.Join(Protocols(), ", "))
+			return
+		}
+		v.errorf(key, "account %q is not configured, add a [%s] section", account, account)
+		return
+	}
+	if checked[account] {
+		return
+	}
+	checked[account] = true
+	if info.Required == nil {
+		return
+	}
+	for _, field := range info.Required(protocol) {
+		if value := protocol.setting(field); !value.IsValid() || value.String() == "" {
+			v.errorf(strings.ToLower(account), "%s: missing required setting %s", account, field)
+		}
+	}
+}
+
+// setting returns the setting name of p, it is looked up in the fields of
+// Protocol and then in its Settings.
+func (p Protocol) setting(name string) reflect.Value {
+	if field := reflect.ValueOf(p).FieldByName(name); field.IsValid() {
+		return field
+	}
+	settings := reflect.ValueOf(p.Settings)
+	if settings.Kind() != reflect.Ptr || settings.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return settings.Elem().FieldByName(name)
+}
+
+func (v *validator) checkGateways() {
+	checked := make(map[string]bool)
+	// account+channel to the gateway using it
+	used := make(map[string]string)
+	for i, gw := range v.cfg.Gateway {
+		if !gw.Enable {
+			continue
+		}
+		v.checkEvents(fmt.Sprintf("gateway[%d].events", i), gw.Name, gw.Events)
+		seen := make(map[string]bool)
+		hasPattern, template := false, ""
+		for _, dir := range []struct {
+			name    string
+			bridges []Bridge
+		}{{"in", gw.In}, {"out", gw.Out}, {"inout", gw.InOut}} {
+			for j, br := range dir.bridges {
+				key := fmt.Sprintf("gateway[%d].%s[%d]", i, dir.name, j)
+				v.checkAccount(key+".account", br.Account, checked)
+				if br.Channel == "" {
+					v.errorf(key, "gateway %s: missing channel for account %s", gw.Name, br.Account)
+					continue
+				}
+				switch n := strings.Count(br.Channel, "*"); {
+				case n > 0:
+					hasPattern = true
+					if n > 1 {
+						v.errorf(key+".channel", "gateway %s: channel pattern %q of account %s can only contain one *", gw.Name, br.Channel, br.Account)
+					}
+				case strings.Contains(br.Channel, "{name}"):
+					template = br.Channel
+				}
+				if info, _ := protocolInfo(strings.Split(br.Account, ".")[0]); br.Options.AutoCreate && !info.AutoCreate {
+					v.errorf(key+".options.autocreate", "gateway %s: AutoCreate is not supported for account %s", gw.Name, br.Account)
+				}
+				v.checkTemplates(key+".options", fmt.Sprintf("gateway %s (%s %s)", gw.Name, br.Account, br.Channel),
+					Protocol{RemoteNickFormat: br.Options.RemoteNickFormat, JoinPartFormat: br.Options.JoinPartFormat,
+						EventFormat: br.Options.EventFormat})
+				id := br.Account + " " + br.Channel
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				if other, ok := used[id]; ok {
+					v.errorf(key+".channel", "channel %s of account %s is used in gateway %s and gateway %s", br.Channel, br.Account, other, gw.Name)
+					continue
+				}
+				used[id] = gw.Name
+			}
+		}
+		if template != "" && !hasPattern {
+			v.errorf(fmt.Sprintf("gateway[%d]", i), "gateway %s: channel %q uses {name}, but no channel pattern with * is configured", gw.Name, template)
+		}
+	}
+	for i, gw := range v.cfg.SameChannelGateway {
+		if !gw.Enable {
+			continue
+		}
+		v.checkEvents(fmt.Sprintf("samechannelgateway[%d].events", i), gw.Name, gw.Events)
+		for _, account := range gw.Accounts {
+			v.checkAccount(fmt.Sprintf("samechannelgateway[%d].accounts", i), account, checked)
+		}
+	}
+}
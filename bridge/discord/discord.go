@@ -1,10 +1,15 @@
 package bdiscord
 
 import (
+	"context"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	log "github.com/Sirupsen/logrus"
 	"github.com/bwmarrin/discordgo"
 	"strings"
+	"sync"
 )
 
 type bdiscord struct {
@@ -15,13 +20,23 @@ type bdiscord struct {
 	Channels     []*discordgo.Channel
 	Nick         string
 	UseChannelID bool
+	guildID      string
+	userID       string
+	typing       bool // a gateway relays the typing notifications
+	sync.RWMutex
 }
 
 var flog *log.Entry
 var protocol = "discord"
 
+// messageLength is the maximum amount of characters in a discord message
+const messageLength = 2000
+
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Token", "Server"), AutoCreate: true})
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *bdiscord {
@@ -29,9 +44,15 @@ func New(cfg config.Protocol, account string, c chan config.Message) *bdiscord {
 	b.Config = &cfg
 	b.Remote = c
 	b.Account = account
+	b.typing = true
 	return b
 }
 
+// FilterEvents implements bridge.EventFilter.
+func (b *bdiscord) FilterEvents(relayed func(event string) bool) {
+	b.typing = relayed(config.EVENT_USER_TYPING)
+}
+
 func (b *bdiscord) Connect() error {
 	var err error
 	flog.Info("Connecting")
@@ -45,6 +66,8 @@ func (b *bdiscord) Connect() error {
 	}
 	flog.Info("Connection succeeded")
 	b.c.AddHandler(b.messageCreate)
+	b.c.AddHandler(b.typingStart)
+	b.c.AddHandler(b.channelUpdate)
 	err = b.c.Open()
 	if err != nil {
 		flog.Debugf("%#v", err)
@@ -61,8 +84,10 @@ func (b *bdiscord) Connect() error {
 		return err
 	}
 	b.Nick = userinfo.Username
+	b.userID = userinfo.ID
 	for _, guild := range guilds {
 		if guild.Name == b.Config.Server {
+			b.guildID = guild.ID
 			b.Channels, err = b.c.GuildChannels(guild.ID)
 			if err != nil {
 				flog.Debugf("%#v", err)
@@ -73,6 +98,14 @@ func (b *bdiscord) Connect() error {
 	return nil
 }
 
+func (b *bdiscord) Disconnect(ctx context.Context) error {
+	if b.c == nil {
+		return nil
+	}
+	flog.Info("Disconnecting")
+	return b.c.Close()
+}
+
 func (b *bdiscord) JoinChannel(channel string) error {
 	idcheck := strings.Split(channel, "ID:")
 	if len(idcheck) > 1 {
@@ -88,8 +121,20 @@ func (b *bdiscord) Send(msg config.Message) error {
 		flog.Errorf("Could not find channelID for %v", msg.Channel)
 		return nil
 	}
-	b.c.ChannelMessageSend(channelID, msg.Username+msg.Text)
-	return nil
+	if msg.Event == config.EVENT_USER_TYPING {
+		return b.c.ChannelTyping(channelID)
+	}
+	_, err := b.c.ChannelMessageSend(channelID, msg.Text)
+	return err
+}
+
+// Capabilities implements bridge.Capable, discord shows /me in italics.
+func (b *bdiscord) Capabilities() helper.Capabilities {
+	limit := helper.Limit{Max: messageLength}
+	if b.Config.MessageLength != 0 {
+		limit.Max = b.Config.MessageLength
+	}
+	return helper.Capabilities{Multiline: true, Markup: helper.MarkupMarkdown, Limit: limit}
 }
 
 func (b *bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -110,8 +155,106 @@ func (b *bdiscord) messageCreate(s *discordgo.Session, m *discordgo.MessageCreat
 	if b.UseChannelID {
 		channelName = "ID:" + m.ChannelID
 	}
-	b.Remote <- config.Message{Username: m.Author.Username, Text: m.ContentWithMentionsReplaced(), Channel: channelName,
-		Account: b.Account, Avatar: "https://cdn.discordapp.com/avatars/" + m.Author.ID + "/" + m.Author.Avatar + ".jpg"}
+	rmsg := config.Message{Username: m.Author.Username, Text: m.ContentWithMentionsReplaced(), Channel: channelName,
+		Account: b.Account, Avatar: "https://cdn.discordapp.com/avatars/" + m.Author.ID + "/" + m.Author.Avatar + ".jpg",
+		Timestamp: helper.ParseTimestamp(m.Timestamp)}
+	// /me is sent as a message in italics
+	if isAction(rmsg.Text) {
+		rmsg.Text = rmsg.Text[1 : len(rmsg.Text)-1]
+		rmsg.Event = config.EVENT_USER_ACTION
+	}
+	b.Remote <- rmsg
+}
+
+// isAction returns true if text is a single line in italics ("_text_"), as
+// discord sends /me. Messages with several emphasized spans are not actions.
+func isAction(text string) bool {
+	if len(text) <= 2 || !strings.HasPrefix(text, "_") || !strings.HasSuffix(text, "_") {
+		return false
+	}
+	return !strings.ContainsAny(text[1:len(text)-1], "_\n")
+}
+
+func (b *bdiscord) typingStart(s *discordgo.Session, m *discordgo.TypingStart) {
+	if !b.typing || m.UserID == b.userID {
+		return
+	}
+	channelName := b.getChannelName(m.ChannelID)
+	if b.UseChannelID {
+		channelName = "ID:" + m.ChannelID
+	}
+	if channelName == "" {
+		return
+	}
+	// the members of the server are cached in the state
+	member, err := s.State.Member(b.guildID, m.UserID)
+	if err != nil {
+		flog.Debugf("unknown user %s: %s", m.UserID, err)
+		return
+	}
+	b.Remote <- config.Message{Username: member.User.Username, Channel: channelName, Account: b.Account, Event: config.EVENT_USER_TYPING}
+}
+
+// channelUpdate sends topic changes to the gateway.
+func (b *bdiscord) channelUpdate(s *discordgo.Session, m *discordgo.ChannelUpdate) {
+	b.Lock()
+	changed := false
+	for i, channel := range b.Channels {
+		if channel.ID == m.ID {
+			changed = channel.Topic != m.Topic
+			b.Channels[i] = m.Channel
+		}
+	}
+	b.Unlock()
+	if !changed {
+		return
+	}
+	channelName := m.Name
+	if b.UseChannelID {
+		channelName = "ID:" + m.ID
+	}
+	b.Remote <- config.Message{Username: "system", Text: "the topic changed to: " + m.Topic, Channel: channelName,
+		Account: b.Account, Event: config.EVENT_TOPIC_CHANGE}
+}
+
+// ListChannels returns the names of the text channels of the server.
+func (b *bdiscord) ListChannels() ([]string, error) {
+	if b.guildID == "" {
+		return nil, fmt.Errorf("%s: server %s not found", b.Account, b.Config.Server)
+	}
+	channels, err := b.c.GuildChannels(b.guildID)
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	b.Channels = channels
+	b.Unlock()
+	var names []string
+	for _, channel := range channels {
+		if channel.Type == "text" {
+			names = append(names, channel.Name)
+		}
+	}
+	return names, nil
+}
+
+// CreateChannel creates the text channel if it does not exist on the server.
+func (b *bdiscord) CreateChannel(channel string) error {
+	if b.getChannelID(channel) != "" {
+		return nil
+	}
+	if b.guildID == "" {
+		return fmt.Errorf("%s: server %s not found", b.Account, b.Config.Server)
+	}
+	flog.Infof("Creating channel %s", channel)
+	created, err := b.c.GuildChannelCreate(b.guildID, channel, "text")
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.Channels = append(b.Channels, created)
+	b.Unlock()
+	return nil
 }
 
 func (b *bdiscord) getChannelID(name string) string {
@@ -119,6 +262,8 @@ func (b *bdiscord) getChannelID(name string) string {
 	if len(idcheck) > 1 {
 		return idcheck[1]
 	}
+	b.RLock()
+	defer b.RUnlock()
 	for _, channel := range b.Channels {
 		if channel.Name == name {
 			return channel.ID
@@ -128,6 +273,8 @@ func (b *bdiscord) getChannelID(name string) string {
 }
 
 func (b *bdiscord) getChannelName(id string) string {
+	b.RLock()
+	defer b.RUnlock()
 	for _, channel := range b.Channels {
 		if channel.ID == id {
 			return channel.Name
@@ -0,0 +1,439 @@
+// Package bemail bridges mailing lists.
+//
+// The channels are the addresses of the lists. Mail is received on a local
+// SMTP listener (BindAddress), the mail server of the lists delivers or
+// forwards the mail of the lists to it, or polled from the mailbox of an IMAP
+// server (IMAPServer). The subject and the plain text body of each mail,
+// without the quoted replies and the signature, are relayed.
+//
+// Chat messages are sent with the SMTP server Server to the list, from the
+// address From with the nick as name. They reply to the last mail of the
+// list, so they are threaded with In-Reply-To and References headers.
+package bemail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	log "github.com/Sirupsen/logrus"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings are the settings of the email accounts that are not in config.Protocol.
+type Settings struct {
+	AllowedNetworks string // networks allowed to connect to the SMTP listener ("127.0.0.1 10.0.0.0/8")
+	From            string // address the messages are sent from
+	IMAPServer      string // IMAP server (host:port) polled for the mail of the lists, with Login and Password
+	Mailbox         string // mailbox of IMAPServer (default INBOX)
+	Nicks           string // nicks of the sender addresses ("address=nick address2=nick2")
+	PollInterval    int    // seconds between the polls of IMAPServer
+}
+
+type Bemail struct {
+	Config   *config.Protocol
+	settings Settings
+	Remote   chan config.Message
+	Account  string
+	listener net.Listener
+	networks []*net.IPNet      // allowed to connect to the listener
+	channels map[string]string // joined channels by lowercase address
+	threads  map[string]thread // last mail of each channel
+	conns    map[net.Conn]bool // open SMTP sessions
+	interval time.Duration     // between the polls of IMAPServer
+	stop     chan struct{}     // closed by Disconnect
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	sync.Mutex
+}
+
+// thread is the mail the next message of a channel replies to.
+type thread struct {
+	id      string // Message-ID
+	subject string
+}
+
+var flog *log.Entry
+var protocol = "email"
+
+// sendMail sends the mails, it is replaced by the tests.
+var sendMail = sendSMTP
+
+// sendTimeout bounds the SMTP transaction of a message.
+var sendTimeout = time.Minute
+
+const (
+	// subjectLength is the maximum amount of characters of the subject of a new thread.
+	subjectLength = 60
+	// defaultNetworks are the networks allowed to connect to the listener
+	// when AllowedNetworks is not set.
+	defaultNetworks = "127.0.0.0/8 ::1"
+	// defaultInterval is the delay between the polls without PollInterval setting.
+	defaultInterval = time.Minute
+)
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: required,
+		Settings: func() interface{} { return &Settings{} }, Check: check})
+}
+
+// required returns the settings required by an account with the settings cfg.
+func required(cfg config.Protocol) []string {
+	var settings Settings
+	if cfg.Decode(&settings) == nil && settings.IMAPServer != "" {
+		return []string{"Server", "From", "Login", "Password"}
+	}
+	return []string{"Server", "BindAddress", "From"}
+}
+
+// check checks the settings of an account.
+func check(cfg config.Protocol) []error {
+	var settings Settings
+	if err := cfg.Decode(&settings); err != nil {
+		return []error{err}
+	}
+	if _, err := helper.ParseNetworks(settings.AllowedNetworks); err != nil {
+		return []error{&config.SettingError{Setting: "AllowedNetworks", Err: err}}
+	}
+	return nil
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bemail {
+	b := &Bemail{}
+	b.Config = &cfg
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.Remote = c
+	b.Account = account
+	b.channels = make(map[string]string)
+	b.threads = make(map[string]thread)
+	b.conns = make(map[net.Conn]bool)
+	b.interval = defaultInterval
+	if b.settings.PollInterval > 0 {
+		b.interval = time.Duration(b.settings.PollInterval) * time.Second
+	}
+	b.stop = make(chan struct{})
+	return b
+}
+
+// Connect starts the SMTP listener and polling IMAPServer.
+func (b *Bemail) Connect() error {
+	if b.Config.BindAddress == "" && b.settings.IMAPServer == "" {
+		return errors.New("BindAddress or IMAPServer is required to receive the mail")
+	}
+	if b.Config.BindAddress != "" {
+		if err := b.listen(); err != nil {
+			return err
+		}
+	}
+	if b.settings.IMAPServer != "" {
+		flog.Infof("Polling %s every %s", b.settings.IMAPServer, b.interval)
+		b.wg.Add(1)
+		go b.pollLoop()
+	}
+	flog.Info("Connection succeeded")
+	return nil
+}
+
+// listen starts the SMTP listener of BindAddress.
+func (b *Bemail) listen() error {
+	networks := b.settings.AllowedNetworks
+	if networks == "" {
+		networks = defaultNetworks
+	}
+	var err error
+	if b.networks, err = helper.ParseNetworks(networks); err != nil {
+		return fmt.Errorf("invalid AllowedNetworks: %s", err)
+	}
+	flog.Infof("Listening for mail on %s", b.Config.BindAddress)
+	l, err := net.Listen("tcp", b.Config.BindAddress)
+	if err != nil {
+		return err
+	}
+	b.listener = l
+	go b.serve(l)
+	return nil
+}
+
+// Disconnect stops polling and the listener and closes the SMTP sessions, the
+// mails being received are retried by the sending server.
+func (b *Bemail) Disconnect(ctx context.Context) error {
+	b.stopOnce.Do(func() { close(b.stop) })
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	b.Lock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.Unlock()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// JoinChannel accepts the mail of the list channel.
+func (b *Bemail) JoinChannel(channel string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.channels[strings.ToLower(channel)] = channel
+	return nil
+}
+
+// Send mails msg to the list, as a reply to the last mail of the list.
+func (b *Bemail) Send(msg config.Message) error {
+	flog.Debugf("Receiving %#v", msg)
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
+	name := strings.TrimSpace(msg.Username)
+	text := msg.Text
+	if msg.Event == config.EVENT_USER_ACTION {
+		text = "* " + name + " " + text
+	}
+	id, err := messageID(b.settings.From)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	t, ok := b.threads[strings.ToLower(msg.Channel)]
+	subject := "Re: " + strings.TrimPrefix(t.subject, "Re: ")
+	if !ok {
+		subject = newSubject(text)
+	}
+	b.threads[strings.ToLower(msg.Channel)] = thread{id: id, subject: subject}
+	b.Unlock()
+
+	var buf bytes.Buffer
+	from := mail.Address{Name: name, Address: b.settings.From}
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.Channel)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: %s\r\n", id)
+	if ok {
+		fmt.Fprintf(&buf, "In-Reply-To: %s\r\nReferences: %s\r\n", t.id, t.id)
+	}
+	buf.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(strings.Replace(text, "\n", "\r\n", -1)))
+	w.Close()
+
+	var auth smtp.Auth
+	if b.Config.Login != "" {
+		host, _, _ := net.SplitHostPort(b.Config.Server)
+		auth = smtp.PlainAuth("", b.Config.Login, b.Config.Password, host)
+	}
+	return sendMail(b.Config.Server, auth, b.settings.From, []string{msg.Channel}, buf.Bytes())
+}
+
+// sendSMTP is smtp.SendMail with a timeout, so a stuck server does not block
+// the messages.
+func sendSMTP(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, sendTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// pollLoop polls IMAPServer every interval until Disconnect.
+func (b *Bemail) pollLoop() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := b.poll(); err != nil {
+			flog.Errorf("polling %s failed: %s", b.settings.IMAPServer, err)
+		}
+	}
+}
+
+// poll relays the unseen mail of the mailbox to the joined channels it is
+// sent to.
+func (b *Bemail) poll() error {
+	var tlsConfig *tls.Config
+	if !b.Config.NoTLS {
+		host, _, _ := net.SplitHostPort(b.settings.IMAPServer)
+		tlsConfig = &tls.Config{ServerName: host, InsecureSkipVerify: b.Config.SkipTLSVerify}
+	}
+	c, err := dialIMAP(b.settings.IMAPServer, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := c.cmd("LOGIN " + imapQuote(b.Config.Login) + " " + imapQuote(b.Config.Password)); err != nil {
+		return err
+	}
+	mailbox := b.settings.Mailbox
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	mails, err := c.fetchUnseen(mailbox)
+	if err != nil {
+		return err
+	}
+	c.cmd("LOGOUT")
+	for _, data := range mails {
+		m, err := parseMail(data)
+		if err != nil {
+			flog.Errorf("invalid mail: %s", err)
+			continue
+		}
+		var channels []string
+		seen := make(map[string]bool)
+		for _, address := range m.to {
+			if channel := b.channel(address); channel != "" && !seen[channel] {
+				seen[channel] = true
+				channels = append(channels, channel)
+			}
+		}
+		if len(channels) == 0 {
+			flog.Debugf("ignoring mail %s, it is not sent to a joined list", m.id)
+			continue
+		}
+		b.deliver(m, channels)
+	}
+	return nil
+}
+
+// Capabilities implements bridge.Capable, the nick is the name of the sender.
+func (b *Bemail) Capabilities() helper.Capabilities {
+	return helper.Capabilities{Username: true, Actions: true, Multiline: true}
+}
+
+// channel returns the joined channel of the list address, or "".
+func (b *Bemail) channel(address string) string {
+	b.Lock()
+	defer b.Unlock()
+	return b.channels[strings.ToLower(address)]
+}
+
+// deliver relays m received for the channels.
+func (b *Bemail) deliver(m *email, channels []string) {
+	b.Lock()
+	for _, channel := range channels {
+		b.threads[strings.ToLower(channel)] = thread{id: m.id, subject: m.subject}
+	}
+	b.Unlock()
+	// our own messages sent back by the list
+	if strings.EqualFold(m.from.Address, b.settings.From) {
+		return
+	}
+	text := strings.TrimSpace(m.subject + "\n" + m.body)
+	if text == "" {
+		return
+	}
+	for _, channel := range channels {
+		msg := config.Message{Username: b.nick(m.from), DisplayName: m.from.Name, Text: text, Channel: channel,
+			Account: b.Account, Timestamp: m.date}
+		flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+		b.Remote <- msg
+	}
+}
+
+// nick returns the nick of the sender addr: its Nicks setting or the local part
+// of its address.
+func (b *Bemail) nick(addr *mail.Address) string {
+	for _, entry := range strings.Fields(b.settings.Nicks) {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], addr.Address) {
+			return kv[1]
+		}
+	}
+	if i := strings.LastIndex(addr.Address, "@"); i != -1 {
+		return addr.Address[:i]
+	}
+	return addr.Address
+}
+
+// messageID returns a new Message-ID in the domain of the address from.
+func messageID(from string) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	domain := "matterbridge"
+	if i := strings.LastIndex(from, "@"); i != -1 {
+		domain = from[i+1:]
+	}
+	return fmt.Sprintf("<%d.%x@%s>", time.Now().UnixNano(), random, domain), nil
+}
+
+// newSubject returns the subject of a thread started by text: its first line.
+func newSubject(text string) string {
+	subject := []rune(strings.TrimSpace(strings.SplitN(text, "\n", 2)[0]))
+	if len(subject) > subjectLength {
+		return string(subject[:subjectLength-3]) + "..."
+	}
+	return string(subject)
+}
@@ -0,0 +1,321 @@
+package bemail
+
+import (
+	"bytes"
+	"context"
+	"github.com/42wim/matterbridge/bridge/config"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const announce = "From: Alice Liddell <alice@example.com>\r\n" +
+	"To: dev@lists.test\r\n" +
+	"Subject: =?utf-8?q?Release_1.0_=E2=9C=93?=\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"Date: Fri, 14 Jul 2017 02:40:00 +0000\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Shipping today, caf=C3=A9 for everyone.\r\n" +
+	"\r\n" +
+	"On Thu, Jul 13, 2017, Bob wrote:\r\n" +
+	"> is it ready?\r\n" +
+	">\r\n" +
+	"\r\n" +
+	"Cheers\r\n" +
+	"-- \r\n" +
+	"Alice, release manager\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Shipping today</p>\r\n" +
+	"--b--\r\n"
+
+func TestParseMail(t *testing.T) {
+	m, err := parseMail([]byte(announce))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.from.Address != "alice@example.com" || m.from.Name != "Alice Liddell" || m.id != "<1@example.com>" ||
+		m.subject != "Release 1.0 ✓" || m.date.Unix() != 1500000000 {
+		t.Errorf("unexpected mail %#v", m)
+	}
+	if want := "Shipping today, café for everyone.\n\nCheers"; m.body != want {
+		t.Errorf("expected body %q, got %q", want, m.body)
+	}
+
+	m, err = parseMail([]byte("From: bob@example.com\r\nSubject: hi\r\nContent-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\nY2Fm6Q==\r\n"))
+	if err != nil || m.body != "café" {
+		t.Errorf("unexpected mail %#v (%v)", m, err)
+	}
+}
+
+func TestStripQuotes(t *testing.T) {
+	for _, test := range []struct {
+		body, want string
+	}{
+		{"ok\n\n> quote\nthanks", "ok\nthanks"},
+		{"Alice wrote:\n> quote\n\nyes", "yes"},
+		{"no quotes\n", "no quotes"},
+		{"top posted\n\n-----Original Message-----\nFrom: bob", "top posted"},
+	} {
+		if got := stripQuotes(test.body); got != test.want {
+			t.Errorf("%q: expected %q, got %q", test.body, test.want, got)
+		}
+	}
+}
+
+type sent struct {
+	server, from string
+	to           []string
+	msg          *mail.Message
+}
+
+func TestEmail(t *testing.T) {
+	c := make(chan config.Message, 10)
+	b := New(config.Protocol{Server: "smtp.test:25", BindAddress: "127.0.0.1:0",
+		Settings: &Settings{From: "bot@test", Nicks: "alice@example.com=alice"}}, "email.test", c)
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(context.Background())
+	b.JoinChannel("dev@lists.test")
+	addr := b.listener.Addr().String()
+
+	if err := sendSMTP(addr, nil, "alice@example.com", []string{"Dev@Lists.test"}, []byte(announce)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-c:
+		if msg.Username != "alice" || msg.DisplayName != "Alice Liddell" || msg.Channel != "dev@lists.test" ||
+			msg.Text != "Release 1.0 ✓\nShipping today, café for everyone.\n\nCheers" || msg.Timestamp.Unix() != 1500000000 {
+			t.Errorf("unexpected message %#v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{"other@lists.test"}, []byte(announce)); err == nil ||
+		!strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("expected the unknown list to be refused, got %v", err)
+	}
+	// the recipients are reset after DATA
+	client, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Mail("alice@example.com")
+	client.Rcpt("dev@lists.test")
+	w, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(announce))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-c
+	if _, err := client.Data(); err == nil || !strings.HasPrefix(err.Error(), "503") {
+		t.Errorf("expected DATA without recipients to be refused, got %v", err)
+	}
+	client.Close()
+
+	mails := make(chan sent, 10)
+	sendMail = func(server string, a smtp.Auth, from string, to []string, data []byte) error {
+		msg, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mails <- sent{server, from, to, msg}
+		return nil
+	}
+	defer func() { sendMail = smtp.SendMail }()
+	b.Send(config.Message{Channel: "dev@lists.test", Username: "[irc] bob ", Text: "congrats\nwell done"})
+	s := <-mails
+	if s.server != "smtp.test:25" || s.from != "bot@test" || len(s.to) != 1 || s.to[0] != "dev@lists.test" {
+		t.Errorf("unexpected envelope %#v", s)
+	}
+	from, _ := s.msg.Header.AddressList("From")
+	subject, _ := new(mime.WordDecoder).DecodeHeader(s.msg.Header.Get("Subject"))
+	if len(from) != 1 || from[0].Name != "[irc] bob" || from[0].Address != "bot@test" || subject != "Re: Release 1.0 ✓" ||
+		s.msg.Header.Get("In-Reply-To") != "<1@example.com>" || s.msg.Header.Get("References") != "<1@example.com>" {
+		t.Errorf("unexpected headers %#v", s.msg.Header)
+	}
+	if body, _ := ioutil.ReadAll(s.msg.Body); string(body) != "congrats\r\nwell done" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// our mail sent back by the list is not relayed, the next reply follows it
+	id := s.msg.Header.Get("Message-ID")
+	echo := "From: bot@test\r\nSubject: Re: Release\r\nMessage-ID: " + id + "\r\n\r\ncongrats\r\n"
+	if err := smtp.SendMail(addr, nil, "bot@test", []string{"dev@lists.test"}, []byte(echo)); err != nil {
+		t.Fatal(err)
+	}
+	if len(c) != 0 {
+		t.Errorf("our own mail was relayed: %#v", <-c)
+	}
+	b.Send(config.Message{Channel: "dev@lists.test", Username: "bob", Text: "waves", Event: config.EVENT_USER_ACTION})
+	s = <-mails
+	if s.msg.Header.Get("In-Reply-To") != id || s.msg.Header.Get("Subject") != "Re: Release" {
+		t.Errorf("unexpected headers %#v", s.msg.Header)
+	}
+	if body, _ := ioutil.ReadAll(s.msg.Body); string(body) != "* bob waves" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	b := New(config.Protocol{BindAddress: "127.0.0.1:0", Settings: &Settings{AllowedNetworks: "10.0.0.0/8 192.168.1.1"}}, "email.test", nil)
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(context.Background())
+	b.JoinChannel("dev@lists.test")
+	err := smtp.SendMail(b.listener.Addr().String(), nil, "alice@example.com", []string{"dev@lists.test"}, []byte(announce))
+	if err == nil || !strings.HasPrefix(err.Error(), "554") {
+		t.Errorf("expected a client outside of AllowedNetworks to be refused, got %v", err)
+	}
+	if err := New(config.Protocol{BindAddress: "127.0.0.1:0", Settings: &Settings{AllowedNetworks: "10.0.0.0/33"}}, "email.test", nil).Connect(); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	// a server that never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	sendTimeout = 100 * time.Millisecond
+	defer func() { sendTimeout = time.Minute }()
+	start := time.Now()
+	if err := sendSMTP(l.Addr().String(), nil, "bot@test", []string{"dev@lists.test"}, []byte(announce)); err == nil {
+		t.Error("expected a timeout")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("the timeout took %s", time.Since(start))
+	}
+}
+
+// imapServer serves the IMAP sessions of TestIMAP, with the mails by UID.
+func imapServer(t *testing.T, l net.Listener, mails map[int]string) {
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			tc := textproto.NewConn(conn)
+			tc.PrintfLine("* OK IMAP4rev1 ready")
+			for {
+				line, err := tc.ReadLine()
+				if err != nil {
+					return
+				}
+				fields := strings.Fields(line)
+				tag, command := fields[0], strings.Join(fields[1:], " ")
+				mu.Lock()
+				switch {
+				case command == `LOGIN "bot" "pass\"word"`:
+				case strings.HasPrefix(command, "LOGIN"):
+					tc.PrintfLine("%s NO [AUTHENTICATIONFAILED] invalid credentials", tag)
+					mu.Unlock()
+					continue
+				case command == `SELECT "Lists"`:
+					tc.PrintfLine("* %d EXISTS", len(mails))
+				case command == "UID SEARCH UNSEEN":
+					var uids []string
+					for uid := range mails {
+						if !seen[uid] {
+							uids = append(uids, strconv.Itoa(uid))
+						}
+					}
+					sort.Strings(uids)
+					tc.PrintfLine("* SEARCH %s", strings.Join(uids, " "))
+				case strings.HasPrefix(command, "UID FETCH "):
+					for i, uid := range strings.Split(strings.Fields(command)[2], ",") {
+						n, _ := strconv.Atoi(uid)
+						seen[n] = true
+						tc.PrintfLine("* %d FETCH (UID %d BODY[] {%d}\r\n%s FLAGS (\\Seen))", i+1, n, len(mails[n]), mails[n])
+					}
+				case command == "LOGOUT":
+					tc.PrintfLine("* BYE")
+				default:
+					t.Errorf("unexpected IMAP command %q", line)
+				}
+				mu.Unlock()
+				tc.PrintfLine("%s OK done", tag)
+			}
+		}()
+	}
+}
+
+func TestIMAP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	other := strings.Replace(announce, "To: dev@lists.test", "To: other@lists.test", 1)
+	cc := strings.Replace(announce, "To: dev@lists.test", "To: bob@example.com\r\nCc: Dev <dev@lists.test>", 1)
+	go imapServer(t, l, map[int]string{7: announce, 8: other, 9: cc})
+
+	c := make(chan config.Message)
+	b := New(config.Protocol{Server: "smtp.test:25", Login: "bot", Password: `pass"word`, NoTLS: true,
+		Settings: &Settings{From: "bot@test", IMAPServer: l.Addr().String(), Mailbox: "Lists"}}, "email.test", c)
+	b.interval = 10 * time.Millisecond
+	b.JoinChannel("dev@lists.test")
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(context.Background())
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-c:
+			if msg.Channel != "dev@lists.test" || msg.Username != "alice" || !strings.HasPrefix(msg.Text, "Release 1.0 ✓\n") {
+				t.Errorf("unexpected message %#v", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+	}
+	// the mails are fetched once, the mail to the other list is not relayed
+	select {
+	case msg := <-c:
+		t.Errorf("unexpected message %#v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b.Disconnect(context.Background())
+	b.Config.Password = "wrong"
+	if err := b.poll(); err == nil || !strings.Contains(err.Error(), "AUTHENTICATIONFAILED") || strings.Contains(err.Error(), "wrong") {
+		t.Errorf("expected the login to fail without the password in the error, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package bemail
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapTimeout bounds the connection and each command of an IMAP session.
+var imapTimeout = time.Minute
+
+// imapConn is an IMAP session (RFC 3501) with the few commands needed to fetch
+// the unseen mail of a mailbox.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is an untagged response with the literals it contains.
+type imapResponse struct {
+	line     string
+	literals [][]byte
+}
+
+// dialIMAP connects to the IMAP server addr, with TLS unless tlsConfig is nil.
+func dialIMAP(addr string, tlsConfig *tls.Config) (*imapConn, error) {
+	dialer := &net.Dialer{Timeout: imapTimeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", greeting)
+	}
+	return c, nil
+}
+
+func (c *imapConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *imapConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// cmd sends command and returns its untagged responses, or an error if the
+// command did not succeed.
+func (c *imapConn) cmd(command string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	// the arguments are not part of the errors, LOGIN has the password
+	name := strings.Fields(command)[0]
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, err
+	}
+	var responses []imapResponse
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			status := strings.TrimPrefix(line, tag+" ")
+			if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+				return nil, fmt.Errorf("%s failed: %s", name, status)
+			}
+			return responses, nil
+		}
+		resp := imapResponse{line: line}
+		// a line ending with {size} goes on after a literal of size bytes
+		for size, ok := literalSize(line); ok; size, ok = literalSize(line) {
+			if size > maxSize {
+				return nil, fmt.Errorf("%s: literal of %d bytes is too big", name, size)
+			}
+			literal := make([]byte, size)
+			if _, err := io.ReadFull(c.r, literal); err != nil {
+				return nil, err
+			}
+			resp.literals = append(resp.literals, literal)
+			if line, err = c.readLine(); err != nil {
+				return nil, err
+			}
+			resp.line += line
+		}
+		responses = append(responses, resp)
+	}
+}
+
+// fetchUnseen returns the unseen mail of mailbox, it is marked as seen.
+func (c *imapConn) fetchUnseen(mailbox string) ([][]byte, error) {
+	if _, err := c.cmd("SELECT " + imapQuote(mailbox)); err != nil {
+		return nil, err
+	}
+	responses, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, resp := range responses {
+		fields := strings.Fields(resp.line)
+		if len(fields) >= 2 && fields[0] == "*" && strings.EqualFold(fields[1], "SEARCH") {
+			uids = append(uids, fields[2:]...)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	// BODY[] sets the \Seen flag
+	if responses, err = c.cmd("UID FETCH " + strings.Join(uids, ",") + " BODY[]"); err != nil {
+		return nil, err
+	}
+	var mails [][]byte
+	for _, resp := range responses {
+		fields := strings.Fields(resp.line)
+		if len(fields) >= 3 && strings.EqualFold(fields[2], "FETCH") && len(resp.literals) > 0 {
+			mails = append(mails, resp.literals[0])
+		}
+	}
+	return mails, nil
+}
+
+// literalSize returns the size of the literal announced at the end of line.
+func literalSize(line string) (int, bool) {
+	i := strings.LastIndex(line, "{")
+	if i == -1 || !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	size, err := strconv.Atoi(line[i+1 : len(line)-1])
+	return size, err == nil && size >= 0
+}
+
+// imapQuote returns s as an IMAP quoted string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
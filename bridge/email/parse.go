@@ -0,0 +1,137 @@
+package bemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// email is a received mail.
+type email struct {
+	from    *mail.Address
+	to      []string // addresses of the To and Cc headers
+	subject string
+	id      string // Message-ID
+	date    time.Time
+	body    string // plain text, without quotes and signature
+}
+
+// parseMail parses the mail data.
+func parseMail(data []byte) (*email, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	from, err := m.Header.AddressList("From")
+	if err != nil {
+		return nil, err
+	}
+	if len(from) == 0 {
+		return nil, errors.New("no sender")
+	}
+	e := &email{from: from[0], id: m.Header.Get("Message-ID")}
+	for _, header := range []string{"To", "Cc"} {
+		// the recipients only matter to the mail fetched with IMAP, ignore invalid headers
+		addrs, _ := m.Header.AddressList(header)
+		for _, addr := range addrs {
+			e.to = append(e.to, addr.Address)
+		}
+	}
+	dec := new(mime.WordDecoder)
+	if e.subject, err = dec.DecodeHeader(m.Header.Get("Subject")); err != nil {
+		e.subject = m.Header.Get("Subject")
+	}
+	if e.date, err = m.Header.Date(); err != nil {
+		e.date = time.Now()
+	}
+	body, err := textBody(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	if err != nil {
+		return nil, err
+	}
+	e.body = stripQuotes(body)
+	return e, nil
+}
+
+// textBody returns the first text/plain part of a body of type contentType.
+func textBody(contentType string, encoding string, r io.Reader) (string, error) {
+	mediaType, params := "text/plain", map[string]string{}
+	if contentType != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(contentType); err != nil {
+			return "", err
+		}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			// quoted-printable parts are decoded by the reader
+			text, err := textBody(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil || text != "" {
+				return text, err
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	text := string(data)
+	if charset := strings.ToLower(params["charset"]); charset == "iso-8859-1" || charset == "latin1" {
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		text = string(runes)
+	}
+	return strings.Replace(text, "\r\n", "\n", -1), nil
+}
+
+// stripQuotes removes the quoted replies with their attribution line ("On ...
+// wrote:"), the forwarded or replied messages of Outlook and the signature
+// from body.
+func stripQuotes(body string) string {
+	var lines []string
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		// the trailing space of the signature separator is removed by quoted-printable
+		if line == "-- " || line == "--" || strings.HasPrefix(trimmed, "-----Original Message-----") {
+			break
+		}
+		if !strings.HasPrefix(trimmed, ">") {
+			lines = append(lines, line)
+			continue
+		}
+		// remove the attribution of the quote
+		for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) > 0 && strings.HasSuffix(strings.TrimSpace(lines[len(lines)-1]), "wrote:") {
+			lines = lines[:len(lines)-1]
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
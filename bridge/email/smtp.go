@@ -0,0 +1,155 @@
+package bemail
+
+import (
+	"github.com/42wim/matterbridge/bridge/helper"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSize is the maximum size of a mail in bytes.
+	maxSize = 10 * 1024 * 1024
+	// sessionTimeout closes idle SMTP sessions.
+	sessionTimeout = 5 * time.Minute
+)
+
+// serve accepts the SMTP sessions until l is closed. The SMTP sessions are
+// not authenticated, only the clients in AllowedNetworks are accepted.
+func (b *Bemail) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			flog.Debugf("listener stopped: %s", err)
+			return
+		}
+		if !helper.InNetworks(b.networks, conn.RemoteAddr().String()) {
+			flog.Infof("refusing the SMTP session of %s, it is not in AllowedNetworks", conn.RemoteAddr())
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.Write([]byte("554 5.7.1 access denied\r\n"))
+			conn.Close()
+			continue
+		}
+		b.Lock()
+		b.conns[conn] = true
+		b.wg.Add(1)
+		b.Unlock()
+		go func() {
+			defer b.wg.Done()
+			b.session(conn)
+			b.Lock()
+			delete(b.conns, conn)
+			b.Unlock()
+		}()
+	}
+}
+
+// session receives mails for the joined channels (RFC 5321, without extensions
+// besides 8BITMIME and SIZE).
+func (b *Bemail) session(conn net.Conn) {
+	defer conn.Close()
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	tc := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) {
+		tc.PrintfLine(format, args...)
+	}
+	var started bool
+	var channels []string
+	reply("220 %s matterbridge ESMTP", hostname)
+	for {
+		conn.SetDeadline(time.Now().Add(sessionTimeout))
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.Index(line, " "); i != -1 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply("250 %s", hostname)
+		case "EHLO":
+			reply("250-%s", hostname)
+			reply("250-8BITMIME")
+			reply("250 SIZE %d", maxSize)
+		case "MAIL":
+			if _, ok := path(arg, "FROM:"); !ok {
+				reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+				continue
+			}
+			started, channels = true, nil
+			reply("250 2.1.0 OK")
+		case "RCPT":
+			address, ok := path(arg, "TO:")
+			switch {
+			case !started:
+				reply("503 5.5.1 MAIL first")
+			case !ok:
+				reply("501 5.5.4 Syntax: RCPT TO:<address>")
+			case b.channel(address) == "":
+				reply("550 5.1.1 %s: no such list", address)
+			default:
+				channels = append(channels, b.channel(address))
+				reply("250 2.1.5 OK")
+			}
+		case "DATA":
+			if len(channels) == 0 {
+				reply("503 5.5.1 RCPT first")
+				continue
+			}
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			r := tc.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+			if err != nil {
+				return
+			}
+			recipients := channels
+			started, channels = false, nil
+			if len(data) > maxSize {
+				io.Copy(ioutil.Discard, r)
+				reply("552 5.3.4 Message too big")
+				continue
+			}
+			m, err := parseMail(data)
+			if err != nil {
+				flog.Errorf("invalid mail: %s", err)
+				reply("554 5.6.0 %s", err)
+				continue
+			}
+			b.deliver(m, recipients)
+			reply("250 2.0.0 OK")
+		case "RSET":
+			started, channels = false, nil
+			reply("250 2.0.0 OK")
+		case "NOOP":
+			reply("250 2.0.0 OK")
+		case "QUIT":
+			reply("221 2.0.0 Bye")
+			return
+		default:
+			reply("502 5.5.2 %s not implemented", verb)
+		}
+	}
+}
+
+// path returns the address of arg, "FROM:<address> [parameters]" for prefix
+// "FROM:".
+func path(arg string, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	i := strings.Index(arg, ">")
+	if !strings.HasPrefix(arg, "<") || i == -1 {
+		return "", false
+	}
+	return arg[1:i], true
+}
@@ -0,0 +1,327 @@
+// Package bexec runs a bridge as an external program (plugin), see the
+// "Exec plugins" section of the README for the protocol.
+//
+// matterbridge starts Command with sh and exchanges JSON objects with it, one
+// per line, on its stdin and stdout. Its stderr is logged. The plugin is
+// restarted when it exits.
+package bexec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Settings are the settings of the exec accounts that are not in config.Protocol.
+type Settings struct {
+	Command string // the plugin to run (with sh -c)
+}
+
+type Bexec struct {
+	Config       *config.Protocol
+	settings     Settings
+	Remote       chan config.Message
+	Account      string
+	channels     []string
+	proc         *process
+	stop         chan struct{}
+	stopOnce     sync.Once
+	restartDelay time.Duration // first delay before restarting a plugin that exited
+	sync.Mutex
+}
+
+// frame is a line of the protocol.
+type frame struct {
+	Type    string           `json:"type"`
+	Account string           `json:"account,omitempty"` // connect
+	Config  *config.Protocol `json:"config,omitempty"`  // connect
+	Channel string           `json:"channel,omitempty"` // join
+	Message *config.Message  `json:"message,omitempty"` // send, message, event
+	Error   string           `json:"error,omitempty"`   // error
+}
+
+// process is a running plugin.
+type process struct {
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	enc       *json.Encoder
+	queue     chan frame    // frames waiting to be written to stdin
+	connected chan error    // answer to the connect request
+	done      chan struct{} // closed when the plugin exited
+	started   time.Time
+}
+
+var flog *log.Entry
+var protocol = "exec"
+
+const (
+	connectTimeout  = 30 * time.Second
+	maxRestartDelay = time.Minute
+	maxLine         = 1024 * 1024
+	queueSize       = 100 // frames waiting to be written to a plugin
+)
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Command"), Settings: func() interface{} { return &Settings{} }})
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bexec {
+	b := &Bexec{}
+	b.Config = &cfg
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.Remote = c
+	b.Account = account
+	b.stop = make(chan struct{})
+	b.restartDelay = time.Second
+	return b
+}
+
+// Connect starts the plugin and waits until it is connected.
+func (b *Bexec) Connect() error {
+	flog.Infof("Starting %s", b.settings.Command)
+	p, err := b.start()
+	if err != nil {
+		return err
+	}
+	flog.Info("Connection succeeded")
+	go b.supervise(p)
+	return nil
+}
+
+// Disconnect asks the plugin to disconnect and waits until it exits.
+// It is killed when ctx is done.
+func (b *Bexec) Disconnect(ctx context.Context) error {
+	b.Lock()
+	b.stopOnce.Do(func() { close(b.stop) })
+	p := b.proc
+	if p != nil {
+		b.write(frame{Type: "disconnect"})
+		// stdin is closed when the queue is written
+		b.proc = nil
+		close(p.queue)
+	}
+	b.Unlock()
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		kill(p.cmd)
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (b *Bexec) JoinChannel(channel string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.channels = append(b.channels, channel)
+	return b.write(frame{Type: "join", Channel: channel})
+}
+
+func (b *Bexec) Send(msg config.Message) error {
+	flog.Debugf("Receiving %#v", msg)
+	b.Lock()
+	defer b.Unlock()
+	return b.write(frame{Type: "send", Message: &msg})
+}
+
+// write queues f for the running plugin. b must be locked.
+func (b *Bexec) write(f frame) error {
+	if b.proc == nil {
+		return fmt.Errorf("%s: plugin is not running", b.Account)
+	}
+	select {
+	case b.proc.queue <- f:
+		return nil
+	default:
+		return fmt.Errorf("%s: plugin is not reading, %s dropped", b.Account, f.Type)
+	}
+}
+
+// writeLoop writes the queued frames to the plugin. stdin is closed when the
+// queue is closed.
+func (p *process) writeLoop() {
+	defer p.stdin.Close()
+	for f := range p.queue {
+		if err := p.enc.Encode(f); err != nil {
+			flog.Errorf("writing %s to plugin failed: %s", f.Type, err)
+		}
+	}
+}
+
+// start starts the plugin, connects it and joins the channels.
+func (b *Bexec) start() (*process, error) {
+	cmd := exec.Command("sh", "-c", b.settings.Command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = &stderrWriter{}
+	newGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &process{cmd: cmd, stdin: stdin, enc: json.NewEncoder(stdin), queue: make(chan frame, queueSize),
+		connected: make(chan error, 1), done: make(chan struct{}), started: time.Now()}
+	go p.writeLoop()
+	go func() {
+		b.receive(p, stdout)
+		err := cmd.Wait()
+		flog.Debugf("%s exited: %v", b.settings.Command, err)
+		close(p.done)
+	}()
+	cfg := *b.Config
+	p.queue <- frame{Type: "connect", Account: b.Account, Config: &cfg}
+	select {
+	case err = <-p.connected:
+	case <-p.done:
+		err = errors.New("plugin exited")
+	case <-time.After(connectTimeout):
+		err = errors.New("plugin did not connect")
+	}
+	if err != nil {
+		kill(cmd)
+		close(p.queue)
+		return nil, fmt.Errorf("%s: %s", b.Account, err)
+	}
+	b.Lock()
+	defer b.Unlock()
+	select {
+	case <-b.stop:
+		kill(cmd)
+		close(p.queue)
+		return nil, fmt.Errorf("%s: disconnected", b.Account)
+	default:
+	}
+	b.proc = p
+	for _, channel := range b.channels {
+		if err := b.write(frame{Type: "join", Channel: channel}); err != nil {
+			flog.Errorf("joining %s failed: %s", channel, err)
+		}
+	}
+	return p, nil
+}
+
+// supervise restarts the plugin when it exits. The delay before restarting
+// doubles while the plugin keeps failing (up to a minute).
+func (b *Bexec) supervise(p *process) {
+	delay := b.restartDelay
+	for {
+		select {
+		case <-p.done:
+		case <-b.stop:
+			return
+		}
+		b.Lock()
+		if b.proc == p {
+			b.proc = nil
+			close(p.queue)
+		}
+		b.Unlock()
+		if time.Since(p.started) > maxRestartDelay {
+			delay = b.restartDelay
+		}
+		flog.Errorf("%s exited, restarting in %s", b.settings.Command, delay)
+		for p = nil; p == nil; {
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(delay):
+			}
+			var err error
+			if p, err = b.start(); err != nil {
+				flog.Errorf("restarting %s failed: %s", b.settings.Command, err)
+			}
+			if delay *= 2; delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+		}
+		flog.Infof("%s restarted", b.settings.Command)
+	}
+}
+
+// receive handles the lines written by the plugin until it closes stdout.
+func (b *Bexec) receive(p *process, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	answered := false // the connect request is answered
+	for scanner.Scan() {
+		var f frame
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			flog.Errorf("invalid line from plugin: %s: %q", err, scanner.Text())
+			continue
+		}
+		switch f.Type {
+		case "connected", "error":
+			var err error
+			if f.Type == "error" {
+				err = errors.New(f.Error)
+			}
+			if !answered {
+				answered = true
+				p.connected <- err
+			} else if err != nil {
+				flog.Errorf("plugin error: %s", err)
+			}
+		case "message", "event":
+			if f.Message == nil {
+				flog.Errorf("%s without message from plugin", f.Type)
+				continue
+			}
+			msg := *f.Message
+			if f.Type == "message" {
+				msg.Event = ""
+			} else if msg.Event == "" {
+				flog.Errorf("event without Event from plugin: %#v", msg)
+				continue
+			}
+			msg.Account = b.Account
+			flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+			b.Remote <- msg
+		default:
+			flog.Debugf("unknown line from plugin: %q", scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		flog.Errorf("reading from plugin failed: %s", err)
+		kill(p.cmd)
+	}
+}
+
+// stderrWriter logs the lines the plugin writes on stderr.
+type stderrWriter struct {
+	buf []byte
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i == -1 {
+			return len(p), nil
+		}
+		flog.Info(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+}
@@ -0,0 +1,156 @@
+package bexec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper/bridgetest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHelperPlugin is not a real test, it is the plugin started by the tests.
+// It echoes the messages sent to it, crashes on "crash" and stops reading on
+// "block".
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("BEXEC_HELPER_PLUGIN") != "1" {
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var f frame
+		json.Unmarshal(scanner.Bytes(), &f)
+		switch f.Type {
+		case "connect":
+			if f.Config.Token != "secret" {
+				enc.Encode(frame{Type: "error", Error: "invalid token"})
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, "connected as", f.Account)
+			enc.Encode(frame{Type: "connected"})
+		case "join":
+			enc.Encode(frame{Type: "event", Message: &config.Message{Username: "system", Text: "plugin joins",
+				Channel: f.Channel, Event: config.EVENT_JOIN_LEAVE}})
+		case "send":
+			if f.Message.Text == "crash" {
+				os.Exit(1)
+			}
+			if f.Message.Text == "block" {
+				time.Sleep(time.Minute)
+			}
+			enc.Encode(frame{Type: "message", Message: &config.Message{Username: "echo", Text: f.Message.Text,
+				Channel: f.Message.Channel}})
+		}
+	}
+	os.Exit(0)
+}
+
+func newPlugin(token string) (*Bexec, chan config.Message) {
+	c := make(chan config.Message, 10)
+	b := New(config.Protocol{Token: token,
+		Settings: &Settings{Command: "BEXEC_HELPER_PLUGIN=1 " + os.Args[0] + " -test.run=TestHelperPlugin"}}, "exec.test", c)
+	b.restartDelay = 10 * time.Millisecond
+	return b, c
+}
+
+func TestPlugin(t *testing.T) {
+	b, c := newPlugin("secret")
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(context.Background())
+	if err := b.JoinChannel("#test"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := bridgetest.Receive(t, c); msg.Event != config.EVENT_JOIN_LEAVE || msg.Channel != "#test" || msg.Account != "exec.test" {
+		t.Errorf("expected the join event, got %#v", msg)
+	}
+	if err := b.Send(config.Message{Username: "alice", Text: "hello", Channel: "#test"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := bridgetest.Receive(t, c); msg.Text != "hello" || msg.Username != "echo" || msg.Event != "" {
+		t.Errorf("expected the echo, got %#v", msg)
+	}
+
+	// the plugin is restarted and joins the channels again
+	b.Send(config.Message{Text: "crash", Channel: "#test"})
+	if msg := bridgetest.Receive(t, c); msg.Event != config.EVENT_JOIN_LEAVE || msg.Channel != "#test" {
+		t.Errorf("expected the join event after the restart, got %#v", msg)
+	}
+	if err := b.Send(config.Message{Username: "alice", Text: "again", Channel: "#test"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := bridgetest.Receive(t, c); msg.Text != "again" {
+		t.Errorf("expected the echo after the restart, got %#v", msg)
+	}
+}
+
+func TestPluginConnectError(t *testing.T) {
+	b, _ := newPlugin("wrong")
+	if err := b.Connect(); err == nil || err.Error() != "exec.test: invalid token" {
+		t.Errorf("expected the error of the plugin, got %v", err)
+	}
+}
+
+func TestPluginNotReading(t *testing.T) {
+	b, _ := newPlugin("secret")
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	b.Send(config.Message{Text: "block", Channel: "#test"})
+	// the pipe and the queue fill up, Send drops the messages instead of blocking
+	text := strings.Repeat("x", 1024)
+	done := make(chan error)
+	go func() {
+		var err error
+		for i := 0; i < 1000 && err == nil; i++ {
+			err = b.Send(config.Message{Text: text, Channel: "#test"})
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the messages to be dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Disconnect(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the plugin to be killed, got %v", err)
+	}
+	// disconnecting twice is harmless
+	if err := b.Disconnect(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPluginKillGroup(t *testing.T) {
+	b, _ := newPlugin("secret")
+	// the sleep started by the shell keeps the stdout of the plugin open
+	b.settings.Command = "sleep 30 & " + b.settings.Command
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	b.Lock()
+	p := b.proc
+	b.Unlock()
+	b.Send(config.Message{Text: "block", Channel: "#test"})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.Disconnect(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the plugin to be killed, got %v", err)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Error("the processes started by the plugin were not killed")
+	}
+}
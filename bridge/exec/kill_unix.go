@@ -0,0 +1,19 @@
+// +build !windows
+
+package bexec
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// newGroup starts the plugin in a new process group, so kill also stops the
+// processes it started (the plugin is started with sh -c).
+func newGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// kill kills the process group of the plugin.
+func kill(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
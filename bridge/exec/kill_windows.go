@@ -0,0 +1,14 @@
+package bexec
+
+import (
+	"os/exec"
+)
+
+// newGroup does nothing, windows has no process groups to kill.
+func newGroup(cmd *exec.Cmd) {
+}
+
+// kill kills the plugin.
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
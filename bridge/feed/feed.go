@@ -0,0 +1,325 @@
+// Package bfeed relays the new items of RSS and Atom feeds (input only).
+//
+// The channels are the URLs of the feeds, they are polled every PollInterval
+// seconds. The items of a feed when it is polled for the first time are not
+// relayed. The GUIDs of the items seen are kept in StateFile, so the items
+// published while matterbridge was stopped are relayed when it starts.
+package bfeed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Settings are the settings of the feed accounts that are not in config.Protocol.
+type Settings struct {
+	FeedFormat   string // template of the messages of the items (fields Title, Link, Author, Summary, Feed)
+	PollInterval int    // seconds between the polls of the feeds
+	StateFile    string // file keeping the items seen
+}
+
+type Bfeed struct {
+	Config   *config.Protocol
+	settings Settings
+	Remote   chan config.Message
+	Account  string
+	client   *http.Client
+	format   *template.Template
+	interval time.Duration
+	feeds    []string            // joined feeds
+	seen     map[string][]string // GUIDs of the items of each feed, nil for feeds never polled
+	cache    map[string]cache
+	polling  sync.Mutex // held while polling a feed
+	joined   chan struct{} // signals new feeds to the poll loop
+	cancel   context.CancelFunc
+	done     chan struct{} // closed when the poll loop ended
+	sync.Mutex
+}
+
+// cache holds the validators of the last answer of a feed for conditional requests.
+type cache struct {
+	etag         string
+	lastModified string
+}
+
+var flog *log.Entry
+var protocol = "feed"
+
+const (
+	// defaultFormat is the template of the messages without FeedFormat setting.
+	defaultFormat = "{{.Title}} {{.Link}}"
+	// defaultInterval is the delay between the polls without PollInterval setting.
+	defaultInterval = 5 * time.Minute
+	// maxSize is the maximum size of a feed in bytes.
+	maxSize = 10 * 1024 * 1024
+)
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Settings: func() interface{} { return &Settings{} }, Check: check})
+}
+
+// check checks the settings of an account.
+func check(cfg config.Protocol) []error {
+	var settings Settings
+	if err := cfg.Decode(&settings); err != nil {
+		return []error{err}
+	}
+	if _, err := helper.ParseTemplate("FeedFormat", settings.FeedFormat); err != nil {
+		return []error{&config.SettingError{Setting: "FeedFormat", Err: err}}
+	}
+	return nil
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bfeed {
+	b := &Bfeed{}
+	b.Config = &cfg
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.Remote = c
+	b.Account = account
+	b.client = &http.Client{Timeout: time.Minute}
+	b.interval = defaultInterval
+	if b.settings.PollInterval > 0 {
+		b.interval = time.Duration(b.settings.PollInterval) * time.Second
+	}
+	b.seen = make(map[string][]string)
+	b.cache = make(map[string]cache)
+	b.joined = make(chan struct{}, 1)
+	b.done = make(chan struct{})
+	return b
+}
+
+// Connect loads the state and starts polling the feeds.
+func (b *Bfeed) Connect() error {
+	format := b.settings.FeedFormat
+	if format == "" {
+		format = defaultFormat
+	}
+	tmpl, err := helper.ParseTemplate("FeedFormat", format)
+	if err != nil {
+		return fmt.Errorf("invalid FeedFormat: %s", err)
+	}
+	b.format = tmpl
+	if err := b.loadState(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+	go b.pollLoop(ctx)
+	flog.Info("Connection succeeded")
+	return nil
+}
+
+// Disconnect stops polling.
+func (b *Bfeed) Disconnect(ctx context.Context) error {
+	if b.cancel == nil {
+		return nil
+	}
+	b.cancel()
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// JoinChannel adds the feed at the URL channel, the poll loop polls it right
+// away and then every interval. It is not polled here: the gateway only reads
+// the messages of the bridges once they all joined their channels.
+func (b *Bfeed) JoinChannel(channel string) error {
+	u, err := url.Parse(channel)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("%s is not the http(s) URL of a feed", channel)
+	}
+	b.Lock()
+	b.feeds = append(b.feeds, channel)
+	b.Unlock()
+	select {
+	case b.joined <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Send drops msg, feeds are input only.
+func (b *Bfeed) Send(msg config.Message) error {
+	flog.Debugf("Dropping %#v, feeds are input only", msg)
+	return nil
+}
+
+func (b *Bfeed) pollLoop(ctx context.Context) {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.joined:
+		case <-ctx.Done():
+			return
+		}
+		b.Lock()
+		feeds := append([]string{}, b.feeds...)
+		b.Unlock()
+		for _, feed := range feeds {
+			if err := b.poll(ctx, feed); err != nil && ctx.Err() == nil {
+				flog.Errorf("polling %s failed: %s", feed, err)
+			}
+		}
+	}
+}
+
+// poll fetches feed and relays its new items, oldest first.
+func (b *Bfeed) poll(ctx context.Context, feed string) error {
+	b.polling.Lock()
+	defer b.polling.Unlock()
+	doc, err := b.fetch(ctx, feed)
+	if err != nil || doc == nil {
+		return err
+	}
+	b.Lock()
+	seen, known := b.seen[feed]
+	b.Unlock()
+	old := make(map[string]bool)
+	for _, guid := range seen {
+		old[guid] = true
+	}
+	guids := make([]string, 0, len(doc.items))
+	changed := !known || len(seen) != len(doc.items)
+	for i := len(doc.items) - 1; i >= 0; i-- {
+		item := doc.items[i]
+		guids = append(guids, item.GUID)
+		if old[item.GUID] {
+			continue
+		}
+		changed = true
+		if known {
+			b.relay(feed, doc, item)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	b.Lock()
+	// only the items still in the feed are kept
+	b.seen[feed] = guids
+	b.Unlock()
+	return b.saveState()
+}
+
+func (b *Bfeed) relay(feed string, doc *document, item item) {
+	item.Feed = doc.title
+	text, err := b.render(item)
+	if err != nil {
+		flog.Errorf("executing FeedFormat failed: %s", err)
+		return
+	}
+	// the timestamp is the time of the relay, the items are not delayed messages
+	msg := config.Message{Username: doc.title, Text: text, Channel: feed, Account: b.Account, Timestamp: time.Now()}
+	flog.Debugf("Sending item %s of %s to gateway", item.GUID, feed)
+	b.Remote <- msg
+}
+
+func (b *Bfeed) render(item item) (string, error) {
+	var buf bytes.Buffer
+	err := b.format.Execute(&buf, item)
+	return strings.TrimSpace(buf.String()), err
+}
+
+// fetch gets and parses feed. It returns nil when the feed did not change.
+func (b *Bfeed) fetch(ctx context.Context, feed string) (*document, error) {
+	req, err := http.NewRequest("GET", feed, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	b.Lock()
+	c := b.cache[feed]
+	b.Unlock()
+	if c.etag != "" {
+		req.Header.Set("If-None-Match", c.etag)
+	}
+	if c.lastModified != "" {
+		req.Header.Set("If-Modified-Since", c.lastModified)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	doc, err := parse(http.MaxBytesReader(nil, resp.Body, maxSize))
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	b.cache[feed] = cache{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+	b.Unlock()
+	return doc, nil
+}
+
+// loadState reads the GUIDs of the items seen from StateFile.
+func (b *Bfeed) loadState() error {
+	if b.settings.StateFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.settings.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	if err := json.Unmarshal(data, &b.seen); err != nil {
+		return fmt.Errorf("reading %s failed: %s", b.settings.StateFile, err)
+	}
+	return nil
+}
+
+// saveState writes the GUIDs of the items seen to StateFile.
+func (b *Bfeed) saveState() error {
+	if b.settings.StateFile == "" {
+		return nil
+	}
+	b.Lock()
+	data, err := json.MarshalIndent(b.seen, "", "  ")
+	b.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := b.settings.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, b.settings.StateFile)
+	}
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %s", b.settings.StateFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package bfeed
+
+import (
+	"context"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper/bridgetest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rss = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel>
+<title>Changelog</title>
+%ITEMS%
+<item><title>v1.0</title><link>https://example.com/v1.0</link><guid>1</guid></item>
+</channel>
+</rss>`
+
+const atom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+<title>Status</title>
+%ITEMS%
+<entry><title>All systems operational</title><id>tag:status,1</id><updated>2017-07-13T00:00:00Z</updated></entry>
+</feed>`
+
+// server serves the feeds, the items of a feed are inserted at %ITEMS%.
+type server struct {
+	*httptest.Server
+	mu    sync.Mutex
+	items map[string]string
+}
+
+func newServer() *server {
+	s := &server{items: make(map[string]string)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		etag := `"` + s.items[r.URL.Path] + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		doc := rss
+		if r.URL.Path == "/atom" {
+			doc = atom
+		}
+		w.Write([]byte(strings.Replace(doc, "%ITEMS%", s.items[r.URL.Path], 1)))
+	}))
+	return s
+}
+
+func (s *server) publish(path string, items string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[path] = items + s.items[path]
+}
+
+// newBridge starts a bridge joining feeds. Its channel is unbuffered like the
+// one of the gateway, which is only read once every channel is joined.
+func newBridge(t *testing.T, cfg config.Protocol, feeds ...string) (*Bfeed, chan config.Message) {
+	c := make(chan config.Message)
+	b := New(cfg, "feed.test", c)
+	b.interval = 10 * time.Millisecond
+	bridgetest.Start(t, b, feeds...)
+	// the first poll sets the items that are not relayed
+	deadline := time.Now().Add(bridgetest.Timeout)
+	for !b.polled(feeds) {
+		if time.Now().After(deadline) {
+			t.Fatal("the feeds were not polled after joining them")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return b, c
+}
+
+// polled returns true if the feeds were polled.
+func (b *Bfeed) polled(feeds []string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, feed := range feeds {
+		if _, ok := b.seen[feed]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFeed(t *testing.T) {
+	s := newServer()
+	defer s.Close()
+	dir, err := ioutil.TempDir("", "feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	settings := &Settings{StateFile: filepath.Join(dir, "state"),
+		FeedFormat: "{{.Title}}{{if .Author}} by {{.Author}}{{end}}:{{if .Summary}} {{truncate 20 .Summary}}{{end}} {{.Link}}"}
+
+	b, c := newBridge(t, config.Protocol{Settings: settings}, s.URL+"/rss", s.URL+"/atom")
+	s.publish("/rss", `<item><title>v1.2</title><link>https://example.com/v1.2</link><guid>3</guid></item>
+		<item><title>v1.1</title><link>https://example.com/v1.1</link><guid>2</guid><dc:creator>alice</dc:creator>
+		<description>&lt;p&gt;Fixes &amp;amp; improvements for everyone&lt;/p&gt;</description>
+		<pubDate>Fri, 14 Jul 2017 02:40:00 +0000</pubDate></item>`)
+	msg := bridgetest.Receive(t, c)
+	if msg.Text != "v1.1 by alice: Fixes & improvements https://example.com/v1.1" || msg.Username != "Changelog" ||
+		msg.Channel != s.URL+"/rss" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if msg = bridgetest.Receive(t, c); msg.Text != "v1.2: https://example.com/v1.2" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	b.Disconnect(context.Background())
+
+	// the items published while stopped are relayed
+	s.publish("/atom", `<entry><title type="html">Degraded &lt;b&gt;performance&lt;/b&gt;</title><id>tag:status,2</id>
+		<link rel="alternate" href="https://status.example.com/2"/><author><name>ops</name></author></entry>`)
+	b, c = newBridge(t, config.Protocol{Settings: &Settings{StateFile: settings.StateFile}}, s.URL+"/rss", s.URL+"/atom")
+	defer b.Disconnect(context.Background())
+	if msg = bridgetest.Receive(t, c); msg.Text != "Degraded performance https://status.example.com/2" || msg.Username != "Status" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	select {
+	case msg := <-c:
+		t.Errorf("unexpected message %#v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestJoinInvalidURL(t *testing.T) {
+	b := New(config.Protocol{}, "feed.test", nil)
+	if err := b.JoinChannel("#general"); err == nil {
+		t.Error("expected an error for a channel that is not an URL")
+	}
+}
@@ -0,0 +1,176 @@
+package bfeed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// item is an item of a feed, it is the data of the FeedFormat template.
+type item struct {
+	Title     string
+	Link      string
+	Author    string
+	Summary   string // plain text
+	GUID      string // guid (RSS) or id (Atom), the link or the title if missing
+	Feed      string // title of the feed
+	Published time.Time
+}
+
+// document is a parsed feed, its items are in document order (newest first).
+type document struct {
+	title string
+	items []item
+}
+
+// xmlFeed decodes RSS 2.0 (rss/channel/item), RSS 1.0 (rdf:RDF/item) and
+// Atom (feed/entry) documents.
+type xmlFeed struct {
+	XMLName xml.Name
+	Channel struct {
+		Title string    `xml:"title"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []rssItem   `xml:"item"`
+	Title   string      `xml:"title"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	Author      string `xml:"author"`
+	Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+	Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type atomEntry struct {
+	Title string `xml:"title"`
+	ID    string `xml:"id"`
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+	} `xml:"link"`
+	Author struct {
+		Name string `xml:"name"`
+	} `xml:"author"`
+	Summary   string `xml:"summary"`
+	Content   string `xml:"content"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+}
+
+// dateFormats are the formats of the dates of RSS (RFC 822 and variants) and Atom (RFC 3339).
+var dateFormats = []string{time.RFC1123Z, time.RFC1123, "Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700", time.RFC3339}
+
+var tags = regexp.MustCompile(`<[^>]*>`)
+
+// parse parses the RSS or Atom feed of r.
+func parse(r io.Reader) (*document, error) {
+	var f xmlFeed
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charsetReader
+	if err := d.Decode(&f); err != nil {
+		return nil, err
+	}
+	doc := &document{}
+	switch strings.ToLower(f.XMLName.Local) {
+	case "rss", "rdf":
+		doc.title = strings.TrimSpace(f.Channel.Title)
+		for _, i := range append(f.Channel.Items, f.Items...) {
+			doc.items = append(doc.items, i.item())
+		}
+	case "feed":
+		doc.title = strings.TrimSpace(f.Title)
+		for _, e := range f.Entries {
+			doc.items = append(doc.items, e.item())
+		}
+	default:
+		return nil, fmt.Errorf("unknown feed format %q", f.XMLName.Local)
+	}
+	return doc, nil
+}
+
+func (i rssItem) item() item {
+	it := item{Title: strings.TrimSpace(i.Title), Link: strings.TrimSpace(i.Link), GUID: strings.TrimSpace(i.GUID),
+		Author: strings.TrimSpace(i.Author), Summary: plainText(i.Description), Published: parseDate(i.PubDate)}
+	if it.Author == "" {
+		it.Author = strings.TrimSpace(i.Creator)
+	}
+	if it.Published.IsZero() {
+		it.Published = parseDate(i.Date)
+	}
+	it.fillGUID()
+	return it
+}
+
+func (e atomEntry) item() item {
+	it := item{Title: plainText(e.Title), GUID: strings.TrimSpace(e.ID), Author: strings.TrimSpace(e.Author.Name),
+		Summary: plainText(e.Summary), Published: parseDate(e.Published)}
+	for _, link := range e.Links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			it.Link = link.Href
+			break
+		}
+	}
+	if it.Summary == "" {
+		it.Summary = plainText(e.Content)
+	}
+	if it.Published.IsZero() {
+		it.Published = parseDate(e.Updated)
+	}
+	it.fillGUID()
+	return it
+}
+
+func (it *item) fillGUID() {
+	if it.GUID == "" {
+		it.GUID = it.Link
+	}
+	if it.GUID == "" {
+		it.GUID = it.Title
+	}
+}
+
+func parseDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, format := range dateFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// plainText returns the text of the HTML s on one line.
+func plainText(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tags.ReplaceAllString(s, " "))), " ")
+}
+
+// charsetReader converts the ISO-8859-1 feeds to UTF-8, the other charsets are not supported.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1":
+		data, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		return bytes.NewReader([]byte(string(runes))), nil
+	}
+	return nil, errors.New("unsupported charset " + charset)
+}
@@ -1,10 +1,14 @@
 package bgitter
 
 import (
+	"context"
 	"github.com/42wim/go-gitter"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	log "github.com/Sirupsen/logrus"
 	"strings"
+	"sync"
 )
 
 type Bgitter struct {
@@ -14,6 +18,7 @@ type Bgitter struct {
 	Account string
 	Users   []gitter.User
 	Rooms   []gitter.Room
+	sync.RWMutex
 }
 
 var flog *log.Entry
@@ -21,6 +26,9 @@ var protocol = "gitter"
 
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Token")})
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Bgitter {
@@ -45,6 +53,11 @@ func (b *Bgitter) Connect() error {
 	return nil
 }
 
+func (b *Bgitter) Disconnect(ctx context.Context) error {
+	// messages are sent synchronously using the API, nothing to disconnect
+	return nil
+}
+
 func (b *Bgitter) JoinChannel(channel string) error {
 	room := channel
 	roomID := b.getRoomID(room)
@@ -72,7 +85,7 @@ func (b *Bgitter) JoinChannel(channel string) error {
 				if !strings.HasSuffix(ev.Message.Text, "​") {
 					flog.Debugf("Sending message from %s on %s to gateway", ev.Message.From.Username, b.Account)
 					b.Remote <- config.Message{Username: ev.Message.From.Username, Text: ev.Message.Text, Channel: room,
-						Account: b.Account, Avatar: b.getAvatar(ev.Message.From.Username)}
+						Account: b.Account, Avatar: b.getAvatar(ev.Message.From.Username), Timestamp: ev.Message.Sent}
 				}
 			case *gitter.GitterConnectionClosed:
 				flog.Errorf("connection with gitter closed for room %s", room)
@@ -84,16 +97,43 @@ func (b *Bgitter) JoinChannel(channel string) error {
 
 func (b *Bgitter) Send(msg config.Message) error {
 	flog.Debugf("Receiving %#v", msg)
+	// gitter can not show typing of others
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
 	roomID := b.getRoomID(msg.Channel)
 	if roomID == "" {
 		flog.Errorf("Could not find roomID for %v", msg.Channel)
 		return nil
 	}
 	// add ZWSP because gitter echoes our own messages
-	return b.c.SendMessage(roomID, msg.Username+msg.Text+" ​")
+	return b.c.SendMessage(roomID, msg.Text+" ​")
+}
+
+// Capabilities implements bridge.Capable.
+func (b *Bgitter) Capabilities() helper.Capabilities {
+	return helper.Capabilities{Multiline: true, Markup: helper.MarkupMarkdown}
+}
+
+// ListChannels returns the URIs of the rooms of the user.
+func (b *Bgitter) ListChannels() ([]string, error) {
+	rooms, err := b.c.GetRooms()
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	b.Rooms = rooms
+	b.Unlock()
+	var names []string
+	for _, room := range rooms {
+		names = append(names, room.URI)
+	}
+	return names, nil
 }
 
 func (b *Bgitter) getRoomID(channel string) string {
+	b.RLock()
+	defer b.RUnlock()
 	for _, v := range b.Rooms {
 		if v.URI == channel {
 			return v.ID
@@ -0,0 +1,41 @@
+// Package bridgetest has the helpers shared by the tests of the bridges.
+package bridgetest
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"testing"
+	"time"
+)
+
+// Timeout is how long Receive waits for a message.
+const Timeout = 5 * time.Second
+
+// Joiner is the part of bridge.Bridger used by Start.
+type Joiner interface {
+	Connect() error
+	JoinChannel(channel string) error
+}
+
+// Start connects b and joins channels, the test fails on errors.
+func Start(t testing.TB, b Joiner, channels ...string) {
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for _, channel := range channels {
+		if err := b.JoinChannel(channel); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Receive returns the next message sent by a bridge on c, the test fails
+// when there is none within Timeout.
+func Receive(t testing.TB, c chan config.Message) config.Message {
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(Timeout):
+		t.Fatal("no message received")
+	}
+	return config.Message{}
+}
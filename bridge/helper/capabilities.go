@@ -0,0 +1,73 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capabilities describes what a protocol can show. Bridges declare them so the
+// gateway can format, split and fall back for them.
+type Capabilities struct {
+	Username  bool   // shows a username per message, otherwise it is prefixed to the text
+	Avatar    bool   // shows the avatar of the sender
+	Actions   bool   // shows user_action events natively (/me), otherwise they are sent in italics
+	Multiline bool   // a message can contain several lines, otherwise every line is sent separately
+	Edits     bool   // sent messages can be edited
+	Threads   bool   // messages can be sent in a thread
+	Uploads   bool   // files can be uploaded
+	Markup    Markup // native formatting of the text
+	Limit     Limit  // maximum size of a message (including the username prefix), its Markup is set from Markup
+	Separator string // put between the username prefix and the text
+}
+
+func (m Markup) String() string {
+	switch m {
+	case MarkupIRC:
+		return "irc"
+	case MarkupMarkdown:
+		return "markdown"
+	}
+	return "none"
+}
+
+// String lists the capabilities, eg
+// "username, avatar, multiline, markdown formatting, max 2000 characters (no actions, edits, threads, uploads)".
+func (c Capabilities) String() string {
+	var has, lacks []string
+	for _, f := range []struct {
+		name string
+		ok   bool
+	}{
+		{"username", c.Username},
+		{"avatar", c.Avatar},
+		{"actions", c.Actions},
+		{"multiline", c.Multiline},
+		{"edits", c.Edits},
+		{"threads", c.Threads},
+		{"uploads", c.Uploads},
+	} {
+		if f.ok {
+			has = append(has, f.name)
+		} else {
+			lacks = append(lacks, f.name)
+		}
+	}
+	if c.Markup != MarkupNone {
+		has = append(has, c.Markup.String()+" formatting")
+	}
+	if c.Limit.Max > 0 {
+		unit := "characters"
+		if c.Limit.Bytes {
+			unit = "bytes"
+		}
+		has = append(has, fmt.Sprintf("max %d %s", c.Limit.Max, unit))
+	}
+	s := strings.Join(has, ", ")
+	if len(lacks) > 0 {
+		if s != "" {
+			s += " "
+		}
+		s += "(no " + strings.Join(lacks, ", ") + ")"
+	}
+	return s
+}
@@ -0,0 +1,179 @@
+package helper
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultPalette are the irc colors with good contrast on light and dark backgrounds.
+var DefaultPalette = []int{2, 3, 4, 5, 6, 7, 10, 12, 13}
+
+// poorContrast are the irc colors unreadable on either a light or a dark background
+// (white, black, yellow, light green, light cyan, grey and light grey).
+var poorContrast = map[int]bool{0: true, 1: true, 8: true, 9: true, 11: true, 14: true, 15: true}
+
+// ircHTMLColors maps the 16 standard irc colors to html colors.
+var ircHTMLColors = []string{"#ffffff", "#000000", "#00007f", "#009300", "#ff0000", "#7f0000", "#9c009c", "#fc7f00",
+	"#ffff00", "#00fc00", "#009393", "#00ffff", "#0000fc", "#ff00ff", "#7f7f7f", "#d2d2d2"}
+
+// zwsp is a zero-width space, used to prevent highlighting people on irc.
+const zwsp = "\u200b"
+
+// Palette returns the colors of palette that have a good contrast.
+// DefaultPalette is returned if none are left.
+func Palette(palette []int) []int {
+	var res []int
+	for _, color := range palette {
+		if color >= 0 && color < len(ircHTMLColors) && !poorContrast[color] {
+			res = append(res, color)
+		}
+	}
+	if len(res) == 0 {
+		return DefaultPalette
+	}
+	return res
+}
+
+// IRCColor returns s colored with an irc color picked from palette based on a
+// hash of s, so the same string always gets the same color.
+func IRCColor(s string, palette []int) string {
+	if len(palette) == 0 {
+		return s
+	}
+	// always use 2 digits so a nick starting with a digit is not eaten
+	return fmt.Sprintf("\x03%02d%s\x03", pickColor(s, palette), s)
+}
+
+// pickColor returns a color from palette based on a hash of s.
+func pickColor(s string, palette []int) int {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+// NearestColor returns the irc color of palette closest to the html color
+// ("#rrggbb"), ok is false if color is not a html color.
+func NearestColor(color string, palette []int) (nearest int, ok bool) {
+	r, g, b, ok := parseHTMLColor(color)
+	if !ok || len(palette) == 0 {
+		return 0, false
+	}
+	best := -1
+	for _, c := range palette {
+		cr, cg, cb, _ := parseHTMLColor(ircHTMLColors[c])
+		distance := (r-cr)*(r-cr) + (g-cg)*(g-cg) + (b-cb)*(b-cb)
+		if best == -1 || distance < best {
+			nearest, best = c, distance
+		}
+	}
+	return nearest, true
+}
+
+// parseHTMLColor returns the components of the html color "#rrggbb".
+func parseHTMLColor(color string) (r, g, b int, ok bool) {
+	if len(color) != 7 || color[0] != '#' {
+		return 0, 0, 0, false
+	}
+	n, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return int(n >> 16), int(n >> 8 & 0xff), int(n & 0xff), true
+}
+
+// NoHighlight inserts a zero-width space after the first character of nick so
+// irc clients do not highlight the user with the same nick.
+func NoHighlight(nick string) string {
+	_, n := utf8.DecodeRuneInString(nick)
+	if n == len(nick) {
+		return nick
+	}
+	return nick[:n] + zwsp + nick[n:]
+}
+
+// ColorNick colors the first of nicks found in username with a color based
+// on that nick and makes sure it does not highlight anyone.
+// username is returned unchanged if it does not contain any of the nicks.
+func ColorNick(username string, palette []int, nicks ...string) string {
+	for _, nick := range nicks {
+		i := strings.Index(username, nick)
+		if nick == "" || i == -1 || len(palette) == 0 {
+			continue
+		}
+		return username[:i] + IRCColor(NoHighlight(nick), []int{pickColor(nick, palette)}) + username[i+len(nick):]
+	}
+	return username
+}
+
+// ircFormatting are the irc formatting codes other than the colors (bold,
+// italic, underline, strikethrough, monospace, reverse and reset).
+const ircFormatting = "\x02\x1d\x1f\x1e\x11\x16\x0f"
+
+// IRCColorsToHTML converts irc colors in s to html spans and escapes the rest of s.
+// It returns the html and s without the irc colors. The other irc formatting
+// codes are dropped, reset (\x0f) also ends the color.
+func IRCColorsToHTML(s string) (string, string) {
+	var htmlText, plain []string
+	open := false
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "\x03"+ircFormatting)
+		if i == -1 {
+			i = len(s)
+		}
+		htmlText = append(htmlText, html.EscapeString(s[:i]))
+		plain = append(plain, s[:i])
+		if i == len(s) {
+			break
+		}
+		code := s[i]
+		s = s[i+1:]
+		if open && (code == '\x03' || code == '\x0f') {
+			htmlText = append(htmlText, "</span>")
+			open = false
+		}
+		if code != '\x03' {
+			continue
+		}
+		j := 0
+		for j < 2 && j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			j++
+		}
+		if j == 0 {
+			continue
+		}
+		var color int
+		fmt.Sscanf(s[:j], "%d", &color)
+		background := -1
+		if j+1 < len(s) && s[j] == ',' && s[j+1] >= '0' && s[j+1] <= '9' {
+			k := j + 1
+			for k < j+3 && k < len(s) && s[k] >= '0' && s[k] <= '9' {
+				k++
+			}
+			fmt.Sscanf(s[j+1:k], "%d", &background)
+			j = k
+		}
+		s = s[j:]
+		if color < len(ircHTMLColors) {
+			style := "color: " + ircHTMLColors[color]
+			if background >= 0 && background < len(ircHTMLColors) {
+				style += "; background-color: " + ircHTMLColors[background]
+			}
+			htmlText = append(htmlText, "<span style='"+style+"'>")
+			open = true
+		}
+	}
+	if open {
+		htmlText = append(htmlText, "</span>")
+	}
+	return strings.Join(htmlText, ""), strings.Join(plain, "")
+}
+
+// StripIRCFormatting returns s without its irc colors and formatting codes.
+func StripIRCFormatting(s string) string {
+	_, plain := IRCColorsToHTML(s)
+	return plain
+}
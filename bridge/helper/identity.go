@@ -0,0 +1,40 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Identities groups the nicks a user has on different accounts.
+// It maps "account:nick" to the number of the user.
+type Identities map[string]int
+
+// ParseIdentities parses entries listing the nicks of one user separated by
+// spaces as account:nick (eg "irc.freenode:alice slack.myteam:alice.s").
+func ParseIdentities(entries []string) (Identities, error) {
+	ids := make(Identities)
+	for i, entry := range entries {
+		for _, field := range strings.Fields(entry) {
+			parts := strings.SplitN(field, ":", 2)
+			if len(parts) != 2 || !strings.Contains(parts[0], ".") || parts[1] == "" {
+				return nil, fmt.Errorf("invalid identity %q, it must look like account:nick (eg irc.freenode:alice)", field)
+			}
+			if other, ok := ids[field]; ok && other != i {
+				return nil, fmt.Errorf("%s is listed in more than one identity", field)
+			}
+			ids[field] = i
+		}
+	}
+	return ids, nil
+}
+
+// Same returns true if nick1 on account1 and nick2 on account2 are the same user:
+// the same nick on the same account, or nicks listed in the same identity.
+func (ids Identities) Same(account1, nick1, account2, nick2 string) bool {
+	if account1 == account2 && nick1 == nick2 {
+		return true
+	}
+	id1, ok1 := ids[account1+":"+nick1]
+	id2, ok2 := ids[account2+":"+nick2]
+	return ok1 && ok2 && id1 == id2
+}
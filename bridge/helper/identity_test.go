@@ -0,0 +1,30 @@
+package helper
+
+import "testing"
+
+func TestIdentities(t *testing.T) {
+	ids, err := ParseIdentities([]string{"irc.freenode:alice slack.team:alice.s", "irc.freenode:bob slack.team:robert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		account1, nick1, account2, nick2 string
+		want                             bool
+	}{
+		{"irc.freenode", "alice", "slack.team", "alice.s", true},
+		{"slack.team", "robert", "irc.freenode", "bob", true},
+		{"irc.freenode", "carol", "irc.freenode", "carol", true},
+		{"irc.freenode", "carol", "slack.team", "carol", false},
+		{"irc.freenode", "alice", "slack.team", "robert", false},
+	} {
+		if got := ids.Same(test.account1, test.nick1, test.account2, test.nick2); got != test.want {
+			t.Errorf("Same(%s:%s, %s:%s) = %t", test.account1, test.nick1, test.account2, test.nick2, got)
+		}
+	}
+	// the last one lists irc.freenode:a in a second identity
+	for _, entry := range []string{"alice", "irc:alice", "irc.freenode:", "slack.team:c irc.freenode:a"} {
+		if _, err := ParseIdentities([]string{"irc.freenode:a slack.team:b", entry}); err == nil {
+			t.Errorf("%q: expected an error", entry)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package helper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxNicks is the maximum number of nicks named in a join/part message.
+const maxNicks = 5
+
+// JoinPartVerbs are the verbs of the join/part messages built by JoinPartText.
+var JoinPartVerbs = []string{"join", "part", "quit"}
+
+// JoinPartText returns the text of a join/part event of nicks, eg "alice joins"
+// or "alice, bob and carol quit". verb is one of JoinPartVerbs.
+func JoinPartText(nicks []string, verb string) string {
+	if len(nicks) == 1 {
+		verb += "s"
+	}
+	return ListNicks(nicks) + " " + verb
+}
+
+// ListNicks returns "a", "a and b", "a, b and c" or "a, b, c, d, e and 3 others".
+func ListNicks(nicks []string) string {
+	if len(nicks) > maxNicks {
+		return strings.Join(nicks[:maxNicks], ", ") + fmt.Sprintf(" and %d others", len(nicks)-maxNicks)
+	}
+	if len(nicks) == 1 {
+		return nicks[0]
+	}
+	return strings.Join(nicks[:len(nicks)-1], ", ") + " and " + nicks[len(nicks)-1]
+}
@@ -0,0 +1,51 @@
+package helper
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseNetworks parses networks separated by spaces, in CIDR notation
+// (eg "192.168.1.0/24") or single addresses.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Fields(s) {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// InNetworks returns true if the IP of addr (host:port) is in one of networks.
+func InNetworks(networks []*net.IPNet, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
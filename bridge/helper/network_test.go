@@ -0,0 +1,21 @@
+package helper
+
+import "testing"
+
+func TestInNetworks(t *testing.T) {
+	networks, err := ParseNetworks("127.0.0.0/8 ::1 192.168.1.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{"127.0.0.1:2525": true, "[::1]:2525": true, "192.168.1.10:25": true,
+		"192.168.1.11:25": false, "10.0.0.1:25": false, "[::2]:25": false} {
+		if got := InNetworks(networks, addr); got != want {
+			t.Errorf("%s: expected %t, got %t", addr, want, got)
+		}
+	}
+	for _, s := range []string{"10.0.0.0/33", "localhost"} {
+		if _, err := ParseNetworks(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package helper contains functions shared by the different bridges.
+package helper
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Markup is the formatting syntax used on a protocol.
+type Markup int
+
+const (
+	MarkupNone Markup = iota
+	MarkupIRC
+	MarkupMarkdown
+)
+
+// Limit describes the maximum size of one message on a protocol.
+type Limit struct {
+	Max    int    // maximum size of a message (including the nick prefix), 0 means no limit
+	Bytes  bool   // count bytes instead of characters (irc)
+	Markup Markup // formatting spans that should not be broken
+}
+
+// minRoom is the minimum amount of text we put on a line when the prefix
+// itself almost fills up the limit.
+const minRoom = 16
+
+// Size returns the size of s as counted by this limit.
+func (l Limit) Size(s string) int {
+	if l.Bytes {
+		return len(s)
+	}
+	return utf8.RuneCountInString(s)
+}
+
+// Split splits text in parts that fit in the limit when prefixed with prefix.
+// It splits at word boundaries when possible, never in the middle of a
+// multibyte character, and closes and reopens formatting spans that would
+// otherwise be broken. Every part is returned with prefix prepended.
+func Split(text string, prefix string, limit Limit) []string {
+	if limit.Max <= 0 || limit.Size(prefix+text) <= limit.Max {
+		return []string{prefix + text}
+	}
+	room := limit.Max - limit.Size(prefix)
+	if room < minRoom {
+		room = minRoom
+	}
+	var parts []string
+	for text != "" {
+		if limit.Size(text) <= room {
+			parts = append(parts, prefix+text)
+			break
+		}
+		part, rest := limit.cut(text, room)
+		parts = append(parts, prefix+part)
+		text = rest
+	}
+	return parts
+}
+
+// cut returns the first part of text that fits in room and the remaining text.
+func (l Limit) cut(text string, room int) (string, string) {
+	for max := room; max > 0; max-- {
+		end := l.fit(text, max)
+		if end == 0 {
+			break
+		}
+		pos := l.breakpoint(text, end)
+		part := strings.TrimRight(text[:pos], " ")
+		if part == "" {
+			part, pos = text[:end], end
+		}
+		closing, reopen := l.Markup.spans(text[:pos])
+		if l.Size(part+closing) > room {
+			continue
+		}
+		return part + closing, reopen + strings.TrimLeft(text[pos:], " ")
+	}
+	// room is too small for closing the spans, just cut the text
+	end := l.fit(text, room)
+	if end == 0 {
+		_, end = utf8.DecodeRuneInString(text)
+	}
+	return text[:end], text[end:]
+}
+
+// fit returns the largest byte offset at a character boundary where text[:offset]
+// fits in max.
+func (l Limit) fit(text string, max int) int {
+	size := 0
+	for i, r := range text {
+		n := 1
+		if l.Bytes {
+			n = utf8.RuneLen(r)
+		}
+		if size+n > max {
+			return i
+		}
+		size += n
+	}
+	return len(text)
+}
+
+// breakpoint returns the position where text[:end] should be split.
+// It prefers the last space outside of a formatting span, then the last space.
+// It returns end if text[:end] does not contain a space.
+func (l Limit) breakpoint(text string, end int) int {
+	if end == len(text) {
+		return end
+	}
+	last := -1
+	for i := end; i > 0; i-- {
+		if text[i] != ' ' {
+			continue
+		}
+		if last == -1 {
+			last = i
+		}
+		if closing, _ := l.Markup.spans(text[:i]); closing == "" {
+			return i
+		}
+	}
+	if last > 0 {
+		return last
+	}
+	return end
+}
+
+// spans returns the markers needed to close the formatting spans still open
+// at the end of text and the markers to reopen them on the next part.
+func (m Markup) spans(text string) (string, string) {
+	switch m {
+	case MarkupIRC:
+		return ircSpans(text)
+	case MarkupMarkdown:
+		return markdownSpans(text)
+	}
+	return "", ""
+}
+
+func ircSpans(text string) (string, string) {
+	var toggles []byte
+	color := ""
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '\x02', '\x1d', '\x1f', '\x16', '\x11':
+			if j := strings.IndexByte(string(toggles), c); j >= 0 {
+				toggles = append(toggles[:j], toggles[j+1:]...)
+			} else {
+				toggles = append(toggles, c)
+			}
+		case '\x03':
+			j := i + 1
+			for n := 0; n < 2 && j < len(text) && text[j] >= '0' && text[j] <= '9'; n++ {
+				j++
+			}
+			if j > i+1 && j+1 < len(text) && text[j] == ',' && text[j+1] >= '0' && text[j+1] <= '9' {
+				j += 2
+				if j < len(text) && text[j] >= '0' && text[j] <= '9' {
+					j++
+				}
+			}
+			color = text[i:j]
+			if color == "\x03" {
+				color = ""
+			}
+			i = j - 1
+		case '\x0f':
+			toggles = toggles[:0]
+			color = ""
+		}
+	}
+	if len(toggles) == 0 && color == "" {
+		return "", ""
+	}
+	return "\x0f", color + string(toggles)
+}
+
+func markdownSpans(text string) (string, string) {
+	fence := false
+	inline := false
+	for i := 0; i < len(text); i++ {
+		if text[i] != '`' {
+			continue
+		}
+		if !inline && strings.HasPrefix(text[i:], "```") {
+			fence = !fence
+			i += 2
+			continue
+		}
+		if !fence {
+			inline = !inline
+		}
+	}
+	switch {
+	case fence:
+		return "\n```", "```\n"
+	case inline:
+		return "`", "`"
+	}
+	return "", ""
+}
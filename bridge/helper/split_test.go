@@ -0,0 +1,42 @@
+package helper
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		prefix string
+		limit  Limit
+		want   []string
+	}{
+		{"no limit", "hello world", "<n> ", Limit{}, []string{"<n> hello world"}},
+		{"fits", "hello world", "<n> ", Limit{Max: 15}, []string{"<n> hello world"}},
+		{"word boundary", "hello world again", "<n> ", Limit{Max: 16}, []string{"<n> hello world", "<n> again"}},
+		{"long word", strings.Repeat("a", 20), "", Limit{Max: 16}, []string{strings.Repeat("a", 16), "aaaa"}},
+		{"multibyte bytes", "ééééééééééé", "", Limit{Max: 17, Bytes: true}, []string{"éééééééé", "ééé"}},
+		{"multibyte characters", "ééééééééééé", "", Limit{Max: 17}, []string{"ééééééééééé"}},
+		{"inline code", "aaaa `bb cc dd ee ff` gg", "", Limit{Max: 18, Markup: MarkupMarkdown},
+			[]string{"aaaa", "`bb cc dd ee ff`", "gg"}},
+		{"irc bold", "\x02bold text that is long\x02", "", Limit{Max: 18, Markup: MarkupIRC},
+			[]string{"\x02bold text that\x0f", "\x02is long\x02"}},
+	}
+	for _, tt := range tests {
+		got := Split(tt.text, tt.prefix, tt.limit)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		for _, part := range got {
+			if !utf8.ValidString(part) {
+				t.Errorf("%s: invalid utf-8 in %q", tt.name, part)
+			}
+			if tt.limit.Max > 0 && tt.limit.Size(part) > tt.limit.Max {
+				t.Errorf("%s: %q is longer than %d", tt.name, part, tt.limit.Max)
+			}
+		}
+	}
+}
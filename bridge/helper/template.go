@@ -0,0 +1,103 @@
+package helper
+
+import (
+	"bytes"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// TemplateData is the data available in RemoteNickFormat, JoinPartFormat and EventFormat templates.
+type TemplateData struct {
+	Nick        string // username of the sender
+	DisplayName string // display name of the sender (username if unknown)
+	Account     string // sending account (e.g. irc.freenode)
+	Protocol    string // protocol of the sending account (e.g. irc)
+	Bridge      string // name of the sending account (e.g. freenode)
+	Label       string // Label of the sending account
+	Channel     string // channel the message was sent on
+	Gateway     string // name of the gateway
+	Text        string // text of the message
+	Event       string // event of the message (eg "join_leave", "user_action"), empty for messages
+}
+
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"truncate": func(n int, s string) string {
+		runes := []rune(s)
+		if len(runes) <= n {
+			return s
+		}
+		return string(runes[:n])
+	},
+	"color": func(s string) string {
+		return IRCColor(s, DefaultPalette)
+	},
+}
+
+// legacyReplacer converts the old {NICK} style placeholders to templates.
+var legacyReplacer = strings.NewReplacer(
+	"{NICK}", "{{.Nick}}",
+	"{BRIDGE}", "{{.Bridge}}",
+	"{PROTOCOL}", "{{.Protocol}}",
+	"{LABEL}", "{{.Label}}",
+	"{GATEWAY}", "{{.Gateway}}",
+	"{CHANNEL}", "{{.Channel}}",
+)
+
+// ParseTemplate parses a text/template with the helper functions
+// (lower, upper, truncate, color) available.
+// The placeholders {NICK}, {BRIDGE} and {PROTOCOL} are still supported.
+func ParseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(legacyReplacer.Replace(text))
+}
+
+// ParseTemplateFuncs is ParseTemplate with the additional functions funcs.
+func ParseTemplateFuncs(name string, text string, funcs template.FuncMap) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Funcs(funcs).Parse(legacyReplacer.Replace(text))
+}
+
+var (
+	templates   = make(map[string]*template.Template)
+	templatesMu sync.Mutex
+)
+
+// Render executes the template format with data. Parsed templates are cached.
+// When format is not a valid template it is logged and returned as is.
+func Render(format string, data TemplateData) string {
+	if format == "" {
+		return ""
+	}
+	templatesMu.Lock()
+	tmpl, ok := templates[format]
+	if !ok {
+		var err error
+		tmpl, err = ParseTemplate("format", format)
+		if err != nil {
+			log.Errorf("invalid template %q: %s", format, err)
+		}
+		templates[format] = tmpl
+	}
+	templatesMu.Unlock()
+	if tmpl == nil {
+		return format
+	}
+	res, err := ExecuteTemplate(tmpl, data)
+	if err != nil {
+		log.Errorf("executing template %q failed: %s", format, err)
+		return format
+	}
+	return res
+}
+
+// ExecuteTemplate executes tmpl with data and returns the result.
+func ExecuteTemplate(tmpl *template.Template, data TemplateData) (string, error) {
+	if data.DisplayName == "" {
+		data.DisplayName = data.Nick
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
@@ -0,0 +1,67 @@
+package helper
+
+import (
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	data := TemplateData{Nick: "Alice", Protocol: "irc", Bridge: "freenode", Label: "fn", Channel: "#test", Gateway: "gw"}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"[{PROTOCOL}] <{NICK}> ", "[irc] <Alice> "},
+		{"<{{.Nick}}/{{.Label}}> ", "<Alice/fn> "},
+		{"{{.DisplayName}}", "Alice"},
+		{"{{lower .Nick}}@{{upper .Bridge}}", "alice@FREENODE"},
+		{"{{.Nick | truncate 3}}", "Ali"},
+		{"{{.Gateway}}:{{.Channel}}", "gw:#test"},
+		{"{{.Nick", "{{.Nick"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Render(tt.format, data); got != tt.want {
+			t.Errorf("Render(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestColorNick(t *testing.T) {
+	palette := Palette(nil)
+	got := ColorNick("<alice> ", palette, "alice")
+	if got != ColorNick("<alice> ", palette, "alice") {
+		t.Errorf("color is not deterministic")
+	}
+	if want := "<" + IRCColor("a"+zwsp+"lice", []int{pickColor("alice", palette)}) + "> "; got != want {
+		t.Errorf("ColorNick = %q, want %q", got, want)
+	}
+	if got := ColorNick("<bob> ", palette, "alice"); got != "<bob> " {
+		t.Errorf("ColorNick changed a username without the nick: %q", got)
+	}
+	for _, color := range Palette([]int{0, 1, 4, 8, 99}) {
+		if color != 4 {
+			t.Errorf("Palette kept color %d with poor contrast", color)
+		}
+	}
+}
+
+func TestIRCColorsToHTML(t *testing.T) {
+	htmlText, plain := IRCColorsToHTML("<\x0304a" + zwsp + "lice\x03> \x02bold\x02 & \x0312blue\x0f \x1ditalic\x1d")
+	if want := "&lt;<span style='color: #ff0000'>a" + zwsp + "lice</span>&gt; bold &amp; <span style='color: #0000fc'>blue</span> italic"; htmlText != want {
+		t.Errorf("IRCColorsToHTML html = %q, want %q", htmlText, want)
+	}
+	if want := "<a" + zwsp + "lice> bold & blue italic"; plain != want {
+		t.Errorf("IRCColorsToHTML plain = %q, want %q", plain, want)
+	}
+	if got := StripIRCFormatting("\x02hi\x0f \x0303there"); got != "hi there" {
+		t.Errorf("StripIRCFormatting = %q", got)
+	}
+	htmlText, plain = IRCColorsToHTML("\x0304,12red on blue\x03 \x031,2 3 \x035,text")
+	if want := "<span style='color: #ff0000; background-color: #0000fc'>red on blue</span> " +
+		"<span style='color: #000000; background-color: #00007f'> 3 </span><span style='color: #7f0000'>,text</span>"; htmlText != want {
+		t.Errorf("IRCColorsToHTML html = %q, want %q", htmlText, want)
+	}
+	if want := "red on blue  3 ,text"; plain != want {
+		t.Errorf("IRCColorsToHTML plain = %q, want %q", plain, want)
+	}
+}
@@ -0,0 +1,49 @@
+package helper
+
+import (
+	"strconv"
+	"time"
+)
+
+// ParseTimestamp parses the timestamps of webhooks and APIs: RFC 3339 (rocketchat)
+// or seconds since the epoch with an optional fraction (slack, mattermost).
+// Numbers too large to be seconds are taken as milliseconds.
+// It returns the zero time when s can not be parsed.
+func ParseTimestamp(s string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}
+	}
+	if f > 1e11 {
+		f /= 1000
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9))
+}
+
+// DelayedThreshold returns the first non-zero DelayedThreshold (in seconds) of
+// thresholds, 5 minutes by default. A negative value disables the marker.
+func DelayedThreshold(thresholds ...int) time.Duration {
+	for _, threshold := range thresholds {
+		if threshold != 0 {
+			return time.Duration(threshold) * time.Second
+		}
+	}
+	return 5 * time.Minute
+}
+
+// Delayed returns the "[15:04] (delayed) " marker when t is more than
+// threshold before now, or an empty string.
+func Delayed(t time.Time, now time.Time, threshold time.Duration) string {
+	if t.IsZero() || threshold <= 0 || now.Sub(t) <= threshold {
+		return ""
+	}
+	format := "15:04"
+	if now.Sub(t) > 20*time.Hour {
+		format = "Jan 2 15:04"
+	}
+	return "[" + t.Local().Format(format) + "] (delayed) "
+}
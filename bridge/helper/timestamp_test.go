@@ -0,0 +1,35 @@
+package helper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2017, 5, 1, 12, 30, 0, 0, time.UTC)
+	for _, s := range []string{"2017-05-01T12:30:00Z", "2017-05-01T12:30:00.000Z", "1493641800", "1493641800.000005", "1493641800000"} {
+		got := ParseTimestamp(s)
+		if d := got.Sub(want); d < 0 || d > time.Millisecond {
+			t.Errorf("ParseTimestamp(%q) = %s, want %s", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "-1"} {
+		if got := ParseTimestamp(s); !got.IsZero() {
+			t.Errorf("ParseTimestamp(%q) = %s, want zero time", s, got)
+		}
+	}
+}
+
+func TestDelayed(t *testing.T) {
+	now := time.Now()
+	if got := Delayed(now.Add(-time.Minute), now, 5*time.Minute); got != "" {
+		t.Errorf("recent message marked as delayed: %q", got)
+	}
+	if got := Delayed(time.Time{}, now, 5*time.Minute); got != "" {
+		t.Errorf("message without timestamp marked as delayed: %q", got)
+	}
+	old := now.Add(-10 * time.Minute)
+	if got, want := Delayed(old, now, 5*time.Minute), "["+old.Format("15:04")+"] (delayed) "; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -1,16 +1,22 @@
 package birc
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	log "github.com/Sirupsen/logrus"
 	ircm "github.com/sorcix/irc"
 	"github.com/thoj/go-ircevent"
+	stdlog "log"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,13 +29,35 @@ type Birc struct {
 	connected chan struct{}
 	Local     chan config.Message // local queue for flood control
 	Account   string
+	stop      chan struct{}          // closed by Disconnect
+	sendDone  chan struct{}          // closed when the local queue is sent
+	joinParts []joinPart             // joins, parts and quits waiting to be coalesced
+	netsplit  map[string]time.Time   // nicks that quit in a netsplit
+	twitch    bool                   // twitch chat (NewTwitch)
+	settings  TwitchSettings         // settings of the twitch accounts
+	rooms     map[string]*twitchRoom // twitch channels
+	stopOnce  sync.Once
+	sync.Mutex
 }
 
 var flog *log.Entry
 var protocol = "irc"
 
+// ircLineLength is the maximum length of an irc line including the trailing CR-LF
+const ircLineLength = 512
+
+// maxChannelLength is the longest channel name the message limit leaves room for.
+const maxChannelLength = 50
+
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Server", "Nick")})
+	bridge.Register("twitch", func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return NewTwitch(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Nick", "Password"),
+		Settings: func() interface{} { return &TwitchSettings{} }, Check: checkTwitch})
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Birc {
@@ -40,6 +68,9 @@ func New(cfg config.Protocol, account string, c chan config.Message) *Birc {
 	b.names = make(map[string][]string)
 	b.Account = account
 	b.connected = make(chan struct{})
+	b.stop = make(chan struct{})
+	b.sendDone = make(chan struct{})
+	b.netsplit = make(map[string]time.Time)
 	if b.Config.MessageDelay == 0 {
 		b.Config.MessageDelay = 1300
 	}
@@ -63,6 +94,8 @@ func (b *Birc) Command(msg *config.Message) string {
 func (b *Birc) Connect() error {
 	flog.Infof("Connecting %s", b.Config.Server)
 	i := irc.IRC(b.Config.Nick, b.Config.Nick)
+	// the debug output contains the passwords
+	i.Log = stdlog.New(config.RedactWriter(os.Stdout), "", stdlog.LstdFlags)
 	if log.GetLevel() == log.DebugLevel {
 		i.Debug = true
 	}
@@ -84,13 +117,43 @@ func (b *Birc) Connect() error {
 	case <-b.connected:
 		flog.Info("Connection succeeded")
 	case <-time.After(time.Second * 30):
+		// doSend is not started, Disconnect must not wait for it
+		close(b.sendDone)
 		return fmt.Errorf("connection timed out")
 	}
-	i.Debug = false
+	if i.Debug {
+		// the connection is already writing, only touch Debug when it was set
+		i.Debug = false
+	}
 	go b.doSend()
 	return nil
 }
 
+func (b *Birc) Disconnect(ctx context.Context) error {
+	if b.i == nil {
+		return nil
+	}
+	// doSend stops when the queue is empty
+	b.stopOnce.Do(func() { close(b.stop) })
+	select {
+	case <-b.sendDone:
+	case <-ctx.Done():
+		flog.Warnf("dropping %d queued messages", len(b.Local))
+	}
+	b.i.QuitMessage = b.Config.QuitMessage
+	if b.i.QuitMessage == "" {
+		b.i.QuitMessage = "matterbridge shutting down"
+	}
+	flog.Infof("Disconnecting %s", b.Config.Server)
+	b.i.Quit()
+	// give the connection some time to send the QUIT
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+	}
+	return nil
+}
+
 func (b *Birc) JoinChannel(channel string) error {
 	b.i.Join(channel)
 	return nil
@@ -101,16 +164,32 @@ func (b *Birc) Send(msg config.Message) error {
 	if msg.Account == b.Account {
 		return nil
 	}
-	if strings.HasPrefix(msg.Text, "!") {
-		b.Command(&msg)
+	// irc has no typing notifications
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
+	if b.twitch && !b.canSend(msg.Channel) {
+		return nil
+	}
+	select {
+	case <-b.stop:
+		flog.Debugf("disconnected, dropping message")
 		return nil
+	default:
 	}
+	event := ""
+	if msg.Event == config.EVENT_USER_ACTION {
+		// sent as CTCP ACTION: \x01ACTION text\x01
+		event = msg.Event
+	}
+	// the gateway sends the lines separately (no Multiline capability),
+	// never let a newline through as it would end the irc command.
 	for _, text := range strings.Split(msg.Text, "\n") {
 		if len(b.Local) < b.Config.MessageQueue {
 			if len(b.Local) == b.Config.MessageQueue-1 {
 				text = text + " <message clipped>"
 			}
-			b.Local <- config.Message{Text: text, Username: msg.Username, Channel: msg.Channel}
+			b.Local <- config.Message{Text: text, Channel: msg.Channel, Event: event}
 		} else {
 			flog.Debugf("flooding, dropping message (queue at %d)", len(b.Local))
 		}
@@ -118,12 +197,53 @@ func (b *Birc) Send(msg config.Message) error {
 	return nil
 }
 
+// Capabilities implements bridge.Capable. The limit leaves room for the CTCP
+// ACTION markers. Twitch chat is plain text.
+func (b *Birc) Capabilities() helper.Capabilities {
+	if b.twitch {
+		return twitchCapabilities()
+	}
+	limit := b.messageLimit()
+	limit.Max -= len("\x01ACTION \x01")
+	return helper.Capabilities{Actions: true, Markup: helper.MarkupIRC, Limit: limit}
+}
+
+// messageLimit returns the maximum size of a message.
+func (b *Birc) messageLimit() helper.Limit {
+	max := b.Config.MessageLength
+	if max == 0 {
+		// the server prepends ":nick!user@host " when relaying our PRIVMSG,
+		// reserve room for the longest possible user (10) and host (63).
+		max = ircLineLength - len("\r\n") - len("PRIVMSG :") - maxChannelLength - len(":"+b.Nick+"!@ ") - 10 - 63
+	}
+	return helper.Limit{Max: max, Bytes: true, Markup: helper.MarkupIRC}
+}
+
 func (b *Birc) doSend() {
 	rate := time.Millisecond * time.Duration(b.Config.MessageDelay)
 	throttle := time.Tick(rate)
-	for msg := range b.Local {
+	defer close(b.sendDone)
+	for {
+		var msg config.Message
+		select {
+		case msg = <-b.Local:
+		case <-b.stop:
+			// send what is left in the queue
+			select {
+			case msg = <-b.Local:
+			default:
+				return
+			}
+		}
 		<-throttle
-		b.i.Privmsg(msg.Channel, msg.Username+msg.Text)
+		if b.twitch {
+			b.slowModeWait(msg.Channel)
+		}
+		if msg.Event == config.EVENT_USER_ACTION {
+			b.i.Action(msg.Channel, msg.Text)
+			continue
+		}
+		b.i.Privmsg(msg.Channel, msg.Text)
 	}
 }
 
@@ -147,7 +267,8 @@ func (b *Birc) endNames(event *irc.Event) {
 
 func (b *Birc) handleNewConnection(event *irc.Event) {
 	flog.Debug("Registering callbacks")
-	i := b.i
+	// b.i may not be set yet, the welcome can arrive before Connect returns
+	i := event.Connection
 	b.Nick = event.Arguments[0]
 	i.AddCallback("PRIVMSG", b.handlePrivMsg)
 	i.AddCallback("CTCP_ACTION", b.handlePrivMsg)
@@ -161,19 +282,97 @@ func (b *Birc) handleNewConnection(event *irc.Event) {
 	i.AddCallback("JOIN", b.handleJoinPart)
 	i.AddCallback("PART", b.handleJoinPart)
 	i.AddCallback("QUIT", b.handleJoinPart)
+	i.AddCallback("NICK", b.handleEvent)
+	i.AddCallback("KICK", b.handleEvent)
+	i.AddCallback("TOPIC", b.handleEvent)
+	i.AddCallback("AWAY", b.handleEvent)
 	i.AddCallback("*", b.handleOther)
+	if b.Config.UseSASL {
+		// SASL is done, its CAP callback must not answer our requests
+		i.ClearCallback("CAP")
+	}
+	if b.twitch {
+		i.SendRaw("CAP REQ :twitch.tv/tags twitch.tv/commands twitch.tv/membership")
+	} else {
+		// servers supporting away-notify send the AWAY of the users we share a channel with
+		i.SendRaw("CAP REQ :away-notify")
+	}
 	// we are now fully connected
 	b.connected <- struct{}{}
 }
 
+// handleJoinPart buffers the joins, parts and quits, they are sent
+// coalesced after JoinPartWindow seconds.
 func (b *Birc) handleJoinPart(event *irc.Event) {
-	flog.Debugf("Sending JOIN_LEAVE event from %s to gateway", b.Account)
-	channel := event.Arguments[0]
+	flog.Debugf("handle %#v", event)
+	jp := joinPart{kind: event.Code, nick: event.Nick}
 	if event.Code == "QUIT" {
-		channel = ""
+		jp.reason = event.Message()
+	} else {
+		jp.channel = event.Arguments[0]
 	}
-	b.Remote <- config.Message{Username: "system", Text: event.Nick + " " + strings.ToLower(event.Code) + "s", Channel: channel, Account: b.Account, Event: config.EVENT_JOIN_LEAVE}
-	flog.Debugf("handle %#v", event)
+	window := time.Duration(b.Config.JoinPartWindow) * time.Second
+	if b.Config.JoinPartWindow == 0 {
+		window = 3 * time.Second
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.joinParts = append(b.joinParts, jp)
+	if len(b.joinParts) == 1 {
+		time.AfterFunc(window, b.flushJoinParts)
+	}
+}
+
+func (b *Birc) flushJoinParts() {
+	b.Lock()
+	events := b.joinParts
+	b.joinParts = nil
+	msgs := coalesceJoinParts(events, b.netsplit, time.Now())
+	b.Unlock()
+	for _, msg := range msgs {
+		flog.Debugf("Sending JOIN_LEAVE event from %s to gateway", b.Account)
+		msg.Account = b.Account
+		b.Remote <- msg
+	}
+}
+
+// handleEvent sends nick changes, kicks, topic changes and away messages to the gateway.
+func (b *Birc) handleEvent(event *irc.Event) {
+	if event.Nick == b.Nick {
+		return
+	}
+	msg := config.Message{Username: "system", Account: b.Account}
+	switch event.Code {
+	case "NICK":
+		msg.Event = config.EVENT_NICK_CHANGE
+		msg.Text = event.Nick + " is now known as " + event.Message()
+	case "KICK":
+		if len(event.Arguments) < 2 {
+			return
+		}
+		msg.Event = config.EVENT_KICK
+		msg.Channel = event.Arguments[0]
+		msg.Text = event.Arguments[1] + " was kicked by " + event.Nick
+		if reason := event.Message(); reason != "" && reason != event.Arguments[1] {
+			msg.Text += ": " + reason
+		}
+	case "TOPIC":
+		msg.Event = config.EVENT_TOPIC_CHANGE
+		msg.Channel = event.Arguments[0]
+		msg.Text = event.Nick + " changed the topic to: " + event.Message()
+	case "AWAY":
+		// only received with the away-notify capability
+		msg.Event = config.EVENT_AWAY
+		msg.Nicks = []string{event.Nick}
+		msg.Text = event.Nick + " is back"
+		if event.Message() != "" {
+			msg.Text = event.Nick + " is away: " + event.Message()
+		}
+	default:
+		return
+	}
+	flog.Debugf("Sending %s event from %s to gateway", msg.Event, b.Account)
+	b.Remote <- msg
 }
 
 func (b *Birc) handleNotice(event *irc.Event) {
@@ -185,6 +384,10 @@ func (b *Birc) handleNotice(event *irc.Event) {
 }
 
 func (b *Birc) handleOther(event *irc.Event) {
+	if b.twitch && strings.HasPrefix(event.Raw, "@") {
+		b.handleTwitch(event.Raw)
+		return
+	}
 	switch event.Code {
 	case "372", "375", "376", "250", "251", "252", "253", "254", "255", "265", "266", "002", "003", "004", "005":
 		return
@@ -202,16 +405,19 @@ func (b *Birc) handlePrivMsg(event *irc.Event) {
 		return
 	}
 	flog.Debugf("handlePrivMsg() %s %s %#v", event.Nick, event.Message(), event)
-	msg := ""
-	if event.Code == "CTCP_ACTION" {
-		msg = event.Nick + " "
-	}
-	msg += event.Message()
+	msg := event.Message()
 	// strip IRC colors
 	re := regexp.MustCompile(`[[:cntrl:]](\d+,|)\d+`)
 	msg = re.ReplaceAllString(msg, "")
 	flog.Debugf("Sending message from %s on %s to gateway", event.Arguments[0], b.Account)
-	b.Remote <- config.Message{Username: event.Nick, Text: msg, Channel: event.Arguments[0], Account: b.Account}
+	rmsg := config.Message{Username: event.Nick, Text: msg, Channel: event.Arguments[0], Account: b.Account, Timestamp: time.Now()}
+	switch event.Code {
+	case "CTCP_ACTION":
+		rmsg.Event = config.EVENT_USER_ACTION
+	case "NOTICE":
+		rmsg.Event = config.EVENT_NOTICE
+	}
+	b.Remote <- rmsg
 }
 
 func (b *Birc) handleTopicWhoTime(event *irc.Event) {
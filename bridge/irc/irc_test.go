@@ -0,0 +1,103 @@
+package birc
+
+import (
+	"bufio"
+	"context"
+	"github.com/42wim/matterbridge/bridge/config"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve welcomes the first client connecting to l, answers the lines in
+// replies and sends the lines it receives on the returned channel.
+func serve(t *testing.T, l net.Listener, replies map[string]string) chan string {
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "USER ") {
+				conn.Write([]byte(":irc.test 001 bot :Welcome\r\n"))
+			}
+			if reply, ok := replies[line]; ok {
+				conn.Write([]byte(reply))
+			}
+			lines <- line
+		}
+	}()
+	return lines
+}
+
+func TestDisconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := serve(t, l, nil)
+	b := New(config.Protocol{Server: l.Addr().String(), Nick: "bot", MessageDelay: 1}, "irc.test", make(chan config.Message, 10))
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	b.Send(config.Message{Channel: "#test", Text: "one\ntwo"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Disconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// messages relayed after the disconnection are dropped
+	b.Send(config.Message{Channel: "#test", Text: "three"})
+
+	var sent []string
+	for len(sent) < 3 {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, "PRIVMSG ") || strings.HasPrefix(line, "QUIT ") {
+				sent = append(sent, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("QUIT not received, got %q", sent)
+		}
+	}
+	if strings.Join(sent, "|") != "PRIVMSG #test :one|PRIVMSG #test :two|QUIT :matterbridge shutting down" {
+		t.Errorf("expected the queued messages sent before QUIT, got %q", sent)
+	}
+}
+
+func TestAwayNotify(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	serve(t, l, map[string]string{"CAP REQ :away-notify": ":irc.test CAP bot ACK :away-notify\r\n" +
+		":alice!a@host AWAY :lunch\r\n:alice!a@host AWAY\r\n"})
+	c := make(chan config.Message, 10)
+	b := New(config.Protocol{Server: l.Addr().String(), Nick: "bot"}, "irc.test", c)
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Disconnect(context.Background())
+	for _, want := range []string{"alice is away: lunch", "alice is back"} {
+		select {
+		case msg := <-c:
+			if msg.Event != config.EVENT_AWAY || msg.Text != want {
+				t.Errorf("expected away event %q, got %#v", want, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("away event %q not received", want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package birc
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// joinPart is a join, part or quit waiting to be coalesced.
+type joinPart struct {
+	kind    string // JOIN, PART or QUIT
+	nick    string
+	channel string // empty for QUIT
+	reason  string // message of the QUIT
+}
+
+// netsplitRe matches the quit message of a netsplit: the names of the servers
+// that lost their link. Users can not choose such a message, the server
+// prefixes theirs with "Quit: ".
+var netsplitRe = regexp.MustCompile(`^[^\s.]+\.\S+ [^\s.]+\.\S+$`)
+
+// splitExpiry is how long a nick that quit in a netsplit is remembered to
+// recognize its rejoin.
+const splitExpiry = time.Hour
+
+// coalesceJoinParts returns the messages for events. Users joining and leaving
+// within the window are left out, netsplits and their rejoins are summarized
+// and the other events are grouped by channel.
+// netsplit holds the nicks that quit in a netsplit and is updated.
+func coalesceJoinParts(events []joinPart, netsplit map[string]time.Time, now time.Time) []config.Message {
+	for nick, t := range netsplit {
+		if now.Sub(t) > splitExpiry {
+			delete(netsplit, nick)
+		}
+	}
+	skip := make([]bool, len(events))
+	// a join followed by a part or quit of the same user is noise
+	for i, jp := range events {
+		if jp.kind != "JOIN" {
+			continue
+		}
+		for j := i + 1; j < len(events); j++ {
+			other := events[j]
+			if !skip[j] && other.nick == jp.nick && (other.kind == "QUIT" || other.kind == "PART" && other.channel == jp.channel) {
+				skip[i], skip[j] = true, true
+				break
+			}
+		}
+	}
+	type group struct {
+		kind, channel string
+		nicks         []string
+	}
+	var groups []*group
+	var splits []*group // nicks by servers of the netsplit
+	var rejoins []*group
+	find := func(groups []*group, kind, channel string) ([]*group, *group) {
+		for _, g := range groups {
+			if g.kind == kind && g.channel == channel {
+				return groups, g
+			}
+		}
+		g := &group{kind: kind, channel: channel}
+		return append(groups, g), g
+	}
+	var g *group
+	for i, jp := range events {
+		if skip[i] {
+			continue
+		}
+		switch {
+		case jp.kind == "QUIT" && netsplitRe.MatchString(jp.reason):
+			netsplit[jp.nick] = now
+			splits, g = find(splits, jp.kind, jp.reason)
+		case jp.kind == "JOIN" && !netsplit[jp.nick].IsZero():
+			rejoins, g = find(rejoins, jp.kind, jp.channel)
+		default:
+			if jp.kind != "JOIN" {
+				delete(netsplit, jp.nick)
+			}
+			groups, g = find(groups, jp.kind, jp.channel)
+		}
+		g.nicks = append(g.nicks, jp.nick)
+	}
+	var msgs []config.Message
+	add := func(channel string, text string, nicks []string) {
+		msgs = append(msgs, config.Message{Username: "system", Text: text, Channel: channel, Event: config.EVENT_JOIN_LEAVE, Nicks: nicks})
+	}
+	for _, g := range splits {
+		add("", fmt.Sprintf("netsplit: %s (%s)", users(len(g.nicks)), g.channel), g.nicks)
+	}
+	for _, g := range rejoins {
+		add(g.channel, fmt.Sprintf("netsplit over: %s rejoined", users(len(g.nicks))), g.nicks)
+	}
+	for _, g := range groups {
+		add(g.channel, helper.JoinPartText(g.nicks, strings.ToLower(g.kind)), g.nicks)
+	}
+	return msgs
+}
+
+func users(n int) string {
+	if n == 1 {
+		return "1 user"
+	}
+	return fmt.Sprintf("%d users", n)
+}
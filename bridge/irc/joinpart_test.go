@@ -0,0 +1,60 @@
+package birc
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func texts(events []joinPart, netsplit map[string]time.Time) []string {
+	var res []string
+	for _, msg := range coalesceJoinParts(events, netsplit, time.Now()) {
+		res = append(res, msg.Channel+": "+msg.Text)
+	}
+	return res
+}
+
+func TestCoalesceJoinParts(t *testing.T) {
+	events := []joinPart{
+		{kind: "JOIN", nick: "alice", channel: "#a"},
+		{kind: "JOIN", nick: "bob", channel: "#a"},
+		{kind: "PART", nick: "carol", channel: "#b"},
+		{kind: "JOIN", nick: "dave", channel: "#a"},
+		{kind: "QUIT", nick: "dave", reason: "Quit: bye"},
+		{kind: "QUIT", nick: "erin", reason: "Quit: bye"},
+	}
+	got := texts(events, make(map[string]time.Time))
+	want := []string{"#a: alice and bob join", "#b: carol parts", ": erin quits"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCoalesceNetsplit(t *testing.T) {
+	netsplit := make(map[string]time.Time)
+	var events []joinPart
+	for i := 0; i < 143; i++ {
+		events = append(events, joinPart{kind: "QUIT", nick: fmt.Sprintf("user%d", i), reason: "hub.example.net leaf.example.net"})
+	}
+	// a user can not fake a netsplit, the server prefixes the message
+	events = append(events, joinPart{kind: "QUIT", nick: "mallory", reason: "Quit: hub.example.net leaf.example.net"})
+	got := texts(events, netsplit)
+	want := []string{": netsplit: 143 users (hub.example.net leaf.example.net)", ": mallory quits"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	events = nil
+	for i := 0; i < 140; i++ {
+		events = append(events, joinPart{kind: "JOIN", nick: fmt.Sprintf("user%d", i), channel: "#a"})
+	}
+	for i := 0; i < 7; i++ {
+		events = append(events, joinPart{kind: "JOIN", nick: fmt.Sprintf("new%d", i), channel: "#a"})
+	}
+	got = texts(events, netsplit)
+	want = []string{"#a: netsplit over: 140 users rejoined", "#a: new0, new1, new2, new3, new4 and 2 others join"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
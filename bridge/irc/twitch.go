@@ -0,0 +1,316 @@
+package birc
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/thoj/go-ircevent"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// twitchServer is used when Server is not set.
+	twitchServer = "irc.chat.twitch.tv:6697"
+	// twitchMessageLength is the maximum amount of characters in a twitch chat message.
+	twitchMessageLength = 500
+	// twitchMessageDelay keeps us below 20 messages per 30 seconds.
+	twitchMessageDelay = 1500
+)
+
+// TwitchSettings are the settings of the twitch accounts that are not in config.Protocol.
+type TwitchSettings struct {
+	RelayFrom string // relay the messages of "all" users (default), "subscribers" or "moderators"
+}
+
+// checkTwitch checks the settings of a twitch account.
+func checkTwitch(cfg config.Protocol) []error {
+	var settings TwitchSettings
+	if err := cfg.Decode(&settings); err != nil {
+		return []error{err}
+	}
+	if r := settings.RelayFrom; r != "" && r != "all" && r != "subscribers" && r != "moderators" {
+		return []error{&config.SettingError{Setting: "RelayFrom", Err: fmt.Errorf("unknown value %q (supported: all, subscribers, moderators)", r)}}
+	}
+	return nil
+}
+
+// twitchRoom is the state of a twitch channel.
+type twitchRoom struct {
+	subsOnly  bool
+	emoteOnly bool
+	slow      time.Duration     // minimum time between our messages
+	badges    map[string]string // our badges in the channel
+	lastSent  time.Time
+}
+
+// privileged returns true if we are not subject to the restrictions of the room.
+func (r *twitchRoom) privileged() bool {
+	return r.badges["broadcaster"] != "" || r.badges["moderator"] != ""
+}
+
+// NewTwitch returns an irc bridge for twitch chat. It requests the twitch
+// capabilities (tags, commands, membership), relays display names and
+// emotes, and honors the restrictions of the rooms.
+func NewTwitch(cfg config.Protocol, account string, c chan config.Message) *Birc {
+	if cfg.Server == "" {
+		cfg.Server = twitchServer
+		cfg.UseTLS = true
+	}
+	// the password is an oauth token
+	if cfg.Password != "" && !strings.HasPrefix(cfg.Password, "oauth:") {
+		cfg.Password = "oauth:" + cfg.Password
+	}
+	if cfg.MessageDelay == 0 {
+		cfg.MessageDelay = twitchMessageDelay
+	}
+	cfg.Nick = strings.ToLower(cfg.Nick)
+	b := New(cfg, account, c)
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.twitch = true
+	b.rooms = make(map[string]*twitchRoom)
+	return b
+}
+
+// room returns the state of channel. b must be locked.
+func (b *Birc) room(channel string) *twitchRoom {
+	r, ok := b.rooms[channel]
+	if !ok {
+		r = &twitchRoom{badges: make(map[string]string)}
+		b.rooms[channel] = r
+	}
+	return r
+}
+
+// twitchCapabilities describes twitch chat: one line of plain text.
+func twitchCapabilities() helper.Capabilities {
+	return helper.Capabilities{Actions: true, Limit: helper.Limit{Max: twitchMessageLength}}
+}
+
+// canSend returns false when the restrictions of channel do not allow us to send.
+func (b *Birc) canSend(channel string) bool {
+	b.Lock()
+	defer b.Unlock()
+	r := b.room(channel)
+	switch {
+	case r.privileged():
+	case r.subsOnly && r.badges["subscriber"] == "" && r.badges["vip"] == "":
+		flog.Infof("%s is in subscribers-only mode, dropping message", channel)
+		return false
+	case r.emoteOnly:
+		flog.Infof("%s is in emote-only mode, dropping message", channel)
+		return false
+	}
+	return true
+}
+
+// slowModeWait waits until we can send to channel in slow mode.
+func (b *Birc) slowModeWait(channel string) {
+	b.Lock()
+	r := b.room(channel)
+	wait := time.Duration(0)
+	if !r.privileged() {
+		wait = time.Until(r.lastSent.Add(r.slow))
+	}
+	b.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	b.Lock()
+	r.lastSent = time.Now()
+	b.Unlock()
+}
+
+// handleTwitch handles the lines with IRCv3 tags.
+func (b *Birc) handleTwitch(raw string) {
+	tags, event := parseTagged(raw)
+	if event == nil || len(event.Arguments) == 0 {
+		flog.Debugf("invalid line %q", raw)
+		return
+	}
+	channel := event.Arguments[0]
+	switch event.Code {
+	case "PRIVMSG":
+		b.handleTwitchMessage(event, tags)
+	case "USERNOTICE":
+		// subscriptions, raids, ...
+		if text := tags["system-msg"]; text != "" {
+			if msg := event.Message(); len(event.Arguments) > 1 && msg != "" {
+				text += ": " + msg
+			}
+			b.Remote <- config.Message{Username: "system", Text: text, Channel: channel, Account: b.Account,
+				Event: config.EVENT_NOTICE, Timestamp: twitchTimestamp(tags)}
+		}
+	case "ROOMSTATE":
+		// the initial state has all the tags, updates only the changed ones
+		b.Lock()
+		r := b.room(channel)
+		if v, ok := tags["subs-only"]; ok {
+			r.subsOnly = v == "1"
+		}
+		if v, ok := tags["emote-only"]; ok {
+			r.emoteOnly = v == "1"
+		}
+		if v, ok := tags["slow"]; ok {
+			seconds, _ := strconv.Atoi(v)
+			r.slow = time.Duration(seconds) * time.Second
+		}
+		b.Unlock()
+	case "USERSTATE":
+		b.Lock()
+		b.room(channel).badges = parseBadges(tags["badges"])
+		b.Unlock()
+	case "NOTICE":
+		flog.Infof("%s: %s (%s)", channel, event.Message(), tags["msg-id"])
+	}
+}
+
+func (b *Birc) handleTwitchMessage(event *irc.Event, tags map[string]string) {
+	if event.Nick == b.Nick || len(event.Arguments) < 2 {
+		return
+	}
+	badges := parseBadges(tags["badges"])
+	if !relayFrom(b.settings.RelayFrom, badges) {
+		flog.Debugf("not relaying message from %s (RelayFrom=%s)", event.Nick, b.settings.RelayFrom)
+		return
+	}
+	text := event.Message()
+	msg := config.Message{Username: event.Nick, DisplayName: tags["display-name"], Channel: event.Arguments[0],
+		Account: b.Account, Color: tags["color"], Timestamp: twitchTimestamp(tags)}
+	if strings.HasPrefix(text, "\x01ACTION ") && strings.HasSuffix(text, "\x01") {
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+		msg.Event = config.EVENT_USER_ACTION
+	}
+	msg.Text = replaceEmotes(text, tags["emotes"])
+	flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+	b.Remote <- msg
+}
+
+// relayFrom returns true if the messages of a user with badges are relayed
+// with the RelayFrom setting relay.
+func relayFrom(relay string, badges map[string]string) bool {
+	mod := badges["broadcaster"] != "" || badges["moderator"] != ""
+	switch relay {
+	case "moderators":
+		return mod
+	case "subscribers":
+		return mod || badges["subscriber"] != "" || badges["vip"] != ""
+	}
+	return true
+}
+
+func twitchTimestamp(tags map[string]string) time.Time {
+	ms, err := strconv.ParseInt(tags["tmi-sent-ts"], 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// parseBadges parses the badges tag, eg "moderator/1,subscriber/12".
+func parseBadges(tag string) map[string]string {
+	badges := make(map[string]string)
+	for _, badge := range strings.Split(tag, ",") {
+		if badge == "" {
+			continue
+		}
+		parts := strings.SplitN(badge, "/", 2)
+		version := "1"
+		if len(parts) == 2 {
+			version = parts[1]
+		}
+		badges[parts[0]] = version
+	}
+	return badges
+}
+
+// replaceEmotes marks the emotes of text as :name:. tag lists the positions
+// of the emotes in characters, eg "25:0-4,12-16/1902:6-10".
+func replaceEmotes(text string, tag string) string {
+	type span struct{ start, end int }
+	var spans []span
+	for _, emote := range strings.Split(tag, "/") {
+		parts := strings.SplitN(emote, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, pos := range strings.Split(parts[1], ",") {
+			var s span
+			bounds := strings.SplitN(pos, "-", 2)
+			if len(bounds) != 2 {
+				continue
+			}
+			var err1, err2 error
+			s.start, err1 = strconv.Atoi(bounds[0])
+			s.end, err2 = strconv.Atoi(bounds[1])
+			if err1 == nil && err2 == nil && s.start <= s.end {
+				spans = append(spans, s)
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return text
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start > spans[j].start })
+	runes := []rune(text)
+	for _, s := range spans {
+		if s.end >= len(runes) {
+			continue
+		}
+		name := string(runes[s.start : s.end+1])
+		runes = append(runes[:s.start], append([]rune(":"+name+":"), runes[s.end+1:]...)...)
+	}
+	return string(runes)
+}
+
+// tagEscapes unescapes the values of IRCv3 tags.
+var tagEscapes = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+// parseTagged parses a line starting with IRCv3 tags (the irc library does not
+// support them).
+func parseTagged(raw string) (map[string]string, *irc.Event) {
+	raw = strings.TrimRight(raw, "\r\n")
+	i := strings.Index(raw, " ")
+	if !strings.HasPrefix(raw, "@") || i == -1 {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(raw[1:i], ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = tagEscapes.Replace(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	line := strings.TrimLeft(raw[i:], " ")
+	event := &irc.Event{Raw: line}
+	if strings.HasPrefix(line, ":") {
+		j := strings.Index(line, " ")
+		if j == -1 {
+			return nil, nil
+		}
+		event.Source = line[1:j]
+		line = line[j+1:]
+		if k, l := strings.Index(event.Source, "!"), strings.Index(event.Source, "@"); k > -1 && l > k {
+			event.Nick = event.Source[:k]
+			event.User = event.Source[k+1 : l]
+			event.Host = event.Source[l+1:]
+		}
+	}
+	split := strings.SplitN(line, " :", 2)
+	args := strings.Fields(split[0])
+	if len(args) == 0 {
+		return nil, nil
+	}
+	event.Code = strings.ToUpper(args[0])
+	event.Arguments = args[1:]
+	if len(split) > 1 {
+		event.Arguments = append(event.Arguments, split[1])
+	}
+	return tags, event
+}
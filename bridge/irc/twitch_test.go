@@ -0,0 +1,105 @@
+package birc
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"reflect"
+	"testing"
+)
+
+func TestParseTagged(t *testing.T) {
+	tags, event := parseTagged(`@badges=moderator/1,subscriber/12;display-name=Alice\sB;emotes=;tmi-sent-ts=1500000000000 :alice!alice@alice.tmi.twitch.tv PRIVMSG #stream :hello there`)
+	if event == nil {
+		t.Fatal("no event")
+	}
+	if event.Code != "PRIVMSG" || event.Nick != "alice" || !reflect.DeepEqual(event.Arguments, []string{"#stream", "hello there"}) {
+		t.Errorf("unexpected event %#v", event)
+	}
+	if tags["display-name"] != "Alice B" || tags["emotes"] != "" {
+		t.Errorf("unexpected tags %#v", tags)
+	}
+	if badges := parseBadges(tags["badges"]); !reflect.DeepEqual(badges, map[string]string{"moderator": "1", "subscriber": "12"}) {
+		t.Errorf("unexpected badges %#v", badges)
+	}
+	if _, event := parseTagged(":tmi.twitch.tv PING"); event != nil {
+		t.Errorf("expected no event for a line without tags, got %#v", event)
+	}
+}
+
+func TestReplaceEmotes(t *testing.T) {
+	for _, test := range []struct {
+		text, emotes, want string
+	}{
+		{"Kappa hi Kappa", "25:0-4,9-13", ":Kappa: hi :Kappa:"},
+		{"é Kappa PogChamp", "25:2-6/88:8-15", "é :Kappa: :PogChamp:"},
+		{"no emotes", "", "no emotes"},
+		{"short", "25:3-10", "short"},
+	} {
+		if got := replaceEmotes(test.text, test.emotes); got != test.want {
+			t.Errorf("%q with %q: expected %q, got %q", test.text, test.emotes, test.want, got)
+		}
+	}
+}
+
+func TestTwitchMessages(t *testing.T) {
+	c := make(chan config.Message, 10)
+	b := NewTwitch(config.Protocol{Nick: "Bot", Password: "token", Settings: &TwitchSettings{RelayFrom: "subscribers"}}, "twitch.test", c)
+	if b.Config.Server != twitchServer || !b.Config.UseTLS || b.Config.Password != "oauth:token" || b.Nick != "bot" {
+		t.Errorf("unexpected config %#v", b.Config)
+	}
+	b.handleTwitch("@badges=subscriber/3;color=#1E90FF;display-name=Alice;emotes=25:0-4;tmi-sent-ts=1500000000000 :alice!alice@alice.tmi.twitch.tv PRIVMSG #stream :\x01ACTION Kappa waves\x01")
+	b.handleTwitch("@badges=;display-name=Spammer :spammer!spammer@spammer.tmi.twitch.tv PRIVMSG #stream :buy followers")
+	b.handleTwitch("@msg-id=sub;system-msg=Bob\\ssubscribed! :tmi.twitch.tv USERNOTICE #stream :great stream")
+	if len(c) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(c))
+	}
+	msg := <-c
+	if msg.Username != "alice" || msg.DisplayName != "Alice" || msg.Text != ":Kappa: waves" || msg.Event != config.EVENT_USER_ACTION ||
+		msg.Color != "#1E90FF" || msg.Channel != "#stream" || msg.Timestamp.Unix() != 1500000000 {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if msg = <-c; msg.Text != "Bob subscribed!: great stream" || msg.Event != config.EVENT_NOTICE {
+		t.Errorf("unexpected notice %#v", msg)
+	}
+}
+
+func TestTwitchRestrictions(t *testing.T) {
+	b := NewTwitch(config.Protocol{Nick: "bot", Password: "oauth:token"}, "twitch.test", nil)
+	b.handleTwitch("@emote-only=0;followers-only=-1;r9k=0;slow=0;subs-only=1 :tmi.twitch.tv ROOMSTATE #stream")
+	b.handleTwitch("@badges=;mod=0 :tmi.twitch.tv USERSTATE #stream")
+	b.Send(config.Message{Channel: "#stream", Text: "hello"})
+	if len(b.Local) != 0 {
+		t.Error("message sent to a subscribers-only channel")
+	}
+	// we are made moderator
+	b.handleTwitch("@badges=moderator/1;mod=1 :tmi.twitch.tv USERSTATE #stream")
+	b.Send(config.Message{Channel: "#stream", Text: "hello"})
+	b.handleTwitch("@subs-only=0 :tmi.twitch.tv ROOMSTATE #other")
+	b.handleTwitch("@emote-only=1 :tmi.twitch.tv ROOMSTATE #other")
+	b.Send(config.Message{Channel: "#other", Text: "hello"})
+	if len(b.Local) != 1 {
+		t.Errorf("expected 1 queued message, got %d", len(b.Local))
+	}
+}
+
+func TestRelayFrom(t *testing.T) {
+	mod := map[string]string{"moderator": "1"}
+	sub := map[string]string{"subscriber": "6"}
+	none := map[string]string{}
+	for _, test := range []struct {
+		relay  string
+		badges map[string]string
+		want   bool
+	}{
+		{"", none, true},
+		{"all", none, true},
+		{"subscribers", sub, true},
+		{"subscribers", mod, true},
+		{"subscribers", none, false},
+		{"moderators", sub, false},
+		{"moderators", mod, true},
+	} {
+		if got := relayFrom(test.relay, test.badges); got != test.want {
+			t.Errorf("%s %v: expected %v", test.relay, test.badges, test.want)
+		}
+	}
+}
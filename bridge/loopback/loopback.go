@@ -0,0 +1,142 @@
+// Package bloopback is an in-memory bridge. It records the messages sent to it
+// and lets messages be injected as if they were received, which makes it
+// useful for testing gateways without a network.
+package bloopback
+
+import (
+	"context"
+	"github.com/42wim/matterbridge/bridge/config"
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+type Bloopback struct {
+	Config    *config.Protocol
+	Remote    chan config.Message
+	Account   string
+	sent      []config.Message
+	channels  []string
+	available []string
+	notify    chan struct{}
+	sync.Mutex
+}
+
+var flog *log.Entry
+var protocol = "loopback"
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bloopback {
+	b := &Bloopback{}
+	b.Config = &cfg
+	b.Remote = c
+	b.Account = account
+	b.notify = make(chan struct{}, 1)
+	return b
+}
+
+func (b *Bloopback) Connect() error {
+	flog.Infof("Connecting %s", b.Account)
+	return nil
+}
+
+func (b *Bloopback) Disconnect(ctx context.Context) error {
+	return nil
+}
+
+func (b *Bloopback) JoinChannel(channel string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.channels = append(b.channels, channel)
+	return nil
+}
+
+// Send records msg.
+func (b *Bloopback) Send(msg config.Message) error {
+	flog.Debugf("Receiving %#v", msg)
+	b.Lock()
+	b.sent = append(b.sent, msg)
+	b.Unlock()
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Inject sends msg to the gateway as if it was received on this bridge.
+func (b *Bloopback) Inject(msg config.Message) {
+	if msg.Account == "" {
+		msg.Account = b.Account
+	}
+	flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+	b.Remote <- msg
+}
+
+// ListChannels returns the channels set with SetAvailableChannels.
+func (b *Bloopback) ListChannels() ([]string, error) {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string(nil), b.available...), nil
+}
+
+// CreateChannel adds channel to the channels returned by ListChannels.
+func (b *Bloopback) CreateChannel(channel string) error {
+	b.Lock()
+	defer b.Unlock()
+	for _, c := range b.available {
+		if c == channel {
+			return nil
+		}
+	}
+	b.available = append(b.available, channel)
+	return nil
+}
+
+// SetAvailableChannels sets the channels returned by ListChannels.
+func (b *Bloopback) SetAvailableChannels(channels ...string) {
+	b.Lock()
+	defer b.Unlock()
+	b.available = channels
+}
+
+// Sent returns the messages sent to this bridge.
+func (b *Bloopback) Sent() []config.Message {
+	b.Lock()
+	defer b.Unlock()
+	return append([]config.Message(nil), b.sent...)
+}
+
+// Channels returns the channels joined.
+func (b *Bloopback) Channels() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string(nil), b.channels...)
+}
+
+// Reset forgets the messages sent to this bridge.
+func (b *Bloopback) Reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.sent = nil
+}
+
+// WaitSent waits until at least n messages are sent to this bridge or timeout
+// passes and returns the messages sent.
+func (b *Bloopback) WaitSent(n int, timeout time.Duration) []config.Message {
+	deadline := time.After(timeout)
+	for {
+		sent := b.Sent()
+		if len(sent) >= n {
+			return sent
+		}
+		select {
+		case <-b.notify:
+		case <-deadline:
+			return sent
+		}
+	}
+}
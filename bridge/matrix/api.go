@@ -0,0 +1,174 @@
+package bmatrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the prefix of the client-server API endpoints.
+const apiPrefix = "/_matrix/client/r0"
+
+// apiError is an error returned by the homeserver.
+type apiError struct {
+	Status     int
+	Code       string `json:"errcode"`
+	Message    string `json:"error"`
+	RetryAfter int    `json:"retry_after_ms"` // M_LIMIT_EXCEEDED
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.Code, e.Message, e.Status)
+}
+
+type loginRequest struct {
+	Type     string `json:"type"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	AccessToken string `json:"access_token"`
+	UserID      string `json:"user_id"`
+}
+
+type whoamiResponse struct {
+	UserID string `json:"user_id"`
+}
+
+type joinResponse struct {
+	RoomID string `json:"room_id"`
+}
+
+type profile struct {
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+type event struct {
+	Type      string          `json:"type"`
+	Sender    string          `json:"sender"`
+	StateKey  *string         `json:"state_key"`
+	Timestamp int64           `json:"origin_server_ts"`
+	Content   json.RawMessage `json:"content"`
+}
+
+// messageContent is the content of m.room.message events.
+type messageContent struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+	URL           string `json:"url,omitempty"` // m.image, m.file, ...
+}
+
+// memberContent is the content of m.room.member events.
+type memberContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+type typingRequest struct {
+	Typing  bool `json:"typing"`
+	Timeout int  `json:"timeout,omitempty"`
+}
+
+// do sends a request to the client-server API endpoint path. in is sent as
+// JSON, the answer is decoded in out.
+func (b *Bmatrix) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	u := b.server() + apiPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	b.Lock()
+	token := b.token
+	b.Unlock()
+	if token != "" {
+		// not in the URL, so it never shows up in the logs
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &apiError{Status: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Code, apiErr.Message = "M_UNKNOWN", resp.Status
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// retry calls f again while the homeserver rate limits it, up to 3 times.
+func retry(ctx context.Context, f func() error) error {
+	for i := 0; ; i++ {
+		err := f()
+		apiErr, ok := err.(*apiError)
+		if !ok || apiErr.Code != "M_LIMIT_EXCEEDED" || i == 2 {
+			return err
+		}
+		delay := time.Duration(apiErr.RetryAfter) * time.Millisecond
+		if delay <= 0 {
+			delay = time.Second
+		}
+		flog.Debugf("rate limited, retrying in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (b *Bmatrix) server() string {
+	return strings.TrimRight(b.Config.Server, "/")
+}
+
+// mediaURL returns the http URL of an mxc:// URL.
+func (b *Bmatrix) mediaURL(mxc string) string {
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return mxc
+	}
+	return b.server() + "/_matrix/media/r0/download/" + strings.TrimPrefix(mxc, "mxc://")
+}
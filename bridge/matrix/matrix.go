@@ -0,0 +1,456 @@
+// Package bmatrix bridges matrix rooms using the client-server API.
+//
+// The bridge logs in with Login and Password or uses the access token Token,
+// joins the rooms by alias (#room:server) or ID (!id:server) and receives the
+// messages with a sync loop. The position of the sync is kept in StateFile so
+// the messages sent while matterbridge was not running are relayed on restart.
+package bmatrix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	log "github.com/Sirupsen/logrus"
+	"github.com/russross/blackfriday"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings are the settings of the matrix accounts that are not in config.Protocol.
+type Settings struct {
+	StateFile string // file keeping the position of the sync
+}
+
+type Bmatrix struct {
+	Config     *config.Protocol
+	settings   Settings
+	Remote     chan config.Message
+	Account    string
+	client     *http.Client
+	token      string            // access token
+	userID     string            // our user
+	rooms      map[string]string // channel by room ID
+	roomIDs    map[string]string // room ID by channel
+	profiles   map[string]profile
+	timelines  []timeline         // timelines to handle, in sync order
+	pending    map[string][]event // timeline events of the rooms not joined yet, by room ID
+	queued     chan struct{}      // signals new timelines to the handler
+	txn        int64              // last transaction ID
+	cancel     context.CancelFunc
+	done       chan struct{} // closed when the sync loop ended
+	retryDelay time.Duration // delay before syncing again after an error
+	sync.Mutex
+}
+
+var flog *log.Entry
+var protocol = "matrix"
+
+const (
+	// syncTimeout is how long the homeserver holds a sync request when
+	// there are no new events.
+	syncTimeout = 30 * time.Second
+	// typingTimeout is how long we are shown as typing.
+	typingTimeout = 5 * time.Second
+	// maxPending is the number of events kept for a room that is not joined yet.
+	maxPending = 100
+)
+
+// timeline is the new events of a room.
+type timeline struct {
+	roomID string
+	events []event
+}
+
+// markdownExtensions are the markdown extensions used for the formatted bodies.
+const markdownExtensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+	blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_AUTOLINK |
+	blackfriday.EXTENSION_STRIKETHROUGH |
+	blackfriday.EXTENSION_HARD_LINE_BREAK
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: required, Settings: func() interface{} { return &Settings{} }})
+}
+
+// required returns the settings required by an account with the settings cfg.
+func required(cfg config.Protocol) []string {
+	if cfg.Token != "" {
+		return []string{"Server"}
+	}
+	return []string{"Server", "Login", "Password"}
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bmatrix {
+	b := &Bmatrix{}
+	b.Config = &cfg
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.Remote = c
+	b.Account = account
+	b.client = &http.Client{Timeout: syncTimeout + 30*time.Second}
+	b.rooms = make(map[string]string)
+	b.roomIDs = make(map[string]string)
+	b.profiles = make(map[string]profile)
+	b.pending = make(map[string][]event)
+	b.queued = make(chan struct{}, 1)
+	b.txn = time.Now().UnixNano()
+	b.done = make(chan struct{})
+	b.retryDelay = 10 * time.Second
+	return b
+}
+
+// Connect logs in and starts the sync loop. The timelines of the rooms that
+// are not joined yet are kept until JoinChannel, so the messages sent while
+// matterbridge was not running are not lost when the first sync is faster.
+func (b *Bmatrix) Connect() error {
+	flog.Infof("Connecting %s", b.Config.Server)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.login(ctx); err != nil {
+		cancel()
+		return err
+	}
+	since := b.loadNextBatch()
+	if since == "" {
+		// only get the position, the history is not relayed
+		var resp syncResponse
+		query := url.Values{"filter": {`{"room":{"timeline":{"limit":1}}}`}}
+		if err := b.do(ctx, "GET", "/sync", query, nil, &resp); err != nil {
+			cancel()
+			return err
+		}
+		since = resp.NextBatch
+		b.saveNextBatch(since)
+	}
+	flog.Info("Connection succeeded")
+	b.cancel = cancel
+	go b.syncLoop(ctx, since)
+	go b.handleLoop(ctx)
+	return nil
+}
+
+// login logs in with Login and Password or checks the access token Token.
+func (b *Bmatrix) login(ctx context.Context) error {
+	if b.Config.Token != "" {
+		b.Lock()
+		b.token = b.Config.Token
+		b.Unlock()
+		var resp whoamiResponse
+		if err := b.do(ctx, "GET", "/account/whoami", nil, nil, &resp); err != nil {
+			return err
+		}
+		b.Lock()
+		b.userID = resp.UserID
+		b.Unlock()
+		return nil
+	}
+	var resp loginResponse
+	err := b.do(ctx, "POST", "/login", nil, loginRequest{Type: "m.login.password", User: b.Config.Login, Password: b.Config.Password}, &resp)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.token = resp.AccessToken
+	b.userID = resp.UserID
+	b.Unlock()
+	return nil
+}
+
+func (b *Bmatrix) Disconnect(ctx context.Context) error {
+	if b.cancel == nil {
+		return nil
+	}
+	b.cancel()
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// JoinChannel joins the room channel, an alias (#room:server) or a room ID (!id:server).
+func (b *Bmatrix) JoinChannel(channel string) error {
+	var resp joinResponse
+	err := retry(context.Background(), func() error {
+		return b.do(context.Background(), "POST", "/join/"+url.PathEscape(channel), nil, struct{}{}, &resp)
+	})
+	if err != nil {
+		return fmt.Errorf("joining %s failed: %s", channel, err)
+	}
+	b.Lock()
+	b.rooms[resp.RoomID] = channel
+	b.roomIDs[channel] = resp.RoomID
+	b.Unlock()
+	// handle the events received before
+	b.queue(timeline{roomID: resp.RoomID})
+	return nil
+}
+
+func (b *Bmatrix) Send(msg config.Message) error {
+	flog.Debugf("Receiving %#v", msg)
+	b.Lock()
+	roomID, ok := b.roomIDs[msg.Channel]
+	userID := b.userID
+	b.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: room %s is not joined", b.Account, msg.Channel)
+	}
+	ctx := context.Background()
+	if msg.Event == config.EVENT_USER_TYPING {
+		return b.do(ctx, "PUT", "/rooms/"+url.PathEscape(roomID)+"/typing/"+url.PathEscape(userID), nil,
+			typingRequest{Typing: true, Timeout: int(typingTimeout / time.Millisecond)}, nil)
+	}
+	content := formatContent(msg.Text)
+	content.MsgType = "m.text"
+	switch msg.Event {
+	case config.EVENT_USER_ACTION:
+		content.MsgType = "m.emote"
+	case config.EVENT_NOTICE:
+		content.MsgType = "m.notice"
+	}
+	path := "/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + b.nextTxn()
+	return retry(ctx, func() error {
+		// the transaction ID makes the retries idempotent
+		return b.do(ctx, "PUT", path, nil, content, nil)
+	})
+}
+
+// Capabilities implements bridge.Capable, actions are sent as m.emote.
+func (b *Bmatrix) Capabilities() helper.Capabilities {
+	return helper.Capabilities{Actions: true, Multiline: true, Markup: helper.MarkupMarkdown}
+}
+
+func (b *Bmatrix) nextTxn() string {
+	b.Lock()
+	defer b.Unlock()
+	b.txn++
+	return "mb" + strconv.FormatInt(b.txn, 10)
+}
+
+// formatContent returns the content of a message with text, with a formatted
+// body when the markdown of text renders to more than a paragraph.
+func formatContent(text string) messageContent {
+	content := messageContent{Body: text}
+	// escape <, the nick prefix (eg "<nick> ") is no html tag
+	escaped := strings.Replace(text, "<", "&lt;", -1)
+	renderer := blackfriday.HtmlRenderer(blackfriday.HTML_USE_XHTML|blackfriday.HTML_SKIP_IMAGES, "", "")
+	html := string(bytes.TrimSpace(blackfriday.Markdown([]byte(escaped), renderer, markdownExtensions)))
+	if strings.HasPrefix(html, "<p>") && strings.HasSuffix(html, "</p>") {
+		inner := strings.TrimSuffix(strings.TrimPrefix(html, "<p>"), "</p>")
+		if !strings.Contains(inner, "<") {
+			return content
+		}
+		if !strings.Contains(inner, "<p>") {
+			html = inner
+		}
+	}
+	content.Format = "org.matrix.custom.html"
+	content.FormattedBody = html
+	return content
+}
+
+// syncLoop receives the new events until ctx is done.
+func (b *Bmatrix) syncLoop(ctx context.Context, since string) {
+	defer close(b.done)
+	query := url.Values{"timeout": {strconv.Itoa(int(syncTimeout / time.Millisecond))}}
+	for {
+		query.Set("since", since)
+		var resp syncResponse
+		err := b.do(ctx, "GET", "/sync", query, nil, &resp)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			flog.Errorf("sync failed: %s, retrying in %s", err, b.retryDelay)
+			if apiErr, ok := err.(*apiError); ok && apiErr.Code == "M_UNKNOWN_TOKEN" && b.Config.Token == "" {
+				// the access token expired, log in again
+				if err := b.login(ctx); err != nil {
+					flog.Errorf("login failed: %s", err)
+				}
+			}
+			select {
+			case <-time.After(b.retryDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		for roomID, room := range resp.Rooms.Join {
+			b.queue(timeline{roomID: roomID, events: room.Timeline.Events})
+		}
+		since = resp.NextBatch
+		b.saveNextBatch(since)
+	}
+}
+
+// queue queues t for the handler, it does not block.
+func (b *Bmatrix) queue(t timeline) {
+	b.Lock()
+	b.timelines = append(b.timelines, t)
+	b.Unlock()
+	select {
+	case b.queued <- struct{}{}:
+	default:
+	}
+}
+
+// handleLoop handles the queued timelines in order until ctx is done. The
+// events of the rooms not joined yet are kept in pending.
+func (b *Bmatrix) handleLoop(ctx context.Context) {
+	for {
+		select {
+		case <-b.queued:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			b.Lock()
+			if len(b.timelines) == 0 {
+				b.Unlock()
+				break
+			}
+			t := b.timelines[0]
+			b.timelines = b.timelines[1:]
+			events := append(b.pending[t.roomID], t.events...)
+			channel, ok := b.rooms[t.roomID]
+			if !ok {
+				if len(events) > maxPending {
+					events = events[len(events)-maxPending:]
+				}
+				b.pending[t.roomID] = events
+				b.Unlock()
+				continue
+			}
+			delete(b.pending, t.roomID)
+			b.Unlock()
+			b.handleEvents(channel, events)
+		}
+	}
+}
+
+// handleEvents sends the messages of the timeline of channel to the gateway.
+// The events before we joined (the history sent for new rooms) are skipped.
+func (b *Bmatrix) handleEvents(channel string, events []event) {
+	b.Lock()
+	userID := b.userID
+	b.Unlock()
+	start := 0
+	for i, ev := range events {
+		if ev.Type == "m.room.member" && ev.StateKey != nil && *ev.StateKey == userID && ev.Sender == userID {
+			var member memberContent
+			if json.Unmarshal(ev.Content, &member) == nil && member.Membership == "join" {
+				start = i + 1
+			}
+		}
+	}
+	for _, ev := range events[start:] {
+		switch ev.Type {
+		case "m.room.member":
+			var member memberContent
+			if ev.StateKey != nil && json.Unmarshal(ev.Content, &member) == nil && member.Membership == "join" {
+				b.Lock()
+				b.profiles[*ev.StateKey] = profile{DisplayName: member.DisplayName, AvatarURL: member.AvatarURL}
+				b.Unlock()
+			}
+		case "m.room.message":
+			if ev.Sender == userID {
+				continue
+			}
+			var content messageContent
+			if err := json.Unmarshal(ev.Content, &content); err != nil {
+				flog.Debugf("invalid message %s: %s", ev.Content, err)
+				continue
+			}
+			b.handleMessage(channel, ev, content)
+		}
+	}
+}
+
+func (b *Bmatrix) handleMessage(channel string, ev event, content messageContent) {
+	p := b.getProfile(ev.Sender)
+	msg := config.Message{Username: localpart(ev.Sender), DisplayName: p.DisplayName, Channel: channel,
+		Account: b.Account, Text: content.Body, Timestamp: time.Unix(0, ev.Timestamp*int64(time.Millisecond))}
+	if p.AvatarURL != "" {
+		msg.Avatar = b.mediaURL(p.AvatarURL)
+	}
+	switch content.MsgType {
+	case "m.emote":
+		msg.Event = config.EVENT_USER_ACTION
+	case "m.notice":
+		msg.Event = config.EVENT_NOTICE
+	case "m.image", "m.file", "m.video", "m.audio":
+		msg.Text = content.Body + " " + b.mediaURL(content.URL)
+	}
+	flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+	b.Remote <- msg
+}
+
+// getProfile returns the display name and avatar of userID, they are looked
+// up once and updated by the member events.
+func (b *Bmatrix) getProfile(userID string) profile {
+	b.Lock()
+	p, ok := b.profiles[userID]
+	b.Unlock()
+	if ok {
+		return p
+	}
+	if err := b.do(context.Background(), "GET", "/profile/"+url.PathEscape(userID), nil, nil, &p); err != nil {
+		flog.Debugf("looking up the profile of %s failed: %s", userID, err)
+	}
+	b.Lock()
+	b.profiles[userID] = p
+	b.Unlock()
+	return p
+}
+
+// localpart returns the user part of a user ID (alice for @alice:example.org).
+func localpart(userID string) string {
+	userID = strings.TrimPrefix(userID, "@")
+	if i := strings.Index(userID, ":"); i != -1 {
+		return userID[:i]
+	}
+	return userID
+}
+
+func (b *Bmatrix) loadNextBatch() string {
+	if b.settings.StateFile == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(b.settings.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			flog.Errorf("reading %s failed: %s", b.settings.StateFile, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// saveNextBatch writes the sync position to StateFile.
+func (b *Bmatrix) saveNextBatch(since string) {
+	if b.settings.StateFile == "" {
+		return
+	}
+	tmp := b.settings.StateFile + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(since+"\n"), 0600)
+	if err == nil {
+		err = os.Rename(tmp, b.settings.StateFile)
+	}
+	if err != nil {
+		flog.Errorf("writing %s failed: %s", b.settings.StateFile, err)
+	}
+}
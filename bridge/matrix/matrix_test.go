@@ -0,0 +1,227 @@
+package bmatrix
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper/bridgetest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// homeserver is a stub of the client-server API with one room.
+type homeserver struct {
+	*httptest.Server
+	batches   chan string // timelines (JSON arrays of events) returned by /sync
+	sent      chan messageContent
+	limited   bool // the next send is rate limited
+	mu        sync.Mutex
+	since     []string // since parameter of the syncs
+	syncing   int      // syncs in progress
+	nextBatch int
+}
+
+func newHomeserver(t *testing.T) *homeserver {
+	hs := &homeserver{batches: make(chan string, 10), sent: make(chan messageContent, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"/login", func(w http.ResponseWriter, r *http.Request) {
+		var req loginRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.User != "bot" || req.Password != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Invalid password"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"tok","user_id":"@bot:test"}`))
+	})
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown token"}`))
+			return
+		}
+		path := strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix)
+		switch {
+		case path == "/account/whoami":
+			w.Write([]byte(`{"user_id":"@bot:test"}`))
+		case path == "/join/%23room:test":
+			// join after the queued timelines are synced
+			for i := 0; i < 100 && len(hs.batches) > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			w.Write([]byte(`{"room_id":"!room:test"}`))
+		case path == "/profile/@alice:test":
+			w.Write([]byte(`{"displayname":"Alice","avatar_url":"mxc://test/alice"}`))
+		case strings.HasPrefix(path, "/rooms/%21room:test/send/m.room.message/"):
+			hs.mu.Lock()
+			limited := hs.limited
+			hs.limited = false
+			hs.mu.Unlock()
+			if limited {
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":10}`))
+				return
+			}
+			var content messageContent
+			json.NewDecoder(r.Body).Decode(&content)
+			hs.sent <- content
+			w.Write([]byte(`{"event_id":"$1"}`))
+		case path == "/sync":
+			hs.sync(w, r)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	hs.Server = httptest.NewServer(mux)
+	return hs
+}
+
+func (hs *homeserver) sync(w http.ResponseWriter, r *http.Request) {
+	hs.mu.Lock()
+	hs.since = append(hs.since, r.URL.Query().Get("since"))
+	hs.syncing++
+	hs.mu.Unlock()
+	defer func() {
+		hs.mu.Lock()
+		hs.syncing--
+		hs.mu.Unlock()
+	}()
+	events := "[]"
+	if r.URL.Query().Get("since") != "" {
+		select {
+		case events = <-hs.batches:
+		case <-time.After(50 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	hs.mu.Lock()
+	hs.nextBatch++
+	next := hs.nextBatch
+	hs.mu.Unlock()
+	w.Write([]byte(`{"next_batch":"s` + strconv.Itoa(next) + `","rooms":{"join":{"!room:test":{"timeline":{"events":` + events + `}}}}}`))
+}
+
+// waitIdle waits until the syncs of the disconnected bridges ended, so they
+// do not take the queued batches.
+func (hs *homeserver) waitIdle() {
+	for i := 0; i < 100; i++ {
+		hs.mu.Lock()
+		syncing := hs.syncing
+		hs.mu.Unlock()
+		if syncing == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (hs *homeserver) syncs() []string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return append([]string{}, hs.since...)
+}
+
+func newBridge(t *testing.T, cfg config.Protocol) (*Bmatrix, chan config.Message) {
+	c := make(chan config.Message, 10)
+	b := New(cfg, "matrix.test", c)
+	bridgetest.Start(t, b, "#room:test")
+	return b, c
+}
+
+func TestMatrix(t *testing.T) {
+	hs := newHomeserver(t)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "matrix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "state")
+
+	b, c := newBridge(t, config.Protocol{Server: hs.URL + "/", Login: "bot", Password: "secret", Settings: &Settings{StateFile: state}})
+	hs.batches <- `[
+		{"type":"m.room.message","sender":"@old:test","origin_server_ts":1000,"content":{"msgtype":"m.text","body":"history"}},
+		{"type":"m.room.member","sender":"@bot:test","state_key":"@bot:test","content":{"membership":"join"}},
+		{"type":"m.room.message","sender":"@alice:test","origin_server_ts":1500000000000,"content":{"msgtype":"m.text","body":"hello"}},
+		{"type":"m.room.message","sender":"@bot:test","content":{"msgtype":"m.text","body":"echo"}},
+		{"type":"m.room.message","sender":"@alice:test","content":{"msgtype":"m.emote","body":"waves"}}
+	]`
+	msg := bridgetest.Receive(t, c)
+	if msg.Text != "hello" || msg.Username != "alice" || msg.DisplayName != "Alice" || msg.Channel != "#room:test" ||
+		msg.Avatar != hs.URL+"/_matrix/media/r0/download/test/alice" || msg.Timestamp.Unix() != 1500000000 || msg.Event != "" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if msg = bridgetest.Receive(t, c); msg.Text != "waves" || msg.Event != config.EVENT_USER_ACTION {
+		t.Errorf("unexpected action %#v", msg)
+	}
+
+	hs.mu.Lock()
+	hs.limited = true
+	hs.mu.Unlock()
+	if err := b.Send(config.Message{Channel: "#room:test", Text: "<irc> **hi**"}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := <-hs.sent; sent.MsgType != "m.text" || sent.Body != "<irc> **hi**" || sent.FormattedBody != "&lt;irc&gt; <strong>hi</strong>" {
+		t.Errorf("unexpected content %#v", sent)
+	}
+	b.Send(config.Message{Channel: "#room:test", Text: "waves", Event: config.EVENT_USER_ACTION})
+	if sent := <-hs.sent; sent.MsgType != "m.emote" || sent.Body != "waves" || sent.Format != "" {
+		t.Errorf("unexpected content %#v", sent)
+	}
+	if err := b.Send(config.Message{Channel: "#other:test", Text: "hi"}); err == nil {
+		t.Error("sending to a room that is not joined should fail")
+	}
+	if err := b.Disconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sync continues from the saved position
+	data, _ := ioutil.ReadFile(state)
+	saved := strings.TrimSpace(string(data))
+	n := len(hs.syncs())
+	// the first sync is done before the room is joined again
+	hs.waitIdle()
+	hs.batches <- `[{"type":"m.room.message","sender":"@alice:test","content":{"msgtype":"m.text","body":"missed"}}]`
+	b, c = newBridge(t, config.Protocol{Server: hs.URL, Token: "tok", Settings: &Settings{StateFile: state}})
+	defer b.Disconnect(context.Background())
+	if msg := bridgetest.Receive(t, c); msg.Text != "missed" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if syncs := hs.syncs(); syncs[n] != saved || saved == "" {
+		t.Errorf("expected a sync since %q, got %q", saved, syncs[n:])
+	}
+}
+
+func TestMatrixLoginFailed(t *testing.T) {
+	hs := newHomeserver(t)
+	defer hs.Close()
+	b := New(config.Protocol{Server: hs.URL, Login: "bot", Password: "wrong"}, "matrix.test", nil)
+	if err := b.Connect(); err == nil || !strings.Contains(err.Error(), "M_FORBIDDEN") {
+		t.Errorf("expected M_FORBIDDEN, got %v", err)
+	}
+}
+
+func TestFormatContent(t *testing.T) {
+	for _, test := range []struct {
+		text, html string
+	}{
+		{"plain text", ""},
+		{"[irc] <nick> hi", ""},
+		{"a _b_", "a <em>b</em>"},
+		{"one\ntwo", "one<br />\ntwo"},
+	} {
+		if content := formatContent(test.text); content.FormattedBody != test.html || content.Body != test.text {
+			t.Errorf("%q: expected %q, got %#v", test.text, test.html, content)
+		}
+	}
+}
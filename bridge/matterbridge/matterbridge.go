@@ -0,0 +1,465 @@
+// Package bmatterbridge links matterbridge instances. One instance listens on
+// BindAddress, the other connects to it on Server. They exchange the messages
+// of their gateways with their origin, so the receiving instance can format
+// them as if they were received locally.
+package bmatterbridge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Settings are the settings of the matterbridge accounts that are not in config.Protocol.
+type Settings struct {
+	TLSCertificate string // certificate file of the server
+	TLSKey         string // key file of the server
+	Transport      string // "tcp" (default) or "websocket"
+}
+
+type Bmatterbridge struct {
+	Config   *config.Protocol
+	settings Settings
+	Remote   chan config.Message
+	Account  string
+	id       string // instanceID
+	listener net.Listener
+	peers    map[*peer]bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	sync.Mutex
+}
+
+// frame is what the instances exchange, one JSON object per line (tcp) or per
+// websocket message.
+type frame struct {
+	Type    string          `json:"type"` // "auth", "error" or "message"
+	Token   string          `json:"token,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Message *config.Message `json:"message,omitempty"`
+}
+
+// conn is a tcp or websocket connection to another instance.
+type conn interface {
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+type streamConn struct {
+	net.Conn
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+func newStreamConn(c net.Conn) *streamConn {
+	return &streamConn{Conn: c, enc: json.NewEncoder(c), dec: json.NewDecoder(c)}
+}
+
+func (c *streamConn) ReadJSON(v interface{}) error {
+	return c.dec.Decode(v)
+}
+
+func (c *streamConn) WriteJSON(v interface{}) error {
+	return c.enc.Encode(v)
+}
+
+type peer struct {
+	conn
+	sync.Mutex // serializes the writes
+}
+
+// write sends f, giving up after writeTimeout so a stalled instance does not
+// block the others.
+func (p *peer) write(f frame) error {
+	p.Lock()
+	defer p.Unlock()
+	p.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return p.WriteJSON(f)
+}
+
+var flog *log.Entry
+var protocol = "matterbridge"
+
+// instanceID identifies this instance in the path of the relayed messages.
+var instanceID = newID()
+
+// authTimeout is the time a new connection has to authenticate.
+const authTimeout = 10 * time.Second
+
+// writeTimeout is the time a message has to be sent to another instance.
+const writeTimeout = 10 * time.Second
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: required, Settings: func() interface{} { return &Settings{} }, Check: check})
+}
+
+// check checks the settings of an account.
+func check(cfg config.Protocol) []error {
+	var settings Settings
+	if err := cfg.Decode(&settings); err != nil {
+		return []error{err}
+	}
+	if t := settings.Transport; t != "" && t != "tcp" && t != "websocket" {
+		return []error{&config.SettingError{Setting: "Transport", Err: fmt.Errorf("unknown value %q (supported: tcp, websocket)", t)}}
+	}
+	return nil
+}
+
+// required returns the settings required by an account with the settings cfg.
+func required(cfg config.Protocol) []string {
+	if cfg.BindAddress == "" {
+		return []string{"Server", "Token"}
+	}
+	if cfg.NoTLS {
+		return []string{"Token"}
+	}
+	return []string{"Token", "TLSCertificate", "TLSKey"}
+}
+
+func newID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bmatterbridge {
+	b := &Bmatterbridge{}
+	b.Config = &cfg
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.Remote = c
+	b.Account = account
+	b.id = instanceID
+	b.peers = make(map[*peer]bool)
+	b.stop = make(chan struct{})
+	return b
+}
+
+// Connect listens on BindAddress or connects to Server.
+func (b *Bmatterbridge) Connect() error {
+	if b.Config.BindAddress != "" {
+		if b.Config.NoTLS && !loopback(b.Config.BindAddress) {
+			flog.Warnf("%s: NoTLS is set, the Token is received in clear text on %s", b.Account, b.Config.BindAddress)
+		}
+		return b.listen()
+	}
+	if b.Config.NoTLS && !loopback(b.Config.Server) {
+		flog.Warnf("%s: NoTLS is set, the Token is sent in clear text to %s", b.Account, b.Config.Server)
+	}
+	flog.Infof("Connecting %s", b.Config.Server)
+	c, err := b.dial()
+	if err != nil {
+		return err
+	}
+	flog.Info("Connection succeeded")
+	if b.addPeer(c) {
+		go b.keepConnected(c)
+	}
+	return nil
+}
+
+func (b *Bmatterbridge) Disconnect(ctx context.Context) error {
+	b.Lock()
+	defer b.Unlock()
+	b.stopOnce.Do(func() { close(b.stop) })
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	for p := range b.peers {
+		p.Close()
+	}
+	return nil
+}
+
+func (b *Bmatterbridge) JoinChannel(channel string) error {
+	return nil
+}
+
+// Send sends msg to the connected instances, with its origin.
+func (b *Bmatterbridge) Send(msg config.Message) error {
+	flog.Debugf("Receiving %#v", msg)
+	origin := config.Origin{}
+	if msg.Origin != nil {
+		origin = *msg.Origin
+	}
+	origin.Path = append(append([]string{}, origin.Path...), b.id)
+	msg.Origin = &origin
+	// do not hold the lock while sending, a slow instance would block the others
+	b.Lock()
+	peers := make([]*peer, 0, len(b.peers))
+	for p := range b.peers {
+		peers = append(peers, p)
+	}
+	b.Unlock()
+	if len(peers) == 0 {
+		return fmt.Errorf("%s: not connected to another instance, message dropped", b.Account)
+	}
+	for _, p := range peers {
+		if err := p.write(frame{Type: "message", Message: &msg}); err != nil {
+			flog.Errorf("sending to %s failed: %s", b.Account, err)
+		}
+	}
+	return nil
+}
+
+func (b *Bmatterbridge) tlsConfig() (*tls.Config, error) {
+	if b.Config.NoTLS {
+		return nil, nil
+	}
+	if b.Config.BindAddress == "" {
+		return &tls.Config{InsecureSkipVerify: b.Config.SkipTLSVerify}, nil
+	}
+	cert, err := tls.LoadX509KeyPair(b.settings.TLSCertificate, b.settings.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func (b *Bmatterbridge) listen() error {
+	tlsConfig, err := b.tlsConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", b.Config.BindAddress)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	b.listener = ln
+	flog.Infof("Listening on %s (%s)", ln.Addr(), b.transport())
+	if b.transport() == "websocket" {
+		upgrader := websocket.Upgrader{}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				flog.Errorf("websocket connection from %s failed: %s", r.RemoteAddr, err)
+				return
+			}
+			b.serve(ws, r.RemoteAddr)
+		})
+		go http.Serve(ln, handler)
+		return nil
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-b.stop:
+				default:
+					flog.Errorf("accepting connections failed: %s", err)
+				}
+				return
+			}
+			go b.serve(newStreamConn(c), c.RemoteAddr().String())
+		}
+	}()
+	return nil
+}
+
+// loopback returns true if address (host:port or websocket URL) is on the
+// local host.
+func loopback(address string) bool {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		address = u.Host
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (b *Bmatterbridge) transport() string {
+	if b.settings.Transport == "" {
+		return "tcp"
+	}
+	return b.settings.Transport
+}
+
+// serve authenticates the instance connected on c and receives its messages.
+func (b *Bmatterbridge) serve(c conn, addr string) {
+	defer c.Close()
+	var auth frame
+	c.SetReadDeadline(time.Now().Add(authTimeout))
+	if err := c.ReadJSON(&auth); err != nil {
+		flog.Errorf("connection from %s failed: %s", addr, err)
+		return
+	}
+	if auth.Type != "auth" || subtle.ConstantTimeCompare([]byte(auth.Token), []byte(b.Config.Token)) != 1 {
+		flog.Errorf("connection from %s: authentication failed", addr)
+		c.SetWriteDeadline(time.Now().Add(writeTimeout))
+		c.WriteJSON(frame{Type: "error", Error: "authentication failed"})
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	p := &peer{conn: c}
+	if !b.addPeer(p) {
+		return
+	}
+	if err := p.write(frame{Type: "auth"}); err != nil {
+		flog.Errorf("connection from %s failed: %s", addr, err)
+		b.removePeer(p)
+		return
+	}
+	flog.Infof("%s connected", addr)
+	b.receive(p)
+	flog.Infof("%s disconnected", addr)
+}
+
+// dial connects and authenticates to Server.
+func (b *Bmatterbridge) dial() (*peer, error) {
+	tlsConfig, err := b.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	var c conn
+	if b.transport() == "websocket" {
+		dialer := websocket.Dialer{TLSClientConfig: tlsConfig, HandshakeTimeout: authTimeout}
+		ws, _, err := dialer.Dial(b.Config.Server, nil)
+		if err != nil {
+			return nil, err
+		}
+		c = ws
+	} else {
+		dialer := &net.Dialer{Timeout: authTimeout}
+		var nc net.Conn
+		if tlsConfig != nil {
+			nc, err = tls.DialWithDialer(dialer, "tcp", b.Config.Server, tlsConfig)
+		} else {
+			nc, err = dialer.Dial("tcp", b.Config.Server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c = newStreamConn(nc)
+	}
+	p := &peer{conn: c}
+	var reply frame
+	err = p.write(frame{Type: "auth", Token: b.Config.Token})
+	if err == nil {
+		c.SetReadDeadline(time.Now().Add(authTimeout))
+		err = c.ReadJSON(&reply)
+	}
+	if err == nil && reply.Type != "auth" {
+		err = errors.New(reply.Error)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+	return p, nil
+}
+
+// keepConnected receives the messages of p and reconnects when the connection is lost.
+func (b *Bmatterbridge) keepConnected(p *peer) {
+	for {
+		b.receive(p)
+		p.Close()
+		for p = nil; p == nil; {
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(10 * time.Second):
+			}
+			flog.Infof("Reconnecting %s", b.Config.Server)
+			var err error
+			if p, err = b.dial(); err != nil {
+				flog.Errorf("Reconnection failed: %s", err)
+			}
+		}
+		if !b.addPeer(p) {
+			p.Close()
+			return
+		}
+		flog.Info("Connection succeeded")
+	}
+}
+
+// addPeer adds p to the instances messages are sent to. It returns false
+// when the bridge is disconnected.
+func (b *Bmatterbridge) addPeer(p *peer) bool {
+	b.Lock()
+	defer b.Unlock()
+	select {
+	case <-b.stop:
+		return false
+	default:
+	}
+	b.peers[p] = true
+	return true
+}
+
+func (b *Bmatterbridge) removePeer(p *peer) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.peers, p)
+}
+
+// receive sends the messages of p to the gateway until the connection is lost.
+func (b *Bmatterbridge) receive(p *peer) {
+	defer b.removePeer(p)
+	for {
+		var f frame
+		if err := p.ReadJSON(&f); err != nil {
+			select {
+			case <-b.stop:
+			default:
+				flog.Errorf("connection lost: %s", err)
+			}
+			return
+		}
+		if f.Type != "message" || f.Message == nil {
+			continue
+		}
+		msg := *f.Message
+		if msg.Origin != nil && relayedBy(msg.Origin, b.id) {
+			flog.Debugf("dropping message relayed by this instance before: %#v", msg)
+			continue
+		}
+		msg.Account = b.Account
+		flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+		b.Remote <- msg
+	}
+}
+
+// relayedBy returns true if the message passed through instance id.
+func relayedBy(origin *config.Origin, id string) bool {
+	for _, hop := range origin.Path {
+		if hop == id {
+			return true
+		}
+	}
+	return false
+}
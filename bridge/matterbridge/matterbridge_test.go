@@ -0,0 +1,186 @@
+package bmatterbridge
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper/bridgetest"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// link connects a client to a server, both with the settings cfg. The
+// client does not get the TLSCertificate and TLSKey of the server.
+func link(t *testing.T, transport string, cfg config.Protocol) (*Bmatterbridge, chan config.Message, *Bmatterbridge, chan config.Message) {
+	serverc, clientc := make(chan config.Message, 10), make(chan config.Message, 10)
+	settings, _ := cfg.Settings.(*Settings)
+	if settings == nil {
+		settings = &Settings{}
+	}
+	cfg.Token = "secret"
+	serverCfg := cfg
+	serverCfg.BindAddress = "127.0.0.1:0"
+	serverCfg.Settings = &Settings{TLSCertificate: settings.TLSCertificate, TLSKey: settings.TLSKey, Transport: transport}
+	server := New(serverCfg, "matterbridge.cloud", serverc)
+	server.id = "server"
+	if err := server.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	clientCfg := cfg
+	clientCfg.Settings = &Settings{Transport: transport}
+	clientCfg.Server = server.listener.Addr().String()
+	if transport == "websocket" && cfg.NoTLS {
+		clientCfg.Server = "ws://" + clientCfg.Server + "/"
+	} else if transport == "websocket" {
+		clientCfg.Server = "wss://" + clientCfg.Server + "/"
+	}
+	client := New(clientCfg, "matterbridge.office", clientc)
+	client.id = "client"
+	if err := client.Connect(); err != nil {
+		server.Disconnect(context.Background())
+		t.Fatal(err)
+	}
+	return server, serverc, client, clientc
+}
+
+// selfSigned writes a self-signed certificate for 127.0.0.1 and its key in
+// dir and returns the files.
+func selfSigned(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "matterbridge test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDer}} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func testLink(t *testing.T, transport string, cfg config.Protocol) {
+	server, serverc, client, clientc := link(t, transport, cfg)
+	defer server.Disconnect(context.Background())
+	defer client.Disconnect(context.Background())
+
+	origin := &config.Origin{Account: "irc.freenode", Protocol: "irc", Bridge: "freenode", Channel: "#test"}
+	if err := client.Send(config.Message{Username: "alice", Text: "hello", Channel: "general", Account: "irc.freenode", Origin: origin}); err != nil {
+		t.Fatal(err)
+	}
+	msg := bridgetest.Receive(t, serverc)
+	if msg.Account != "matterbridge.cloud" || msg.Username != "alice" || msg.Text != "hello" || msg.Channel != "general" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if msg.Origin == nil || msg.Origin.Protocol != "irc" || msg.Origin.Channel != "#test" || strings.Join(msg.Origin.Path, ",") != "client" {
+		t.Errorf("unexpected origin %#v", msg.Origin)
+	}
+	if len(origin.Path) != 0 {
+		t.Errorf("origin of the sent message modified: %#v", origin)
+	}
+
+	// the server sends to the client
+	if err := server.Send(config.Message{Username: "bob", Text: "hi", Channel: "general", Account: "discord.cloud"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := bridgetest.Receive(t, clientc); msg.Account != "matterbridge.office" || msg.Text != "hi" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+
+	// a message that passed the server before is dropped
+	looped := &config.Origin{Account: "discord.cloud", Path: []string{"server"}}
+	client.Send(config.Message{Username: "bob", Text: "loop", Channel: "general", Origin: looped})
+	client.Send(config.Message{Username: "bob", Text: "no loop", Channel: "general"})
+	if msg := bridgetest.Receive(t, serverc); msg.Text != "no loop" {
+		t.Errorf("looped message relayed: %#v", msg)
+	}
+	// the deferred Disconnect is the second one
+	client.Disconnect(context.Background())
+}
+
+func TestLinkTCP(t *testing.T) {
+	testLink(t, "tcp", config.Protocol{NoTLS: true})
+}
+
+func TestLinkWebsocket(t *testing.T) {
+	testLink(t, "websocket", config.Protocol{NoTLS: true})
+}
+
+func TestLinkTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "matterbridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := selfSigned(t, dir)
+	for _, transport := range []string{"tcp", "websocket"} {
+		testLink(t, transport, config.Protocol{SkipTLSVerify: true, Settings: &Settings{TLSCertificate: cert, TLSKey: key}})
+
+		// the certificate is verified unless SkipTLSVerify is set
+		server := New(config.Protocol{BindAddress: "127.0.0.1:0", Token: "secret",
+			Settings: &Settings{TLSCertificate: cert, TLSKey: key, Transport: transport}}, "matterbridge.cloud", make(chan config.Message))
+		if err := server.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		addr := server.listener.Addr().String()
+		if transport == "websocket" {
+			addr = "wss://" + addr + "/"
+		}
+		client := New(config.Protocol{Server: addr, Token: "secret", Settings: &Settings{Transport: transport}}, "matterbridge.office", make(chan config.Message))
+		if err := client.Connect(); err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Errorf("%s: expected a certificate error, got %v", transport, err)
+		}
+		server.Disconnect(context.Background())
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	for address, want := range map[string]bool{"127.0.0.1:9000": true, "localhost:9000": true, "[::1]:9000": true,
+		"ws://127.0.0.1:9000/": true, ":9000": false, "0.0.0.0:9000": false, "example.com:9000": false,
+		"ws://example.com:9000/": false} {
+		if got := loopback(address); got != want {
+			t.Errorf("%s: expected %t, got %t", address, want, got)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	server := New(config.Protocol{BindAddress: "127.0.0.1:0", Token: "secret", NoTLS: true}, "matterbridge.cloud", make(chan config.Message))
+	if err := server.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Disconnect(context.Background())
+	client := New(config.Protocol{Server: server.listener.Addr().String(), Token: "wrong", NoTLS: true}, "matterbridge.office", make(chan config.Message))
+	if err := client.Connect(); err == nil || err.Error() != "authentication failed" {
+		t.Errorf("expected authentication failure, got %v", err)
+	}
+}
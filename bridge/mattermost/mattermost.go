@@ -1,10 +1,17 @@
 package bmattermost
 
 import (
+	"context"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/42wim/matterbridge/matterclient"
 	"github.com/42wim/matterbridge/matterhook"
 	log "github.com/Sirupsen/logrus"
+	"github.com/mattermost/platform/model"
+	"strings"
+	"time"
 )
 
 type MMhook struct {
@@ -18,9 +25,12 @@ type MMapi struct {
 }
 
 type MMMessage struct {
-	Text     string
-	Channel  string
-	Username string
+	Text      string
+	Channel   string
+	Username  string
+	Event     string
+	Nicks     []string
+	Timestamp time.Time
 }
 
 type Bmattermost struct {
@@ -38,6 +48,17 @@ var protocol = "mattermost"
 
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: required, AutoCreate: true})
+}
+
+// required returns the settings required by an account with the settings cfg.
+func required(cfg config.Protocol) []string {
+	if cfg.UseAPI {
+		return []string{"Server", "Team", "Login", "Password"}
+	}
+	return []string{"URL", "BindAddress"}
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Bmattermost {
@@ -77,6 +98,15 @@ func (b *Bmattermost) Connect() error {
 	return nil
 }
 
+func (b *Bmattermost) Disconnect(ctx context.Context) error {
+	// the webhooks have nothing to disconnect
+	if !b.Config.UseAPI || b.mc == nil {
+		return nil
+	}
+	flog.Infof("Logging out %s", b.Config.Login)
+	return b.mc.Logout()
+}
+
 func (b *Bmattermost) JoinChannel(channel string) error {
 	// we can only join channels using the API
 	if b.Config.UseAPI {
@@ -85,20 +115,44 @@ func (b *Bmattermost) JoinChannel(channel string) error {
 	return nil
 }
 
+// ListChannels returns the names of the public and private channels of the team.
+func (b *Bmattermost) ListChannels() ([]string, error) {
+	if !b.Config.UseAPI {
+		return nil, fmt.Errorf("%s: listing channels needs UseAPI", b.Account)
+	}
+	if err := b.mc.UpdateChannels(); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, channel := range append(b.mc.GetChannels(), b.mc.GetMoreChannels()...) {
+		if channel.TeamId == b.TeamId && (channel.Type == model.CHANNEL_OPEN || channel.Type == model.CHANNEL_PRIVATE) {
+			names = append(names, channel.Name)
+		}
+	}
+	return names, nil
+}
+
+// CreateChannel creates channel if it does not exist in the team.
+func (b *Bmattermost) CreateChannel(channel string) error {
+	if !b.Config.UseAPI {
+		return fmt.Errorf("%s: creating channels needs UseAPI", b.Account)
+	}
+	if b.mc.GetChannelId(channel, "") != "" {
+		return nil
+	}
+	flog.Infof("Creating channel %s", channel)
+	return b.mc.CreateChannel(channel)
+}
+
 func (b *Bmattermost) Send(msg config.Message) error {
 	flog.Debugf("Receiving %#v", msg)
+	// mattermost can not show typing of others
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
 	nick := msg.Username
 	message := msg.Text
 	channel := msg.Channel
-
-	if b.Config.PrefixMessagesWithNick {
-		/*if IsMarkup(message) {
-			message = nick + "\n\n" + message
-		} else {
-		*/
-		message = nick + " " + message
-		//}
-	}
 	if !b.Config.UseAPI {
 		matterMessage := matterhook.OMessage{IconURL: b.Config.IconURL}
 		matterMessage.Channel = channel
@@ -116,6 +170,17 @@ func (b *Bmattermost) Send(msg config.Message) error {
 	return nil
 }
 
+// Capabilities implements bridge.Capable. Only the webhooks can set the
+// username of a message.
+func (b *Bmattermost) Capabilities() helper.Capabilities {
+	caps := helper.Capabilities{Username: !b.Config.UseAPI && !b.Config.PrefixMessagesWithNick,
+		Multiline: true, Markup: helper.MarkupMarkdown}
+	if b.Config.PrefixMessagesWithNick {
+		caps.Separator = " "
+	}
+	return caps
+}
+
 func (b *Bmattermost) handleMatter() {
 	flog.Debugf("Choosing API based Mattermost connection: %t", b.Config.UseAPI)
 	mchan := make(chan *MMMessage)
@@ -126,7 +191,7 @@ func (b *Bmattermost) handleMatter() {
 	}
 	for message := range mchan {
 		flog.Debugf("Sending message from %s on %s to gateway", message.Username, b.Account)
-		b.Remote <- config.Message{Text: message.Text, Username: message.Username, Channel: message.Channel, Account: b.Account}
+		b.Remote <- config.Message{Text: message.Text, Username: message.Username, Channel: message.Channel, Account: b.Account, Event: message.Event, Nicks: message.Nicks, Timestamp: message.Timestamp}
 	}
 }
 
@@ -140,6 +205,19 @@ func (b *Bmattermost) handleMatterClient(mchan chan *MMMessage) {
 			m.Username = message.Username
 			m.Channel = message.Channel
 			m.Text = message.Text
+			m.Timestamp = time.Unix(0, message.Post.CreateAt*int64(time.Millisecond))
+			switch {
+			case message.Post.Type == model.POST_JOIN_LEAVE:
+				m.Event = config.EVENT_JOIN_LEAVE
+				m.Nicks = []string{message.Username}
+			case message.Post.Type == model.POST_HEADER_CHANGE:
+				m.Event = config.EVENT_TOPIC_CHANGE
+			case strings.HasPrefix(message.Post.Type, model.POST_SYSTEM_MESSAGE_PREFIX):
+				m.Event = config.EVENT_NOTICE
+			}
+			if m.Event != "" && m.Event != config.EVENT_NOTICE {
+				m.Username = "system"
+			}
 			if len(message.Post.FileIds) > 0 {
 				for _, link := range b.mc.GetPublicLinks(message.Post.FileIds) {
 					m.Text = m.Text + "\n" + link
@@ -158,6 +236,7 @@ func (b *Bmattermost) handleMatterHook(mchan chan *MMMessage) {
 		m.Username = message.UserName
 		m.Text = message.Text
 		m.Channel = message.ChannelName
+		m.Timestamp = helper.ParseTimestamp(message.Timestamp)
 		mchan <- m
 	}
 }
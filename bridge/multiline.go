@@ -0,0 +1,97 @@
+package bridge
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/paste"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	pasteServer *paste.Server
+	pasteErr    error
+	pasteOnce   sync.Once
+)
+
+// getPaste returns the paste server configured in the general section,
+// starting it on first use.
+func getPaste(cfg *config.Config) (*paste.Server, error) {
+	if cfg.General.PasteBindAddress == "" {
+		return nil, nil
+	}
+	pasteOnce.Do(func() {
+		pasteServer, pasteErr = paste.New(paste.Config{BindAddress: cfg.General.PasteBindAddress,
+			URL:       cfg.General.PasteURL,
+			Retention: time.Duration(cfg.General.PasteRetention) * time.Hour})
+	})
+	return pasteServer, pasteErr
+}
+
+// Send applies the multiline policy of the bridge, formats the message for
+// its capabilities and sends it.
+func (b *Bridge) Send(msg config.Message) error {
+	if c, ok := b.Bridger.(Commander); ok && msg.Account != b.Account && strings.HasPrefix(msg.Text, "!") {
+		c.Command(&msg)
+		return nil
+	}
+	switch b.Config.Multiline {
+	case "join":
+		msg.Text = b.joinLines(msg.Text)
+	case "upload":
+		msg.Text = b.upload(msg.Text)
+	}
+	caps, ok := b.Capabilities()
+	if !ok {
+		return b.Bridger.Send(msg)
+	}
+	for _, m := range format(msg, caps) {
+		if err := b.Bridger.Send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bridge) joinLines(text string) string {
+	separator := b.Config.MultilineSeparator
+	if separator == "" {
+		separator = " | "
+	}
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, separator)
+}
+
+// upload stores text on the paste server when it is too long and returns
+// a summary with a link to the paste.
+func (b *Bridge) upload(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	maxLines := b.Config.MultilineMaxLines
+	if maxLines == 0 {
+		maxLines = 3
+	}
+	if len(lines) <= maxLines && (b.Config.MultilineMaxBytes == 0 || len(text) <= b.Config.MultilineMaxBytes) {
+		return text
+	}
+	if b.paste == nil {
+		log.Errorf("%s: Multiline=\"upload\" needs PasteBindAddress in [general]", b.Account)
+		return text
+	}
+	url, err := b.paste.Store(text)
+	if err != nil {
+		log.Errorf("%s: storing paste failed: %s", b.Account, err)
+		return text
+	}
+	summary := strings.TrimSpace(lines[0])
+	if runes := []rune(summary); len(runes) > 80 {
+		summary = string(runes[:80]) + "..."
+	}
+	return fmt.Sprintf("%s (%d lines, full message: %s)", summary, len(lines), url)
+}
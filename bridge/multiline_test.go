@@ -0,0 +1,62 @@
+package bridge
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"github.com/42wim/matterbridge/paste"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMultilineJoin(t *testing.T) {
+	lb := bloopback.New(config.Protocol{}, "fake.test", nil)
+	b := &Bridge{Account: "fake.test", Bridger: lb, Config: config.Protocol{Multiline: "join"}}
+	b.Send(config.Message{Account: "irc.test", Text: "one\n\ntwo\nthree"})
+	b.Config.MultilineSeparator = " / "
+	b.Send(config.Message{Account: "irc.test", Text: "one\ntwo"})
+	sent := lb.Sent()
+	if len(sent) != 2 || sent[0].Text != "one | two | three" || sent[1].Text != "one / two" {
+		t.Errorf("unexpected messages %q", texts(sent))
+	}
+}
+
+func TestMultilineUpload(t *testing.T) {
+	server, err := paste.New(paste.Config{BindAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := bloopback.New(config.Protocol{}, "fake.test", nil)
+	b := &Bridge{Account: "fake.test", Bridger: lb, paste: server,
+		Config: config.Protocol{Multiline: "upload", MultilineMaxLines: 2}}
+	b.Send(config.Message{Account: "irc.test", Text: "one\ntwo"})
+	long := "first line\ntwo\nthree"
+	b.Send(config.Message{Account: "irc.test", Text: long})
+	sent := lb.Sent()
+	if len(sent) != 2 || sent[0].Text != "one\ntwo" {
+		t.Fatalf("unexpected messages %q", texts(sent))
+	}
+	prefix := "first line (3 lines, full message: " + server.URL
+	if !strings.HasPrefix(sent[1].Text, prefix) {
+		t.Fatalf("expected a summary starting with %q, got %q", prefix, sent[1].Text)
+	}
+	resp, err := http.Get(strings.TrimSuffix(strings.TrimPrefix(sent[1].Text, "first line (3 lines, full message: "), ")"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != long {
+		t.Errorf("expected the paste %q, got %q", long, body)
+	}
+}
+
+func TestNewPasteError(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.General.PasteBindAddress = "localhost"
+	cfg.SetAccount("loopback.test", config.Protocol{Multiline: "upload"})
+	if _, err := New(cfg, &config.Bridge{Account: "loopback.test"}, nil); err == nil {
+		t.Errorf("expected an error for an invalid PasteBindAddress")
+	}
+}
@@ -1,7 +1,10 @@
 package brocketchat
 
 import (
+	"context"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/42wim/matterbridge/hook/rockethook"
 	"github.com/42wim/matterbridge/matterhook"
 	log "github.com/Sirupsen/logrus"
@@ -25,6 +28,9 @@ var protocol = "rocketchat"
 
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("URL", "BindAddress", "Nick")})
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Brocketchat {
@@ -49,12 +55,21 @@ func (b *Brocketchat) Connect() error {
 	return nil
 }
 
+func (b *Brocketchat) Disconnect(ctx context.Context) error {
+	// the webhooks have nothing to disconnect
+	return nil
+}
+
 func (b *Brocketchat) JoinChannel(channel string) error {
 	return nil
 }
 
 func (b *Brocketchat) Send(msg config.Message) error {
 	flog.Debugf("Receiving %#v", msg)
+	// the webhooks can not show typing
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
 	matterMessage := matterhook.OMessage{IconURL: b.Config.IconURL}
 	matterMessage.Channel = msg.Channel
 	matterMessage.UserName = msg.Username
@@ -68,6 +83,11 @@ func (b *Brocketchat) Send(msg config.Message) error {
 	return nil
 }
 
+// Capabilities implements bridge.Capable.
+func (b *Brocketchat) Capabilities() helper.Capabilities {
+	return helper.Capabilities{Username: true, Multiline: true, Markup: helper.MarkupMarkdown}
+}
+
 func (b *Brocketchat) handleRocketHook() {
 	for {
 		message := b.rh.Receive()
@@ -77,6 +97,7 @@ func (b *Brocketchat) handleRocketHook() {
 			continue
 		}
 		flog.Debugf("Sending message from %s on %s to gateway", message.UserName, b.Account)
-		b.Remote <- config.Message{Text: message.Text, Username: message.UserName, Channel: message.ChannelName, Account: b.Account}
+		b.Remote <- config.Message{Text: message.Text, Username: message.UserName, Channel: message.ChannelName, Account: b.Account,
+			Timestamp: helper.ParseTimestamp(message.Timestamp)}
 	}
 }
@@ -1,26 +1,38 @@
 package bslack
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	"github.com/42wim/matterbridge/matterhook"
 	log "github.com/Sirupsen/logrus"
 	"github.com/nlopes/slack"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 type MMMessage struct {
-	Text     string
-	Channel  string
-	Username string
-	Raw      *slack.MessageEvent
+	Text        string
+	Channel     string
+	Username    string
+	DisplayName string
+	Event       string
+	Nicks       []string
+	Timestamp   time.Time
+	Raw         *slack.MessageEvent
 }
 
 type Bslack struct {
 	mh       *matterhook.Client
 	sc       *slack.Client
+	client   *http.Client // for the methods the slack client lacks
 	Config   *config.Protocol
 	rtm      *slack.RTM
 	Plus     bool
@@ -29,6 +41,8 @@ type Bslack struct {
 	Account  string
 	si       *slack.Info
 	channels []slack.Channel
+	typing   bool // a gateway relays the typing notifications
+	sync.RWMutex
 }
 
 var flog *log.Entry
@@ -36,6 +50,17 @@ var protocol = "slack"
 
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: required, AutoCreate: true})
+}
+
+// required returns the settings required by an account with the settings cfg.
+func required(cfg config.Protocol) []string {
+	if cfg.UseAPI {
+		return []string{"Token"}
+	}
+	return []string{"URL", "BindAddress"}
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Bslack {
@@ -43,9 +68,15 @@ func New(cfg config.Protocol, account string, c chan config.Message) *Bslack {
 	b.Config = &cfg
 	b.Remote = c
 	b.Account = account
+	b.typing = true
 	return b
 }
 
+// FilterEvents implements bridge.EventFilter.
+func (b *Bslack) FilterEvents(relayed func(event string) bool) {
+	b.typing = relayed(config.EVENT_USER_TYPING)
+}
+
 func (b *Bslack) Command(cmd string) string {
 	return ""
 }
@@ -57,6 +88,7 @@ func (b *Bslack) Connect() error {
 			matterhook.Config{BindAddress: b.Config.BindAddress})
 	} else {
 		b.sc = slack.New(b.Config.Token)
+		b.client = &http.Client{Timeout: time.Minute}
 		b.rtm = b.sc.NewRTM()
 		go b.rtm.ManageConnection()
 	}
@@ -65,6 +97,15 @@ func (b *Bslack) Connect() error {
 	return nil
 }
 
+func (b *Bslack) Disconnect(ctx context.Context) error {
+	// the webhooks have nothing to disconnect
+	if !b.Config.UseAPI || b.rtm == nil {
+		return nil
+	}
+	flog.Info("Disconnecting")
+	return b.rtm.Disconnect()
+}
+
 func (b *Bslack) JoinChannel(channel string) error {
 	// we can only join channels using the API
 	if b.Config.UseAPI {
@@ -84,8 +125,28 @@ func (b *Bslack) Send(msg config.Message) error {
 	nick := msg.Username
 	message := msg.Text
 	channel := msg.Channel
-	if b.Config.PrefixMessagesWithNick {
-		message = nick + " " + message
+	if msg.Event == config.EVENT_USER_TYPING {
+		// only the API can show we are typing
+		if !b.Config.UseAPI {
+			return nil
+		}
+		schannel, err := b.getChannelByName(channel)
+		if err != nil {
+			return err
+		}
+		b.rtm.SendMessage(b.rtm.NewTypingMessage(schannel.ID))
+		return nil
+	}
+	if msg.Event == config.EVENT_USER_ACTION {
+		// only sent with the API (Actions capability), as the bot user
+		schannel, err := b.getChannelByName(channel)
+		if err != nil {
+			return err
+		}
+		if !b.Config.PrefixMessagesWithNick {
+			message = nick + message
+		}
+		return b.meMessage(schannel.ID, message)
 	}
 	if !b.Config.UseAPI {
 		matterMessage := matterhook.OMessage{IconURL: b.Config.IconURL}
@@ -123,6 +184,38 @@ func (b *Bslack) Send(msg config.Message) error {
 	return nil
 }
 
+// Capabilities implements bridge.Capable. Only the API can show avatars and
+// actions.
+func (b *Bslack) Capabilities() helper.Capabilities {
+	caps := helper.Capabilities{Username: !b.Config.PrefixMessagesWithNick, Avatar: b.Config.UseAPI,
+		Actions: b.Config.UseAPI, Multiline: true, Markup: helper.MarkupMarkdown}
+	if b.Config.PrefixMessagesWithNick {
+		caps.Separator = " "
+	}
+	return caps
+}
+
+// meMessage sends text as a /me message (subtype me_message).
+func (b *Bslack) meMessage(channelID string, text string) error {
+	resp, err := b.client.PostForm("https://slack.com/api/chat.meMessage",
+		url.Values{"token": {b.Config.Token}, "channel": {channelID}, "text": {text}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if !res.Ok {
+		return fmt.Errorf("chat.meMessage failed: %s", res.Error)
+	}
+	return nil
+}
+
 func (b *Bslack) getAvatar(user string) string {
 	var avatar string
 	if b.Users != nil {
@@ -135,7 +228,48 @@ func (b *Bslack) getAvatar(user string) string {
 	return avatar
 }
 
+// ListChannels returns the names of the channels of the team.
+func (b *Bslack) ListChannels() ([]string, error) {
+	if !b.Config.UseAPI {
+		return nil, fmt.Errorf("%s: listing channels needs UseAPI", b.Account)
+	}
+	channels, err := b.sc.GetChannels(true)
+	if err != nil {
+		return nil, err
+	}
+	b.Lock()
+	b.channels = channels
+	b.Unlock()
+	var names []string
+	for _, channel := range channels {
+		names = append(names, channel.Name)
+	}
+	return names, nil
+}
+
+// CreateChannel creates channel if it does not exist in the team.
+func (b *Bslack) CreateChannel(channel string) error {
+	// refresh the channels, they may not be known yet when connecting
+	if _, err := b.ListChannels(); err != nil {
+		return err
+	}
+	if _, err := b.getChannelByName(channel); err == nil {
+		return nil
+	}
+	flog.Infof("Creating channel %s", channel)
+	created, err := b.sc.CreateChannel(channel)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.channels = append(b.channels, *created)
+	b.Unlock()
+	return nil
+}
+
 func (b *Bslack) getChannelByName(name string) (*slack.Channel, error) {
+	b.RLock()
+	defer b.RUnlock()
 	if b.channels == nil {
 		return nil, fmt.Errorf("%s: channel %s not found (no channels found)", b.Account, name)
 	}
@@ -147,6 +281,36 @@ func (b *Bslack) getChannelByName(name string) (*slack.Channel, error) {
 	return nil, fmt.Errorf("%s: channel %s not found", b.Account, name)
 }
 
+func (b *Bslack) getChannelByID(id string) (*slack.Channel, error) {
+	b.RLock()
+	defer b.RUnlock()
+	for _, channel := range b.channels {
+		if channel.ID == id {
+			return &channel, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: channel %s not found", b.Account, id)
+}
+
+// memberChannels returns the names of the channels we share with user.
+func (b *Bslack) memberChannels(user string) []string {
+	b.RLock()
+	defer b.RUnlock()
+	var names []string
+	for _, channel := range b.channels {
+		if !channel.IsMember {
+			continue
+		}
+		for _, member := range channel.Members {
+			if member == user {
+				names = append(names, channel.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
 func (b *Bslack) handleSlack() {
 	flog.Debugf("Choosing API based slack connection: %t", b.Config.UseAPI)
 	mchan := make(chan *MMMessage)
@@ -165,7 +329,7 @@ func (b *Bslack) handleSlack() {
 		texts := strings.Split(message.Text, "\n")
 		for _, text := range texts {
 			flog.Debugf("Sending message from %s on %s to gateway", message.Username, b.Account)
-			b.Remote <- config.Message{Text: text, Username: message.Username, Channel: message.Channel, Account: b.Account, Avatar: b.getAvatar(message.Username)}
+			b.Remote <- config.Message{Text: text, Username: message.Username, DisplayName: message.DisplayName, Channel: message.Channel, Account: b.Account, Avatar: b.getAvatar(message.Username), Event: message.Event, Nicks: message.Nicks, Timestamp: message.Timestamp}
 		}
 	}
 }
@@ -189,19 +353,66 @@ func (b *Bslack) handleSlackClient(mchan chan *MMMessage) {
 				}
 				m := &MMMessage{}
 				m.Username = user.Name
+				m.DisplayName = user.RealName
 				m.Channel = channel.Name
 				m.Text = ev.Text
 				m.Raw = ev
+				m.Timestamp = helper.ParseTimestamp(ev.Timestamp)
 				m.Text = b.replaceMention(m.Text)
+				switch ev.SubType {
+				case "me_message":
+					m.Event = config.EVENT_USER_ACTION
+				case "channel_join", "channel_leave":
+					m.Username = "system"
+					m.Event = config.EVENT_JOIN_LEAVE
+					m.Nicks = []string{user.Name}
+					m.Text = user.Name + " joins"
+					if ev.SubType == "channel_leave" {
+						m.Text = user.Name + " parts"
+					}
+				case "channel_topic":
+					m.Username = "system"
+					m.Event = config.EVENT_TOPIC_CHANGE
+					m.Text = user.Name + " changed the topic to: " + ev.Topic
+				}
 				mchan <- m
 			}
 			count++
+		case *slack.UserTypingEvent:
+			if !b.typing {
+				continue
+			}
+			channel, err := b.getChannelByID(ev.Channel)
+			if err != nil {
+				continue
+			}
+			mchan <- &MMMessage{Username: b.userName(ev.User), Channel: channel.Name, Event: config.EVENT_USER_TYPING}
+		case *slack.UserChangeEvent:
+			if old := b.userName(ev.User.ID); old != "" && old != ev.User.Name {
+				mchan <- &MMMessage{Username: "system", Text: old + " is now known as " + ev.User.Name, Event: config.EVENT_NICK_CHANGE}
+			}
+			b.Users, _ = b.sc.GetUsers()
+		case *slack.PresenceChangeEvent:
+			if b.si != nil && ev.User == b.si.User.ID {
+				continue
+			}
+			// presence is not per channel, send it on the channels of the user
+			text := b.userName(ev.User) + " is back"
+			if ev.Presence == "away" {
+				text = b.userName(ev.User) + " is away"
+			}
+			for _, channel := range b.memberChannels(ev.User) {
+				mchan <- &MMMessage{Username: "system", Text: text, Channel: channel, Event: config.EVENT_AWAY,
+					Nicks: []string{b.userName(ev.User)}}
+			}
 		case *slack.OutgoingErrorEvent:
 			flog.Debugf("%#v", ev.Error())
 		case *slack.ChannelJoinedEvent:
 			b.Users, _ = b.sc.GetUsers()
 		case *slack.ConnectedEvent:
+			b.Lock()
 			b.channels = ev.Info.Channels
+			b.Unlock()
 			b.si = ev.Info
 			b.Users, _ = b.sc.GetUsers()
 		case *slack.InvalidAuthEvent:
@@ -220,6 +431,7 @@ func (b *Bslack) handleMatterHook(mchan chan *MMMessage) {
 		m.Text = message.Text
 		m.Text = b.replaceMention(m.Text)
 		m.Channel = message.ChannelName
+		m.Timestamp = helper.ParseTimestamp(message.Timestamp)
 		mchan <- m
 	}
 }
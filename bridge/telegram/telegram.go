@@ -2,10 +2,15 @@ package btelegram
 
 import (
 	"bytes"
+	"context"
 	"html"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	log "github.com/Sirupsen/logrus"
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/russross/blackfriday"
@@ -21,8 +26,14 @@ type Btelegram struct {
 var flog *log.Entry
 var protocol = "telegram"
 
+// messageLength is the maximum amount of characters in a telegram message
+const messageLength = 4096
+
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Token")})
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Btelegram {
@@ -51,6 +62,11 @@ func (b *Btelegram) Connect() error {
 	return nil
 }
 
+func (b *Btelegram) Disconnect(ctx context.Context) error {
+	// messages are sent synchronously and updates are polled, nothing to disconnect
+	return nil
+}
+
 func (b *Btelegram) JoinChannel(channel string) error {
 	return nil
 }
@@ -106,8 +122,26 @@ func (b *Btelegram) Send(msg config.Message) error {
 	if err != nil {
 		return err
 	}
+	// telegram can not show typing of others
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
+	m := tgbotapi.NewMessage(chatid, render(msg))
+	m.ParseMode = "HTML"
+	_, err = b.c.Send(m)
+	return err
+}
 
-	parsed := blackfriday.Markdown([]byte(msg.Text),
+// render returns the HTML of the markdown text of msg. The username prefixed
+// by the gateway is not markdown, it is escaped and prepended after rendering.
+func render(msg config.Message) string {
+	prefix, text := "", msg.Text
+	if strings.HasPrefix(text, msg.Username) {
+		prefix, text = msg.Username, text[len(msg.Username):]
+	}
+	// the gateway splits the markdown before it is rendered, so every
+	// message is valid html
+	parsed := blackfriday.Markdown([]byte(text),
 		&customHtml{blackfriday.HtmlRenderer(blackfriday.HTML_USE_XHTML|blackfriday.HTML_SKIP_IMAGES, "", "")},
 		blackfriday.EXTENSION_NO_INTRA_EMPHASIS|
 			blackfriday.EXTENSION_FENCED_CODE|
@@ -116,11 +150,16 @@ func (b *Btelegram) Send(msg config.Message) error {
 			blackfriday.EXTENSION_HEADER_IDS|
 			blackfriday.EXTENSION_BACKSLASH_LINE_BREAK|
 			blackfriday.EXTENSION_DEFINITION_LISTS)
+	return html.EscapeString(prefix) + string(parsed)
+}
 
-	m := tgbotapi.NewMessage(chatid, msg.Username+string(parsed))
-	m.ParseMode = "HTML"
-	_, err = b.c.Send(m)
-	return err
+// Capabilities implements bridge.Capable.
+func (b *Btelegram) Capabilities() helper.Capabilities {
+	limit := helper.Limit{Max: messageLength}
+	if b.Config.MessageLength != 0 {
+		limit.Max = b.Config.MessageLength
+	}
+	return helper.Capabilities{Multiline: true, Markup: helper.MarkupMarkdown, Limit: limit}
 }
 
 func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
@@ -129,6 +168,9 @@ func (b *Btelegram) handleRecv(updates <-chan tgbotapi.Update) {
 			continue
 		}
 		flog.Debugf("Sending message from %s on %s to gateway", update.Message.From.UserName, b.Account)
-		b.Remote <- config.Message{Username: update.Message.From.UserName, Text: update.Message.Text, Channel: strconv.FormatInt(update.Message.Chat.ID, 10), Account: b.Account}
+		from := update.Message.From
+		b.Remote <- config.Message{Username: from.UserName, DisplayName: strings.TrimSpace(from.FirstName + " " + from.LastName),
+			Text: update.Message.Text, Channel: strconv.FormatInt(update.Message.Chat.ID, 10), Account: b.Account,
+			Timestamp: time.Unix(int64(update.Message.Date), 0)}
 	}
 }
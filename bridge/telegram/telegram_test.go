@@ -0,0 +1,21 @@
+package btelegram
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	for _, test := range []struct {
+		msg  config.Message
+		want string
+	}{
+		{config.Message{Username: "<_bob_> ", Text: "<_bob_> *hello* & bye"}, "&lt;_bob_&gt; <em>hello</em> &amp; bye\n"},
+		{config.Message{Username: "*alice* ", Text: "*alice* _waves_"}, "*alice* <em>waves</em>\n"},
+		{config.Message{Username: "carol", Text: "no prefix"}, "no prefix\n"},
+	} {
+		if got := render(test.msg); got != test.want {
+			t.Errorf("expected %q, got %q", test.want, got)
+		}
+	}
+}
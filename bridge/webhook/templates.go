@@ -0,0 +1,170 @@
+package bwebhook
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// payloadFuncs are the functions of the templates of the payloads, besides
+// the helper functions.
+var payloadFuncs = template.FuncMap{
+	// firstline returns the first line of a commit message or a comment
+	"firstline": func(s string) string {
+		return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+	},
+	// short returns the abbreviated commit id
+	"short": func(id string) string {
+		if len(id) > 7 {
+			return id[:7]
+		}
+		return id
+	},
+	// ref returns the branch or tag name of a ref
+	"ref": func(ref string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	},
+	// past returns the past tense of the GitLab actions (open, close, merge, ...)
+	"past": func(action string) string {
+		switch {
+		case strings.HasSuffix(action, "ed"):
+			return action
+		case strings.HasSuffix(action, "e"):
+			return action + "d"
+		}
+		return action + "ed"
+	},
+	// plural returns word followed by "s" unless n is 1
+	"plural": func(n interface{}, word string) string {
+		if fmt.Sprint(n) == "1" {
+			return word
+		}
+		return word + "s"
+	},
+}
+
+const (
+	// noValue is what text/template prints for the missing keys of the
+	// payloads, also with the option missingkey=zero as the values of the
+	// JSON objects are interface{}.
+	noValue = "<no value>"
+	// noValueEscape replaces noValue in the strings of the payloads, so only
+	// the missing keys are removed from the output. It has as many characters.
+	noValueEscape = "<no\ue000value>"
+)
+
+// parseTemplate parses a template of the payloads.
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return helper.ParseTemplateFuncs(name, text, payloadFuncs)
+}
+
+// execute executes tmpl with the decoded JSON payload. The missing keys and
+// the nulls of the payload print nothing.
+func execute(tmpl *template.Template, payload interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, normalize(payload)); err != nil {
+		return "", err
+	}
+	text := strings.Replace(buf.String(), noValue, "", -1)
+	return strings.Replace(text, noValueEscape, noValue, -1), nil
+}
+
+// normalize replaces the nulls of the decoded JSON payload with "" and escapes
+// noValue in its strings.
+func normalize(payload interface{}) interface{} {
+	switch v := payload.(type) {
+	case nil:
+		return ""
+	case string:
+		return strings.Replace(v, noValue, noValueEscape, -1)
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalize(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalize(value)
+		}
+	}
+	return payload
+}
+
+// The templates of the events of GitHub, also used for the compatible events of Gitea.
+const (
+	githubPush = `{{if .deleted -}}
+{{.sender.login}} deleted {{ref .ref}} of {{.repository.full_name}}
+{{- else if not .commits -}}
+{{.sender.login}} pushed {{ref .ref}} to {{.repository.full_name}}
+{{- else -}}
+{{.sender.login}} pushed {{len .commits}} {{plural (len .commits) "commit"}} to {{ref .ref}} of {{.repository.full_name}} {{.compare}}
+{{- range .commits}}
+* {{firstline .message}} ({{short .id}}){{end}}
+{{- end}}`
+	githubIssues       = `{{.sender.login}} {{.action}} issue #{{.issue.number}} in {{.repository.full_name}}: {{.issue.title}} {{.issue.html_url}}`
+	githubPullRequest  = `{{.sender.login}} {{if .pull_request.merged}}merged{{else}}{{.action}}{{end}} pull request #{{.pull_request.number}} in {{.repository.full_name}}: {{.pull_request.title}} {{.pull_request.html_url}}`
+	githubIssueComment = `{{if eq .action "created"}}{{.sender.login}} commented on #{{.issue.number}} in {{.repository.full_name}}: {{truncate 200 (firstline .comment.body)}} {{.comment.html_url}}{{end}}`
+	githubRelease      = `{{if eq .action "published"}}{{.sender.login}} published release {{.release.tag_name}} of {{.repository.full_name}} {{.release.html_url}}{{end}}`
+)
+
+// builtins are the templates of the events by source (the header with the
+// event) and event.
+var builtins = map[string]map[string]string{
+	"X-GitHub-Event": {
+		"push":          githubPush,
+		"issues":        githubIssues,
+		"pull_request":  githubPullRequest,
+		"issue_comment": githubIssueComment,
+		"release":       githubRelease,
+		"workflow_run":  `{{if eq .action "completed"}}Workflow {{.workflow_run.name}} {{.workflow_run.conclusion}} on {{.workflow_run.head_branch}} of {{.repository.full_name}} {{.workflow_run.html_url}}{{end}}`,
+	},
+	"X-Gitlab-Event": {
+		"Push Hook":          `{{.user_username}} pushed {{.total_commits_count}} {{plural .total_commits_count "commit"}} to {{ref .ref}} of {{.project.path_with_namespace}}{{range .commits}}` + "\n" + `* {{firstline .message}} ({{short .id}}){{end}}`,
+		"Tag Push Hook":      `{{.user_username}} pushed tag {{ref .ref}} to {{.project.path_with_namespace}}`,
+		"Issue Hook":         `{{.user.username}} {{past .object_attributes.action}} issue #{{.object_attributes.iid}} in {{.project.path_with_namespace}}: {{.object_attributes.title}} {{.object_attributes.url}}`,
+		"Merge Request Hook": `{{.user.username}} {{past .object_attributes.action}} merge request !{{.object_attributes.iid}} in {{.project.path_with_namespace}}: {{.object_attributes.title}} {{.object_attributes.url}}`,
+		"Note Hook":          `{{.user.username}} commented in {{.project.path_with_namespace}}: {{truncate 200 (firstline .object_attributes.note)}} {{.object_attributes.url}}`,
+		"Pipeline Hook":      `{{with .object_attributes}}{{if or (eq .status "success") (eq .status "failed")}}Pipeline #{{.id}} {{.status}} on {{.ref}} of {{$.project.path_with_namespace}} {{$.project.web_url}}/-/pipelines/{{.id}}{{end}}{{end}}`,
+		"Release Hook":       `{{if eq .action "create"}}Release {{.tag}} of {{.project.path_with_namespace}} created {{.url}}{{end}}`,
+	},
+	"X-Gitea-Event": {
+		"push":          strings.Replace(githubPush, ".compare", ".compare_url", 1),
+		"issues":        githubIssues,
+		"pull_request":  githubPullRequest,
+		"issue_comment": githubIssueComment,
+		"release":       githubRelease,
+	},
+}
+
+// sources are the event headers of the built-in templates, in the order they
+// are looked for (Gitea also sends X-GitHub-Event), with the name of the source.
+var sources = []struct{ header, name string }{
+	{"X-Gitea-Event", "Gitea"},
+	{"X-Gitlab-Event", "GitLab"},
+	{"X-GitHub-Event", "GitHub"},
+}
+
+var templates = make(map[string]map[string]*template.Template)
+
+func init() {
+	for header, events := range builtins {
+		templates[header] = make(map[string]*template.Template)
+		for event, text := range events {
+			templates[header][event] = template.Must(parseTemplate(event, text))
+		}
+	}
+}
+
+// builtinTemplate returns the built-in template of the event of the webhook
+// with header, and the name of its source. The template is nil for unknown
+// events.
+func builtinTemplate(header http.Header) (*template.Template, string) {
+	for _, source := range sources {
+		if event := header.Get(source.header); event != "" {
+			return templates[source.header][event], source.name
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,285 @@
+// Package bwebhook relays JSON webhooks (input only).
+//
+// Each account is a source of webhooks, its channels are the paths the
+// webhooks are posted to (eg "/github"). The accounts with the same
+// BindAddress share the listener.
+//
+// The requests must be signed with Token (HMAC-SHA256 of the body in the
+// X-Hub-Signature-256, X-Gitea-Signature or X-Signature-256 header) or carry
+// it (X-Gitlab-Token or X-Webhook-Token header). Without Token, every request
+// is accepted when Insecure is set.
+//
+// The payload is formatted with the template WebhookFormat, or else with the
+// built-in template of the event for GitHub, GitLab and Gitea webhooks.
+package bwebhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Settings are the settings of the webhook accounts that are not in config.Protocol.
+type Settings struct {
+	Insecure      bool   // accept the requests without Token
+	WebhookFormat string // template of the messages of the JSON payloads
+}
+
+type Bwebhook struct {
+	Config   *config.Protocol
+	settings Settings
+	Remote   chan config.Message
+	Account  string
+	format   *template.Template // WebhookFormat
+	server   *server
+	paths    []string // joined channels
+}
+
+// server is a listener shared by the accounts with the same BindAddress.
+type server struct {
+	address  string
+	listener net.Listener
+	http     *http.Server
+	accounts int
+	hooks    map[string]*Bwebhook // by path
+	sync.Mutex
+}
+
+var flog *log.Entry
+var protocol = "webhook"
+
+var (
+	servers   = make(map[string]*server) // by BindAddress
+	serversMu sync.Mutex
+)
+
+const (
+	// maxSize is the maximum size of a payload in bytes.
+	maxSize = 5 * 1024 * 1024
+)
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: required, Settings: func() interface{} { return &Settings{} }, Check: check})
+}
+
+// required returns the settings required by an account with the settings cfg.
+func required(cfg config.Protocol) []string {
+	var settings Settings
+	if cfg.Decode(&settings) == nil && settings.Insecure {
+		return []string{"BindAddress"}
+	}
+	return []string{"BindAddress", "Token"}
+}
+
+// check checks the settings of an account.
+func check(cfg config.Protocol) []error {
+	var settings Settings
+	if err := cfg.Decode(&settings); err != nil {
+		return []error{err}
+	}
+	if _, err := parseTemplate("WebhookFormat", settings.WebhookFormat); err != nil {
+		return []error{&config.SettingError{Setting: "WebhookFormat", Err: err}}
+	}
+	return nil
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bwebhook {
+	b := &Bwebhook{}
+	b.Config = &cfg
+	if err := cfg.Decode(&b.settings); err != nil {
+		flog.Errorf("%s: %s", account, err)
+	}
+	b.Remote = c
+	b.Account = account
+	return b
+}
+
+// Connect parses WebhookFormat and starts the listener of BindAddress, unless
+// another account already did.
+func (b *Bwebhook) Connect() error {
+	if b.Config.Token == "" && !b.settings.Insecure {
+		return fmt.Errorf("Token is required to verify the webhooks, set Insecure=true to accept every request")
+	}
+	if b.settings.WebhookFormat != "" {
+		tmpl, err := parseTemplate("WebhookFormat", b.settings.WebhookFormat)
+		if err != nil {
+			return fmt.Errorf("invalid WebhookFormat: %s", err)
+		}
+		b.format = tmpl
+	}
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	s, ok := servers[b.Config.BindAddress]
+	if !ok {
+		flog.Infof("Listening on %s", b.Config.BindAddress)
+		l, err := net.Listen("tcp", b.Config.BindAddress)
+		if err != nil {
+			return err
+		}
+		s = &server{address: b.Config.BindAddress, listener: l, hooks: make(map[string]*Bwebhook)}
+		s.http = &http.Server{Handler: s, ReadTimeout: time.Minute, WriteTimeout: time.Minute}
+		go func() {
+			if err := s.http.Serve(l); err != http.ErrServerClosed {
+				flog.Errorf("listener of %s stopped: %s", s.address, err)
+			}
+		}()
+		servers[b.Config.BindAddress] = s
+	}
+	s.accounts++
+	b.server = s
+	flog.Info("Connection succeeded")
+	return nil
+}
+
+// Disconnect removes the paths of the account, the listener is stopped when
+// the last account using it disconnects.
+func (b *Bwebhook) Disconnect(ctx context.Context) error {
+	s := b.server
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	for _, path := range b.paths {
+		delete(s.hooks, path)
+	}
+	s.Unlock()
+	serversMu.Lock()
+	s.accounts--
+	last := s.accounts == 0
+	if last {
+		delete(servers, s.address)
+	}
+	serversMu.Unlock()
+	if !last {
+		return nil
+	}
+	return s.http.Shutdown(ctx)
+}
+
+// JoinChannel relays the webhooks posted to the path channel.
+func (b *Bwebhook) JoinChannel(channel string) error {
+	if !strings.HasPrefix(channel, "/") {
+		return fmt.Errorf("%s is not a path (eg /github)", channel)
+	}
+	s := b.server
+	s.Lock()
+	defer s.Unlock()
+	if other, ok := s.hooks[channel]; ok && other != b {
+		return fmt.Errorf("%s is already used by %s", channel, other.Account)
+	}
+	s.hooks[channel] = b
+	b.paths = append(b.paths, channel)
+	return nil
+}
+
+// Send drops msg, webhooks are input only.
+func (b *Bwebhook) Send(msg config.Message) error {
+	flog.Debugf("Dropping %#v, webhooks are input only", msg)
+	return nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.Lock()
+	b, ok := s.hooks[r.URL.Path]
+	s.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	b.handle(w, r, body)
+}
+
+// handle relays the webhook r with the payload body.
+func (b *Bwebhook) handle(w http.ResponseWriter, r *http.Request, body []byte) {
+	if !b.verify(r.Header, body) {
+		flog.Infof("%s: invalid signature or token from %s", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "invalid signature or token", http.StatusUnauthorized)
+		return
+	}
+	var payload interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	// keep the ids as they are sent, not as floats
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	tmpl, source := b.format, "webhook"
+	if tmpl == nil {
+		tmpl, source = builtinTemplate(r.Header)
+	}
+	if tmpl == nil {
+		flog.Debugf("%s: no template for the webhook, dropping it", r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	text, err := execute(tmpl, payload)
+	if err != nil {
+		flog.Errorf("%s: executing template %s failed: %s", r.URL.Path, tmpl.Name(), err)
+		http.Error(w, "executing template failed", http.StatusInternalServerError)
+		return
+	}
+	text = strings.TrimSpace(text)
+	w.WriteHeader(http.StatusNoContent)
+	if text == "" {
+		return
+	}
+	username := b.Config.Nick
+	if username == "" {
+		username = source
+	}
+	msg := config.Message{Username: username, Text: text, Channel: r.URL.Path, Account: b.Account, Timestamp: time.Now()}
+	flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+	b.Remote <- msg
+}
+
+// verify returns true if the headers of a request with body are signed with
+// Token or carry it, or if Token is not set and Insecure is.
+func (b *Bwebhook) verify(header http.Header, body []byte) bool {
+	if b.Config.Token == "" {
+		return b.settings.Insecure
+	}
+	mac := hmac.New(sha256.New, []byte(b.Config.Token))
+	mac.Write(body)
+	sum := []byte(hex.EncodeToString(mac.Sum(nil)))
+	for _, name := range []string{"X-Hub-Signature-256", "X-Gitea-Signature", "X-Signature-256"} {
+		signature := strings.ToLower(strings.TrimPrefix(header.Get(name), "sha256="))
+		if signature != "" && hmac.Equal([]byte(signature), sum) {
+			return true
+		}
+	}
+	for _, name := range []string{"X-Gitlab-Token", "X-Webhook-Token"} {
+		token := header.Get(name)
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(b.Config.Token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
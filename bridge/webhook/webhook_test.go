@@ -0,0 +1,169 @@
+package bwebhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper/bridgetest"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newBridge(t *testing.T, cfg config.Protocol, account string, paths ...string) (*Bwebhook, chan config.Message) {
+	c := make(chan config.Message, 10)
+	cfg.BindAddress = "127.0.0.1:0"
+	b := New(cfg, account, c)
+	bridgetest.Start(t, b, paths...)
+	return b, c
+}
+
+func post(t *testing.T, b *Bwebhook, path string, body string, header map[string]string) int {
+	req, err := http.NewRequest("POST", "http://"+b.server.listener.Addr().String()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+const push = `{"ref":"refs/heads/master","compare":"https://github.com/o/r/compare/a...b","deleted":false,
+	"sender":{"login":"alice"},"repository":{"full_name":"o/r"},
+	"commits":[{"id":"0123456789abcdef","message":"Fix the build\n\nIt was broken."},{"id":"fedcba9876543210","message":"Add tests"}]}`
+
+func TestWebhook(t *testing.T) {
+	github, c := newBridge(t, config.Protocol{Token: "s3cret"}, "webhook.github", "/github")
+	defer github.Disconnect(context.Background())
+	custom, c2 := newBridge(t, config.Protocol{Token: "t0ken", Nick: "ci",
+		Settings: &Settings{WebhookFormat: `{{.build.status | upper}}: {{.build.name}} #{{.build.number}}{{.missing}}`}}, "webhook.ci", "/ci")
+	if custom.server != github.server {
+		t.Fatal("the accounts with the same BindAddress should share the listener")
+	}
+
+	header := map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("s3cret", push)}
+	if code := post(t, github, "/github", push, header); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	msg := bridgetest.Receive(t, c)
+	want := "alice pushed 2 commits to master of o/r https://github.com/o/r/compare/a...b\n* Fix the build (0123456)\n* Add tests (fedcba9)"
+	if msg.Text != want || msg.Username != "GitHub" || msg.Channel != "/github" || msg.Account != "webhook.github" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+
+	header["X-Hub-Signature-256"] = "sha256=" + sign("wrong", push)
+	if code := post(t, github, "/github", push, header); code != http.StatusUnauthorized {
+		t.Errorf("expected an invalid signature to be refused, got %d", code)
+	}
+	// events without template are dropped
+	ping := `{"zen":"Keep it simple."}`
+	if code := post(t, github, "/github", ping, map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign("s3cret", ping)}); code != http.StatusNoContent {
+		t.Errorf("unexpected status %d", code)
+	}
+
+	build := `{"build":{"status":"passed","name":"matterbridge","number":42}}`
+	if code := post(t, custom, "/ci", build, map[string]string{"X-Webhook-Token": "t0ken"}); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if msg = bridgetest.Receive(t, c2); msg.Text != "PASSED: matterbridge #42" || msg.Username != "ci" || msg.Channel != "/ci" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if code := post(t, custom, "/ci", build, map[string]string{"X-Webhook-Token": "s3cret"}); code != http.StatusUnauthorized {
+		t.Errorf("expected the token of another source to be refused, got %d", code)
+	}
+	if code := post(t, custom, "/ci", "not json", map[string]string{"X-Webhook-Token": "t0ken"}); code != http.StatusBadRequest {
+		t.Errorf("expected invalid JSON to be refused, got %d", code)
+	}
+	if code := post(t, custom, "/other", build, nil); code != http.StatusNotFound {
+		t.Errorf("expected an unknown path to be refused, got %d", code)
+	}
+	if err := custom.JoinChannel("/github"); err == nil {
+		t.Error("joining the path of another account should fail")
+	}
+	if len(c) != 0 || len(c2) != 0 {
+		t.Errorf("unexpected messages %d %d", len(c), len(c2))
+	}
+	custom.Disconnect(context.Background())
+	if code := post(t, github, "/ci", build, nil); code != http.StatusNotFound {
+		t.Errorf("expected the path of a disconnected account to be removed, got %d", code)
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	if err := New(config.Protocol{BindAddress: "127.0.0.1:0"}, "webhook.test", nil).Connect(); err == nil {
+		t.Fatal("expected an error without Token")
+	}
+	b, c := newBridge(t, config.Protocol{Settings: &Settings{Insecure: true,
+		WebhookFormat: `{{define "b"}}{{.c}}{{.d}}{{end}}{{.a}}{{.missing}}{{.missing.key}}{{.null}}{{firstline .null}} {{with .b}}{{.c}}{{.d}}{{end}} {{template "b" .b}}`}},
+		"webhook.test", "/hook")
+	defer b.Disconnect(context.Background())
+	if code := post(t, b, "/hook", `{"a":"one","null":null,"b":{"c":"<no value>"}}`, nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	// the missing keys print nothing, the text of the payload is kept
+	if msg := bridgetest.Receive(t, c); msg.Text != "one <no value> <no value>" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+}
+
+func TestBuiltinTemplates(t *testing.T) {
+	for _, test := range []struct {
+		header, event, payload, want string
+	}{
+		{"X-GitHub-Event", "push", `{"ref":"refs/heads/old","deleted":true,"sender":{"login":"alice"},"repository":{"full_name":"o/r"},"commits":[]}`,
+			"alice deleted old of o/r"},
+		{"X-GitHub-Event", "pull_request", `{"action":"closed","sender":{"login":"bob"},"repository":{"full_name":"o/r"},
+			"pull_request":{"number":7,"merged":true,"title":"Add webhooks","html_url":"https://github.com/o/r/pull/7"}}`,
+			"bob merged pull request #7 in o/r: Add webhooks https://github.com/o/r/pull/7"},
+		{"X-GitHub-Event", "issue_comment", `{"action":"created","sender":{"login":"bob"},"repository":{"full_name":"o/r"},
+			"issue":{"number":3},"comment":{"body":"LGTM\nthanks","html_url":"https://github.com/o/r/issues/3#c1"}}`,
+			"bob commented on #3 in o/r: LGTM https://github.com/o/r/issues/3#c1"},
+		{"X-Gitlab-Event", "Merge Request Hook", `{"user":{"username":"carol"},"project":{"path_with_namespace":"g/p"},
+			"object_attributes":{"action":"open","iid":12,"title":"Fix CI","url":"https://gitlab.com/g/p/-/merge_requests/12"}}`,
+			"carol opened merge request !12 in g/p: Fix CI https://gitlab.com/g/p/-/merge_requests/12"},
+		{"X-Gitlab-Event", "Pipeline Hook", `{"project":{"path_with_namespace":"g/p","web_url":"https://gitlab.com/g/p"},
+			"object_attributes":{"id":1234567,"status":"failed","ref":"main"}}`,
+			"Pipeline #1234567 failed on main of g/p https://gitlab.com/g/p/-/pipelines/1234567"},
+		{"X-Gitlab-Event", "Pipeline Hook", `{"project":{"path_with_namespace":"g/p"},"object_attributes":{"id":1,"status":"running"}}`, ""},
+		{"X-Gitlab-Event", "Push Hook", `{"user_username":"carol","ref":"refs/heads/main","total_commits_count":1,
+			"project":{"path_with_namespace":"g/p"},"commits":[{"id":"abcdef0123","message":"Update README\n"}]}`,
+			"carol pushed 1 commit to main of g/p\n* Update README (abcdef0)"},
+		{"X-Gitea-Event", "push", `{"ref":"refs/tags/v1.0","sender":{"login":"dave"},"repository":{"full_name":"o/r"},"commits":[]}`,
+			"dave pushed v1.0 to o/r"},
+		{"X-Gitea-Event", "issues", `{"action":"opened","sender":{"login":"dave"},"repository":{"full_name":"o/r"},
+			"issue":{"number":5,"title":"Crash","html_url":"https://gitea.com/o/r/issues/5"}}`,
+			"dave opened issue #5 in o/r: Crash https://gitea.com/o/r/issues/5"},
+	} {
+		b, c := newBridge(t, config.Protocol{Settings: &Settings{Insecure: true}}, "webhook.test", "/hook")
+		header := map[string]string{test.header: test.event}
+		if test.header == "X-Gitea-Event" {
+			header["X-GitHub-Event"] = test.event
+		}
+		if code := post(t, b, "/hook", test.payload, header); code != http.StatusNoContent {
+			t.Errorf("%s %s: unexpected status %d", test.header, test.event, code)
+		}
+		switch {
+		case test.want == "" && len(c) != 0:
+			t.Errorf("%s %s: unexpected message %#v", test.header, test.event, <-c)
+		case test.want != "":
+			if msg := bridgetest.Receive(t, c); msg.Text != test.want {
+				t.Errorf("%s %s: expected %q, got %q", test.header, test.event, test.want, msg.Text)
+			}
+		}
+		b.Disconnect(context.Background())
+	}
+}
@@ -1,12 +1,18 @@
 package bxmpp
 
 import (
+	"context"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
 	log "github.com/Sirupsen/logrus"
 	"github.com/mattn/go-xmpp"
 	"crypto/tls"
+	"fmt"
+	"html"
 
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +22,9 @@ type Bxmpp struct {
 	Config  *config.Protocol
 	Remote  chan config.Message
 	Account string
+	pending map[string]chan xmpp.IQ // queries waiting for their result, by id
+	created map[string]bool         // rooms to configure when joined
+	sync.Mutex
 }
 
 var flog *log.Entry
@@ -23,11 +32,16 @@ var protocol = "xmpp"
 
 func init() {
 	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Server", "Jid", "Password", "Muc", "Nick"), AutoCreate: true})
 }
 
 func New(cfg config.Protocol, account string, c chan config.Message) *Bxmpp {
 	b := &Bxmpp{}
 	b.xmppMap = make(map[string]string)
+	b.pending = make(map[string]chan xmpp.IQ)
+	b.created = make(map[string]bool)
 	b.Config = &cfg
 	b.Account = account
 	b.Remote = c
@@ -47,15 +61,121 @@ func (b *Bxmpp) Connect() error {
 	return nil
 }
 
+func (b *Bxmpp) Disconnect(ctx context.Context) error {
+	if b.xc == nil {
+		return nil
+	}
+	status := b.Config.QuitMessage
+	if status == "" {
+		status = "matterbridge shutting down"
+	}
+	flog.Infof("Disconnecting %s", b.Config.Server)
+	b.xc.SendOrg(fmt.Sprintf("<presence type='unavailable'><status>%s</status></presence>", html.EscapeString(status)))
+	return b.xc.Close()
+}
+
+// JoinChannel joins the room, and configures it when CreateChannel found it
+// did not exist yet.
 func (b *Bxmpp) JoinChannel(channel string) error {
-	b.xc.JoinMUCNoHistory(channel+"@"+b.Config.Muc, b.Config.Nick)
+	room := channel + "@" + b.Config.Muc
+	b.xc.JoinMUCNoHistory(room, b.Config.Nick)
+	b.Lock()
+	create := b.created[channel]
+	delete(b.created, channel)
+	b.Unlock()
+	if !create {
+		return nil
+	}
+	// a new room stays locked until its owner configures it
+	_, err := b.xc.RawInformationQuery(b.xc.JID(), room, "create-"+channel, xmpp.IQTypeSet,
+		"http://jabber.org/protocol/muc#owner", fmt.Sprintf(roomConfig, html.EscapeString(channel)))
+	return err
+}
+
+// roomConfig is the configuration submitted for rooms we create,
+// a persistent room named after the channel.
+const roomConfig = `<x xmlns='jabber:x:data' type='submit'>` +
+	`<field var='FORM_TYPE'><value>http://jabber.org/protocol/muc#roomconfig</value></field>` +
+	`<field var='muc#roomconfig_roomname'><value>%s</value></field>` +
+	`<field var='muc#roomconfig_persistentroom'><value>1</value></field></x>`
+
+// CreateChannel creates the room if it does not exist. Joining a room creates
+// it, so the room is only marked to be configured by JoinChannel. Existing
+// rooms are left alone.
+func (b *Bxmpp) CreateChannel(channel string) error {
+	room := channel + "@" + b.Config.Muc
+	iq, err := b.query(room, "exists-"+channel, "http://jabber.org/protocol/disco#info")
+	if err != nil {
+		return err
+	}
+	if iq.Type != "error" {
+		return nil
+	}
+	flog.Infof("Creating room %s", room)
+	b.Lock()
+	b.created[channel] = true
+	b.Unlock()
 	return nil
 }
 
+// query sends an information query to jid and waits for its result.
+func (b *Bxmpp) query(jid string, id string, namespace string) (xmpp.IQ, error) {
+	c := make(chan xmpp.IQ, 1)
+	b.Lock()
+	b.pending[id] = c
+	b.Unlock()
+	defer func() {
+		b.Lock()
+		delete(b.pending, id)
+		b.Unlock()
+	}()
+	if _, err := b.xc.RawInformationQuery(b.xc.JID(), jid, id, xmpp.IQTypeGet, namespace, ""); err != nil {
+		return xmpp.IQ{}, err
+	}
+	select {
+	case iq := <-c:
+		return iq, nil
+	case <-time.After(10 * time.Second):
+		return xmpp.IQ{}, fmt.Errorf("no answer from %s", jid)
+	}
+}
+
 func (b *Bxmpp) Send(msg config.Message) error {
 	flog.Debugf("Receiving %#v", msg)
-	b.xc.Send(xmpp.Chat{Type: "groupchat", Remote: msg.Channel + "@" + b.Config.Muc, Text: msg.Username + msg.Text})
-	return nil
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
+	text := msg.Text
+	if msg.Event == config.EVENT_USER_ACTION {
+		text = "/me " + text
+	}
+	// colored nicks (ColorNicks) are sent using XHTML-IM, the irc formatting
+	// of messages relayed without it is dropped
+	if b.Config.ColorNicks && strings.Contains(text, "\x03") {
+		b.sendHTML(msg.Channel+"@"+b.Config.Muc, text)
+		return nil
+	}
+	text = helper.StripIRCFormatting(text)
+	_, err := b.xc.Send(xmpp.Chat{Type: "groupchat", Remote: msg.Channel + "@" + b.Config.Muc, Text: text})
+	return err
+}
+
+// Capabilities implements bridge.Capable. xmpp servers have no fixed limit,
+// messages are only split when MessageLength is set (leaving room for /me).
+func (b *Bxmpp) Capabilities() helper.Capabilities {
+	limit := helper.Limit{}
+	if b.Config.MessageLength > 0 {
+		limit.Max = b.Config.MessageLength - len("/me ")
+	}
+	return helper.Capabilities{Actions: true, Multiline: true, Limit: limit}
+}
+
+// sendHTML sends text with its irc colors converted to XHTML-IM (XEP-0071).
+func (b *Bxmpp) sendHTML(remote string, text string) {
+	htmlText, plain := helper.IRCColorsToHTML(text)
+	b.xc.SendOrg(fmt.Sprintf("<message to='%s' type='groupchat' xml:lang='en'><body>%s</body>"+
+		"<html xmlns='http://jabber.org/protocol/xhtml-im'><body xmlns='http://www.w3.org/1999/xhtml'>%s</body></html></message>",
+		html.EscapeString(remote), html.EscapeString(plain), htmlText))
 }
 
 func (b *Bxmpp) createXMPP() (*xmpp.Client, error) {
@@ -103,7 +223,6 @@ func (b *Bxmpp) xmppKeepAlive() chan bool {
 func (b *Bxmpp) handleXmpp() error {
 	done := b.xmppKeepAlive()
 	defer close(done)
-	nodelay := time.Time{}
 	for {
 		m, err := b.xc.Recv()
 		if err != nil {
@@ -121,11 +240,27 @@ func (b *Bxmpp) handleXmpp() error {
 				if len(s) == 2 {
 					nick = s[1]
 				}
-				if nick != b.Config.Nick && v.Stamp == nodelay && v.Text != "" {
+				if nick != b.Config.Nick && v.Text != "" {
 					flog.Debugf("Sending message from %s on %s to gateway", nick, b.Account)
-					b.Remote <- config.Message{Username: nick, Text: v.Text, Channel: channel, Account: b.Account}
+					rmsg := config.Message{Username: nick, Text: v.Text, Channel: channel, Account: b.Account, Timestamp: v.Stamp}
+					// messages without delay are live
+					if rmsg.Timestamp.IsZero() {
+						rmsg.Timestamp = time.Now()
+					}
+					if strings.HasPrefix(rmsg.Text, "/me ") {
+						rmsg.Text = strings.TrimPrefix(rmsg.Text, "/me ")
+						rmsg.Event = config.EVENT_USER_ACTION
+					}
+					b.Remote <- rmsg
 				}
 			}
+		case xmpp.IQ:
+			b.Lock()
+			c, ok := b.pending[v.ID]
+			b.Unlock()
+			if ok {
+				c <- v
+			}
 		case xmpp.Presence:
 			// do nothing
 		}
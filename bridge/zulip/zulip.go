@@ -0,0 +1,325 @@
+// Package bzulip bridges zulip streams and topics.
+//
+// The bridge uses the REST API as a bot (Login is the email of the bot, Token
+// its API key). It registers an event queue and long-polls it for messages,
+// registering a new queue when the server expired it.
+//
+// Channels are "stream/topic", or "stream" to receive the messages of all the
+// topics of the stream (messages are then sent to the "(no topic)" topic).
+package bzulip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Bzulip struct {
+	Config      *config.Protocol
+	Remote      chan config.Message
+	Account     string
+	client      *http.Client
+	email       string          // our email
+	channels    map[string]bool // joined channels
+	queueID     string
+	lastEventID int
+	cancel      context.CancelFunc
+	done        chan struct{} // closed when the poll loop ended
+	retryDelay  time.Duration // delay before polling again after an error
+	sync.Mutex
+}
+
+// apiError is an error returned by the server.
+type apiError struct {
+	Status     int
+	Result     string  `json:"result"`
+	Message    string  `json:"msg"`
+	Code       string  `json:"code"`
+	RetryAfter float64 `json:"retry-after"` // seconds, RATE_LIMIT_HIT
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s (%s, %d)", e.Message, e.Code, e.Status)
+}
+
+type registerResponse struct {
+	QueueID     string `json:"queue_id"`
+	LastEventID int    `json:"last_event_id"`
+}
+
+type eventsResponse struct {
+	Events []event `json:"events"`
+}
+
+type event struct {
+	ID      int      `json:"id"`
+	Type    string   `json:"type"`
+	Message *message `json:"message"`
+}
+
+type message struct {
+	Type           string          `json:"type"` // "stream" or "private"
+	SenderEmail    string          `json:"sender_email"`
+	SenderFullName string          `json:"sender_full_name"`
+	AvatarURL      string          `json:"avatar_url"`
+	Stream         json.RawMessage `json:"display_recipient"` // stream name, or the users of a private message
+	Topic          string          `json:"subject"`
+	Content        string          `json:"content"`
+	Timestamp      int64           `json:"timestamp"`
+}
+
+var flog *log.Entry
+var protocol = "zulip"
+
+const (
+	// messageLength is the maximum amount of characters in a zulip message
+	messageLength = 10000
+	// noTopic is the topic of the messages sent to a stream channel.
+	noTopic = "(no topic)"
+)
+
+func init() {
+	flog = log.WithFields(log.Fields{"module": protocol})
+	bridge.Register(protocol, func(cfg config.Protocol, account string, c chan config.Message) bridge.Bridger {
+		return New(cfg, account, c)
+	}, config.ProtocolInfo{Required: config.Require("Server", "Login", "Token")})
+}
+
+func New(cfg config.Protocol, account string, c chan config.Message) *Bzulip {
+	b := &Bzulip{}
+	b.Config = &cfg
+	b.Remote = c
+	b.Account = account
+	// the server holds the event requests up to 90 seconds
+	b.client = &http.Client{Timeout: 2 * time.Minute}
+	b.channels = make(map[string]bool)
+	b.done = make(chan struct{})
+	b.retryDelay = 10 * time.Second
+	return b
+}
+
+// Connect checks the credentials, registers the event queue and starts polling it.
+func (b *Bzulip) Connect() error {
+	flog.Infof("Connecting %s", b.Config.Server)
+	ctx, cancel := context.WithCancel(context.Background())
+	var me struct {
+		Email string `json:"email"`
+	}
+	if err := b.do(ctx, "GET", "/users/me", nil, &me); err != nil {
+		cancel()
+		return err
+	}
+	b.email = me.Email
+	if err := b.register(ctx); err != nil {
+		cancel()
+		return err
+	}
+	flog.Info("Connection succeeded")
+	b.cancel = cancel
+	go b.poll(ctx)
+	return nil
+}
+
+// Disconnect stops polling and deletes the event queue.
+func (b *Bzulip) Disconnect(ctx context.Context) error {
+	if b.cancel == nil {
+		return nil
+	}
+	b.cancel()
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	b.Lock()
+	queueID := b.queueID
+	b.Unlock()
+	return b.do(ctx, "DELETE", "/events", url.Values{"queue_id": {queueID}}, nil)
+}
+
+// JoinChannel subscribes to the stream of channel ("stream" or "stream/topic").
+func (b *Bzulip) JoinChannel(channel string) error {
+	stream, _ := splitChannel(channel)
+	subscriptions, _ := json.Marshal([]map[string]string{{"name": stream}})
+	err := b.do(context.Background(), "POST", "/users/me/subscriptions", url.Values{"subscriptions": {string(subscriptions)}}, nil)
+	if err != nil {
+		return fmt.Errorf("subscribing to %s failed: %s", stream, err)
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.channels[channel] = true
+	return nil
+}
+
+// Send sends msg as the bot, the gateway prefixes the remote nick.
+func (b *Bzulip) Send(msg config.Message) error {
+	flog.Debugf("Receiving %#v", msg)
+	// the bot can not show typing of others
+	if msg.Event == config.EVENT_USER_TYPING {
+		return nil
+	}
+	stream, topic := splitChannel(msg.Channel)
+	if topic == "" {
+		topic = noTopic
+	}
+	content := msg.Text
+	if msg.Event == config.EVENT_USER_ACTION {
+		content = "/me " + content
+	}
+	form := url.Values{"type": {"stream"}, "to": {stream}, "topic": {topic}, "content": {content}}
+	return b.do(context.Background(), "POST", "/messages", form, nil)
+}
+
+// Capabilities implements bridge.Capable, actions are sent as /me messages.
+func (b *Bzulip) Capabilities() helper.Capabilities {
+	return helper.Capabilities{Actions: true, Multiline: true, Markup: helper.MarkupMarkdown,
+		Limit: helper.Limit{Max: messageLength}}
+}
+
+// splitChannel returns the stream and the topic of channel.
+func splitChannel(channel string) (string, string) {
+	if i := strings.Index(channel, "/"); i != -1 {
+		return channel[:i], channel[i+1:]
+	}
+	return channel, ""
+}
+
+// register registers a new event queue for the messages.
+func (b *Bzulip) register(ctx context.Context) error {
+	form := url.Values{"event_types": {`["message"]`}, "apply_markdown": {"false"}, "client_gravatar": {"false"}}
+	var resp registerResponse
+	if err := b.do(ctx, "POST", "/register", form, &resp); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.queueID = resp.QueueID
+	b.lastEventID = resp.LastEventID
+	return nil
+}
+
+// poll receives the events of the queue until ctx is done.
+func (b *Bzulip) poll(ctx context.Context) {
+	defer close(b.done)
+	for {
+		b.Lock()
+		query := url.Values{"queue_id": {b.queueID}, "last_event_id": {strconv.Itoa(b.lastEventID)}}
+		b.Unlock()
+		var resp eventsResponse
+		err := b.do(ctx, "GET", "/events", query, &resp)
+		if ctx.Err() != nil {
+			return
+		}
+		if apiErr, ok := err.(*apiError); ok && apiErr.Code == "BAD_EVENT_QUEUE_ID" {
+			flog.Info("event queue expired, registering a new one")
+			err = b.register(ctx)
+		}
+		if err != nil {
+			delay := b.retryDelay
+			if apiErr, ok := err.(*apiError); ok && apiErr.RetryAfter > 0 {
+				delay = time.Duration(apiErr.RetryAfter * float64(time.Second))
+			}
+			flog.Errorf("receiving events failed: %s, retrying in %s", err, delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		for _, ev := range resp.Events {
+			b.Lock()
+			b.lastEventID = ev.ID
+			b.Unlock()
+			if ev.Type == "message" && ev.Message != nil {
+				b.handleMessage(ev.Message)
+			}
+		}
+	}
+}
+
+// handleMessage sends a stream message to the gateway, on the "stream/topic"
+// channel or else the "stream" channel.
+func (b *Bzulip) handleMessage(m *message) {
+	if m.Type != "stream" || m.SenderEmail == b.email {
+		return
+	}
+	var stream string
+	if err := json.Unmarshal(m.Stream, &stream); err != nil {
+		flog.Debugf("invalid stream %s: %s", m.Stream, err)
+		return
+	}
+	channel := stream + "/" + m.Topic
+	b.Lock()
+	if !b.channels[channel] {
+		channel = stream
+	}
+	joined := b.channels[channel]
+	b.Unlock()
+	if !joined {
+		return
+	}
+	msg := config.Message{Username: m.SenderFullName, Channel: channel, Account: b.Account, Text: m.Content,
+		Avatar: m.AvatarURL, Timestamp: time.Unix(m.Timestamp, 0)}
+	if strings.HasPrefix(msg.Text, "/me ") {
+		msg.Text = strings.TrimPrefix(msg.Text, "/me ")
+		msg.Event = config.EVENT_USER_ACTION
+	}
+	flog.Debugf("Sending message from %s on %s to gateway", msg.Username, b.Account)
+	b.Remote <- msg
+}
+
+// do sends a request to the API endpoint path, with form as query (GET,
+// DELETE) or body. The answer is decoded in out.
+func (b *Bzulip) do(ctx context.Context, method string, path string, form url.Values, out interface{}) error {
+	u := strings.TrimRight(b.Config.Server, "/") + "/api/v1" + path
+	var body string
+	if method == "GET" || method == "DELETE" {
+		if len(form) > 0 {
+			u += "?" + form.Encode()
+		}
+	} else {
+		body = form.Encode()
+	}
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(b.Config.Login, b.Config.Token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &apiError{Status: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = resp.Status
+		}
+		if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+			apiErr.RetryAfter = seconds
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
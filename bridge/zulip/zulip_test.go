@@ -0,0 +1,152 @@
+package bzulip
+
+import (
+	"context"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper/bridgetest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// server is a stub of the zulip API.
+type server struct {
+	*httptest.Server
+	events    chan string // events (JSON arrays) returned by /events
+	sent      chan url.Values
+	mu        sync.Mutex
+	queues    int  // registered queues
+	expire    bool // the next events request finds an expired queue
+	deleted   []string
+	subscribe []string
+}
+
+func newServer(t *testing.T) *server {
+	s := &server{events: make(chan string, 10), sent: make(chan url.Values, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if user, key, ok := r.BasicAuth(); !ok || user != "bot@test" || key != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"result":"error","msg":"Invalid API key","code":"UNAUTHORIZED"}`))
+			return
+		}
+		r.ParseForm()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/v1/users/me":
+			w.Write([]byte(`{"result":"success","email":"bot@test"}`))
+		case "POST /api/v1/register":
+			s.queues++
+			w.Write([]byte(`{"result":"success","queue_id":"q` + strconv.Itoa(s.queues) + `","last_event_id":-1}`))
+		case "POST /api/v1/users/me/subscriptions":
+			s.subscribe = append(s.subscribe, r.Form.Get("subscriptions"))
+			w.Write([]byte(`{"result":"success"}`))
+		case "POST /api/v1/messages":
+			s.sent <- r.PostForm
+			w.Write([]byte(`{"result":"success","id":1}`))
+		case "DELETE /api/v1/events":
+			s.deleted = append(s.deleted, r.Form.Get("queue_id"))
+			w.Write([]byte(`{"result":"success"}`))
+		case "GET /api/v1/events":
+			if s.expire || r.Form.Get("queue_id") != "q"+strconv.Itoa(s.queues) {
+				s.expire = false
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"result":"error","msg":"Bad event queue id","code":"BAD_EVENT_QUEUE_ID"}`))
+				return
+			}
+			s.mu.Unlock()
+			events := "[]"
+			select {
+			case events = <-s.events:
+			case <-time.After(50 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+			s.mu.Lock()
+			w.Write([]byte(`{"result":"success","events":` + events + `}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func TestZulip(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	c := make(chan config.Message, 10)
+	b := New(config.Protocol{Server: s.URL, Login: "bot@test", Token: "key"}, "zulip.test", c)
+	b.retryDelay = 10 * time.Millisecond
+	if err := b.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	b.JoinChannel("general/chat")
+	b.JoinChannel("announce")
+	s.mu.Lock()
+	if len(s.subscribe) != 2 || s.subscribe[0] != `[{"name":"general"}]` {
+		t.Errorf("unexpected subscriptions %q", s.subscribe)
+	}
+	s.mu.Unlock()
+
+	s.events <- `[
+		{"id":0,"type":"heartbeat"},
+		{"id":1,"type":"message","message":{"type":"stream","sender_email":"alice@test","sender_full_name":"Alice",
+			"display_recipient":"general","subject":"chat","content":"hello **all**","timestamp":1500000000}},
+		{"id":2,"type":"message","message":{"type":"stream","sender_email":"bot@test","sender_full_name":"Bot",
+			"display_recipient":"general","subject":"chat","content":"echo"}},
+		{"id":3,"type":"message","message":{"type":"stream","sender_email":"bob@test","sender_full_name":"Bob",
+			"display_recipient":"general","subject":"other","content":"not joined"}},
+		{"id":4,"type":"message","message":{"type":"stream","sender_email":"bob@test","sender_full_name":"Bob",
+			"display_recipient":"announce","subject":"release","content":"/me ships it"}}
+	]`
+	msg := bridgetest.Receive(t, c)
+	if msg.Text != "hello **all**" || msg.Username != "Alice" || msg.Channel != "general/chat" || msg.Timestamp.Unix() != 1500000000 {
+		t.Errorf("unexpected message %#v", msg)
+	}
+	if msg = bridgetest.Receive(t, c); msg.Text != "ships it" || msg.Event != config.EVENT_USER_ACTION || msg.Channel != "announce" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+
+	// an expired queue is registered again
+	s.mu.Lock()
+	s.expire = true
+	s.mu.Unlock()
+	s.events <- `[{"id":0,"type":"message","message":{"type":"stream","sender_email":"alice@test","sender_full_name":"Alice",
+		"display_recipient":"general","subject":"chat","content":"again"}}]`
+	if msg = bridgetest.Receive(t, c); msg.Text != "again" {
+		t.Errorf("unexpected message %#v", msg)
+	}
+
+	b.Send(config.Message{Channel: "general/chat", Text: "**<irc> bob**: hi"})
+	if form := <-s.sent; form.Get("to") != "general" || form.Get("topic") != "chat" || form.Get("content") != "**<irc> bob**: hi" || form.Get("type") != "stream" {
+		t.Errorf("unexpected message %v", form)
+	}
+	b.Send(config.Message{Channel: "announce", Text: "waves", Event: config.EVENT_USER_ACTION})
+	if form := <-s.sent; form.Get("to") != "announce" || form.Get("topic") != noTopic || form.Get("content") != "/me waves" {
+		t.Errorf("unexpected message %v", form)
+	}
+
+	if err := b.Disconnect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queues != 2 || len(s.deleted) != 1 || s.deleted[0] != "q2" {
+		t.Errorf("expected 2 queues and q2 deleted, got %d queues, deleted %q", s.queues, s.deleted)
+	}
+}
+
+func TestZulipInvalidKey(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+	b := New(config.Protocol{Server: s.URL, Login: "bot@test", Token: "wrong"}, "zulip.test", nil)
+	if err := b.Connect(); err == nil || err.Error() != "Invalid API key (UNAUTHORIZED, 401)" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
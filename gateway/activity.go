@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"time"
+)
+
+// activityKey is a user on a channel of an account.
+type activityKey struct {
+	account, channel, nick string
+}
+
+type activity struct {
+	last time.Time // time of the last message
+	away bool      // the away event is sent
+}
+
+// Activity remembers when the users of a gateway last spoke, for
+// JoinPartActive and AwayAfter. It is used by the goroutine relaying the
+// messages only.
+type Activity struct {
+	users      map[activityKey]*activity
+	expiry     time.Duration // how long users are remembered, 0 when not needed
+	identities helper.Identities
+}
+
+// NewActivity returns an Activity remembering the users for expiry.
+// Nothing is remembered when expiry is 0. The nicks of identities are the
+// same user on the different accounts.
+func NewActivity(expiry time.Duration, identities helper.Identities) *Activity {
+	return &Activity{users: make(map[activityKey]*activity), expiry: expiry, identities: identities}
+}
+
+// JoinPartActive returns the JoinPartActive of the account cfg, or else of the
+// general section. It is 0 when every join/part is shown.
+func JoinPartActive(cfg config.Protocol, general config.Protocol) time.Duration {
+	if cfg.JoinPartActive != 0 {
+		return time.Duration(cfg.JoinPartActive) * time.Minute
+	}
+	return time.Duration(general.JoinPartActive) * time.Minute
+}
+
+// ActivityWindow returns how long the activity of users is needed: the longest
+// JoinPartActive of bridges or awayAfter. It is 0 when activity is not used.
+func ActivityWindow(bridges map[string]*bridge.Bridge, general config.Protocol, awayAfter time.Duration) time.Duration {
+	window := awayAfter
+	for _, br := range bridges {
+		if w := JoinPartActive(br.Config, general); w > window {
+			window = w
+		}
+	}
+	return window
+}
+
+// Update remembers when the sender of msg last spoke.
+func (a *Activity) Update(msg config.Message) {
+	if a.expiry == 0 || msg.Username == "" || msg.Event != "" && msg.Event != config.EVENT_USER_ACTION {
+		return
+	}
+	key := activityKey{msg.Account, msg.Channel, msg.Username}
+	if u, ok := a.users[key]; ok {
+		u.last, u.away = time.Now(), false
+		return
+	}
+	a.users[key] = &activity{last: time.Now()}
+}
+
+// Active returns msg with only the users who spoke within window, and false
+// if none of them did. Users are active when they spoke on the channel of msg
+// (any channel of their account for events without channel), or on another
+// account where they have a nick listed in the same identity. The text naming
+// the users (eg "alice and bob quit") is rebuilt. Events without users are
+// always active.
+func (a *Activity) Active(msg config.Message, window time.Duration) (config.Message, bool) {
+	if len(msg.Nicks) == 0 {
+		return msg, true
+	}
+	var active []string
+	for _, nick := range msg.Nicks {
+		if a.spoke(msg, nick, window) {
+			active = append(active, nick)
+		}
+	}
+	if len(active) == 0 {
+		return msg, false
+	}
+	if len(active) < len(msg.Nicks) {
+		for _, verb := range helper.JoinPartVerbs {
+			if msg.Text == helper.JoinPartText(msg.Nicks, verb) {
+				msg.Text = helper.JoinPartText(active, verb)
+				break
+			}
+		}
+		msg.Nicks = active
+	}
+	return msg, true
+}
+
+func (a *Activity) spoke(msg config.Message, nick string, window time.Duration) bool {
+	for key, u := range a.users {
+		if time.Since(u.last) > window || !a.identities.Same(key.account, key.nick, msg.Account, nick) {
+			continue
+		}
+		if key.account != msg.Account || msg.Channel == "" || key.channel == msg.Channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Check forgets the users that are not needed anymore and returns the away
+// events of the users who did not speak for awayAfter (none when 0).
+func (a *Activity) Check(now time.Time, awayAfter time.Duration) []config.Message {
+	var away []config.Message
+	for key, u := range a.users {
+		idle := now.Sub(u.last)
+		if awayAfter > 0 && !u.away && idle >= awayAfter {
+			u.away = true
+			away = append(away, config.Message{Username: "system", Text: key.nick + " is now away", Channel: key.channel,
+				Account: key.account, Event: config.EVENT_AWAY, Nicks: []string{key.nick}})
+		}
+		if idle > a.expiry {
+			delete(a.users, key)
+		}
+	}
+	return away
+}
@@ -1,12 +1,16 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/42wim/matterbridge/gateway/record"
 	log "github.com/Sirupsen/logrus"
-	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 type Gateway struct {
@@ -18,8 +22,19 @@ type Gateway struct {
 	ChannelsIn     map[string][]string
 	ignoreNicks    map[string][]string
 	ChannelOptions map[string]config.ChannelOptions
+	patterns       []patternBridge // bridges with a channel pattern or template
+	routes         []route         // channels mapped by patterns
+	joined         map[string]bool // account+channel joined
+	newNames       chan []string
+	channelRefresh time.Duration
+	activity       *Activity // last message of the users
+	activityCheck  time.Duration
+	awayAfter      time.Duration
 	Name           string
 	Message        chan config.Message
+	Recorder       *record.Recorder // records the relayed messages when set
+	stop           chan struct{}
+	stopped        chan struct{}
 }
 
 func New(cfg *config.Config, gateway *config.Gateway) *Gateway {
@@ -28,7 +43,17 @@ func New(cfg *config.Config, gateway *config.Gateway) *Gateway {
 	gw.Config = cfg
 	gw.MyConfig = gateway
 	gw.Message = make(chan config.Message)
+	gw.stop = make(chan struct{})
+	gw.stopped = make(chan struct{})
 	gw.Bridges = make(map[string]*bridge.Bridge)
+	gw.joined = make(map[string]bool)
+	gw.newNames = make(chan []string)
+	gw.activityCheck = time.Minute
+	gw.awayAfter = time.Duration(cfg.General.AwayAfter) * time.Minute
+	gw.channelRefresh = time.Minute
+	if cfg.General.ChannelRefresh != 0 {
+		gw.channelRefresh = time.Duration(cfg.General.ChannelRefresh) * time.Second
+	}
 	return gw
 }
 
@@ -39,26 +64,44 @@ func (gw *Gateway) AddBridge(cfg *config.Bridge) error {
 		}
 	}
 	log.Infof("Starting bridge: %s ", cfg.Account)
-	br := bridge.New(gw.Config, cfg, gw.Message)
+	br, err := bridge.New(gw.Config, cfg, gw.Message)
+	if err != nil {
+		return err
+	}
 	gw.Bridges[cfg.Account] = br
-	err := br.Connect()
+	err = br.Connect()
 	if err != nil {
 		return fmt.Errorf("Bridge %s failed to start: %v", br.Account, err)
 	}
-	exists := make(map[string]bool)
 	for _, channel := range append(gw.ChannelsOut[br.Account], gw.ChannelsIn[br.Account]...) {
-		if !exists[br.Account+channel] {
-			mychannel := channel
-			log.Infof("%s: joining %s", br.Account, channel)
-			if br.Protocol == "irc" && gw.ChannelOptions[br.Account+channel].Key != "" {
-				log.Debugf("using key %s for channel %s", gw.ChannelOptions[br.Account+channel].Key, channel)
-				mychannel = mychannel + " " + gw.ChannelOptions[br.Account+channel].Key
+		gw.joinChannel(br, channel)
+	}
+	return nil
+}
+
+func (gw *Gateway) joinChannel(br *bridge.Bridge, channel string) {
+	if gw.joined[br.Account+channel] {
+		return
+	}
+	gw.joined[br.Account+channel] = true
+	if gw.ChannelOptions[br.Account+channel].AutoCreate {
+		if creator, ok := br.Bridger.(bridge.ChannelCreator); ok {
+			if err := creator.CreateChannel(channel); err != nil {
+				log.Errorf("%s: creating %s failed: %s", br.Account, channel, err)
 			}
-			br.JoinChannel(mychannel)
-			exists[br.Account+channel] = true
+		} else {
+			log.Errorf("%s: can not create channels, AutoCreate of %s is ignored", br.Account, channel)
 		}
 	}
-	return nil
+	mychannel := channel
+	log.Infof("%s: joining %s", br.Account, channel)
+	if br.Protocol == "irc" && gw.ChannelOptions[br.Account+channel].Key != "" {
+		log.Debugf("using key %s for channel %s", gw.ChannelOptions[br.Account+channel].Key, channel)
+		mychannel = mychannel + " " + gw.ChannelOptions[br.Account+channel].Key
+	}
+	if err := br.JoinChannel(mychannel); err != nil {
+		log.Errorf("%s: joining %s failed: %s", br.Account, channel, err)
+	}
 }
 
 func (gw *Gateway) Start() error {
@@ -69,78 +112,141 @@ func (gw *Gateway) Start() error {
 			return err
 		}
 	}
-	//TODO fix mapIgnores
-	//gw.mapIgnores()
+	gw.mapIgnores()
+	if err := gw.startPatterns(); err != nil {
+		return err
+	}
+	// checked when loading the config
+	identities, _ := helper.ParseIdentities(gw.Config.General.Identities)
+	gw.activity = NewActivity(ActivityWindow(gw.Bridges, gw.Config.General, gw.awayAfter), identities)
 	go gw.handleReceive()
 	return nil
 }
 
+// Stop stops relaying messages and disconnects the bridges after they have
+// sent their queued messages. It gives up waiting when ctx is done.
+func (gw *Gateway) Stop(ctx context.Context) {
+	close(gw.stop)
+	// wait for the message being relayed
+	select {
+	case <-gw.stopped:
+	case <-ctx.Done():
+	}
+	var wg sync.WaitGroup
+	for _, br := range gw.Bridges {
+		wg.Add(1)
+		go func(br *bridge.Bridge) {
+			defer wg.Done()
+			log.Infof("Stopping bridge: %s", br.Account)
+			if err := br.Disconnect(ctx); err != nil {
+				log.Errorf("Bridge %s failed to disconnect: %v", br.Account, err)
+			}
+		}(br)
+	}
+	wg.Wait()
+}
+
 func (gw *Gateway) handleReceive() {
+	defer close(gw.stopped)
+	var check <-chan time.Time
+	if gw.activity.expiry > 0 {
+		ticker := time.NewTicker(gw.activityCheck)
+		defer ticker.Stop()
+		check = ticker.C
+	}
 	for {
 		select {
 		case msg := <-gw.Message:
-			for _, br := range gw.Bridges {
-				gw.handleMessage(msg, br)
+			if msg.Timestamp.IsZero() {
+				msg.Timestamp = time.Now()
+			}
+			gw.record(record.In, msg.Account, msg)
+			gw.activity.Update(msg)
+			gw.relay(msg)
+		case names := <-gw.newNames:
+			gw.addRoutes(names)
+		case <-check:
+			for _, away := range gw.activity.Check(time.Now(), gw.awayAfter) {
+				gw.relay(away)
 			}
+		case <-gw.stop:
+			return
 		}
 	}
 }
 
+// relay sends msg to every bridge of the gateway.
+func (gw *Gateway) relay(msg config.Message) {
+	for _, br := range gw.Bridges {
+		gw.handleMessage(msg, br)
+	}
+}
+
 func (gw *Gateway) mapChannels() error {
 	options := make(map[string]config.ChannelOptions)
-	m := make(map[string][]string)
-	for _, br := range gw.MyConfig.Out {
-		m[br.Account] = append(m[br.Account], br.Channel)
-		options[br.Account+br.Channel] = br.Options
-	}
-	gw.ChannelsOut = m
-	m = nil
-	m = make(map[string][]string)
-	for _, br := range gw.MyConfig.In {
-		m[br.Account] = append(m[br.Account], br.Channel)
-		options[br.Account+br.Channel] = br.Options
-	}
-	gw.ChannelsIn = m
-	for _, br := range gw.MyConfig.InOut {
-		gw.ChannelsIn[br.Account] = append(gw.ChannelsIn[br.Account], br.Channel)
-		gw.ChannelsOut[br.Account] = append(gw.ChannelsOut[br.Account], br.Channel)
-		options[br.Account+br.Channel] = br.Options
+	in := make(map[string][]string)
+	out := make(map[string][]string)
+	for _, dir := range []struct {
+		bridges []config.Bridge
+		in, out bool
+	}{{gw.MyConfig.Out, false, true}, {gw.MyConfig.In, true, false}, {gw.MyConfig.InOut, true, true}} {
+		for _, br := range dir.bridges {
+			if isPattern(br.Channel) {
+				gw.patterns = append(gw.patterns, patternBridge{Bridge: br, in: dir.in, out: dir.out})
+				continue
+			}
+			if dir.in {
+				in[br.Account] = append(in[br.Account], br.Channel)
+			}
+			if dir.out {
+				out[br.Account] = append(out[br.Account], br.Channel)
+			}
+			options[br.Account+br.Channel] = br.Options
+		}
 	}
+	gw.ChannelsIn = in
+	gw.ChannelsOut = out
 	gw.ChannelOptions = options
 	return nil
 }
 
 func (gw *Gateway) mapIgnores() {
 	m := make(map[string][]string)
-	for _, br := range gw.MyConfig.In {
-		accInfo := strings.Split(br.Account, ".")
-		m[br.Account] = strings.Fields(gw.Config.IRC[accInfo[1]].IgnoreNicks)
+	for _, br := range gw.Bridges {
+		m[br.Account] = strings.Fields(br.Config.IgnoreNicks)
 	}
 	gw.ignoreNicks = m
 }
 
 func (gw *Gateway) getDestChannel(msg *config.Message, dest string) []string {
-	channels := gw.ChannelsIn[msg.Account]
-	// broadcast to every out channel (irc QUIT)
-	if msg.Event == config.EVENT_JOIN_LEAVE && msg.Channel == "" {
-		return gw.ChannelsOut[dest]
-	}
-	for _, channel := range channels {
-		if channel == msg.Channel {
-			return gw.ChannelsOut[dest]
+	// events without channel are broadcasted to every out channel (irc QUIT, NICK)
+	broadcast := msg.Event != "" && msg.Channel == ""
+	var channels []string
+	for _, r := range gw.allRoutes() {
+		if broadcast || r.hasIn(msg.Account, msg.Channel) {
+			channels = appendUnique(channels, r.out[dest]...)
 		}
 	}
-	return []string{}
+	return channels
 }
 
 func (gw *Gateway) handleMessage(msg config.Message, dest *bridge.Bridge) {
 	if gw.ignoreMessage(&msg) {
 		return
 	}
+	if !config.RelayEvent(gw.MyConfig.Events, msg.Event) {
+		return
+	}
 	// only relay join/part when configged
 	if msg.Event == config.EVENT_JOIN_LEAVE && !gw.Bridges[dest.Account].Config.ShowJoinPart {
 		return
 	}
+	if window := JoinPartActive(dest.Config, gw.Config.General); msg.Event == config.EVENT_JOIN_LEAVE && window > 0 {
+		var active bool
+		if msg, active = gw.activity.Active(msg, window); !active {
+			return
+		}
+	}
 	originchannel := msg.Channel
 	channels := gw.getDestChannel(&msg, dest.Account)
 	for _, channel := range channels {
@@ -148,14 +254,18 @@ func (gw *Gateway) handleMessage(msg config.Message, dest *bridge.Bridge) {
 		if msg.Account == dest.Account && channel == originchannel {
 			continue
 		}
-		msg.Channel = channel
-		if msg.Channel == "" {
+		if channel == "" {
 			log.Debug("empty channel")
 			return
 		}
-		log.Debugf("Sending %#v from %s (%s) to %s (%s)", msg, msg.Account, originchannel, dest.Account, channel)
-		gw.modifyUsername(&msg, dest)
-		err := dest.Send(msg)
+		// work on a copy, the username is formatted for every channel
+		m := msg
+		m.Channel = channel
+		log.Debugf("Sending %#v from %s (%s) to %s (%s)", m, m.Account, originchannel, dest.Account, channel)
+		Relay{Gateway: gw.Name, General: gw.Config.General, Source: gw.Bridges[msg.Account], Dest: dest,
+			Channel: originchannel, Options: gw.ChannelOptions[dest.Account+channel]}.Prepare(&m)
+		gw.record(record.Out, dest.Account, m)
+		err := dest.Send(m)
 		if err != nil {
 			fmt.Println(err)
 		}
@@ -172,29 +282,8 @@ func (gw *Gateway) ignoreMessage(msg *config.Message) bool {
 	return false
 }
 
-func (gw *Gateway) modifyMessage(msg *config.Message, dest *bridge.Bridge) {
-	val := reflect.ValueOf(gw.Config).Elem()
-	for i := 0; i < val.NumField(); i++ {
-		typeField := val.Type().Field(i)
-		// look for the protocol map (both lowercase)
-		if strings.ToLower(typeField.Name) == dest.Protocol {
-			// get the Protocol struct from the map
-			protoCfg := val.Field(i).MapIndex(reflect.ValueOf(dest.Name))
-			//config.SetNickFormat(msg, protoCfg.Interface().(config.Protocol))
-			val.Field(i).SetMapIndex(reflect.ValueOf(dest.Name), protoCfg)
-			break
-		}
+func (gw *Gateway) record(direction string, account string, msg config.Message) {
+	if err := gw.Recorder.Record(direction, gw.Name, account, msg); err != nil {
+		log.Errorf("recording message failed: %s", err)
 	}
 }
-
-func (gw *Gateway) modifyUsername(msg *config.Message, dest *bridge.Bridge) {
-	br := gw.Bridges[msg.Account]
-	nick := gw.Config.General.RemoteNickFormat
-	if nick == "" {
-		nick = dest.Config.RemoteNickFormat
-	}
-	nick = strings.Replace(nick, "{NICK}", msg.Username, -1)
-	nick = strings.Replace(nick, "{BRIDGE}", br.Name, -1)
-	nick = strings.Replace(nick, "{PROTOCOL}", br.Protocol, -1)
-	msg.Username = nick
-}
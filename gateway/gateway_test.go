@@ -0,0 +1,396 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"github.com/42wim/matterbridge/gateway/record"
+	"testing"
+	"time"
+)
+
+const timeout = time.Second
+
+func newConfig() *config.Config {
+	return &config.Config{Protocols: map[string]map[string]config.Protocol{"loopback": {
+		"a": {RemoteNickFormat: "<{{.Nick}}> "},
+		"b": {RemoteNickFormat: "[{{.Protocol}}.{{.Bridge}}] <{{.Nick}}> "},
+		"c": {},
+	}}}
+}
+
+func startGateway(t *testing.T, cfg *config.Config, gwcfg config.Gateway) *Gateway {
+	gw := New(cfg, &gwcfg)
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func loopback(gw *Gateway, account string) *bloopback.Bloopback {
+	return gw.Bridges[account].Bridger.(*bloopback.Bloopback)
+}
+
+// flush returns the messages sent to the bridge to, after every message
+// injected before on the bridge from is handled.
+func flush(gw *Gateway, from string, to string) []config.Message {
+	// the gateway handles the messages in order, when it has read the marker
+	// every message before it is handled. The marker itself is not relayed.
+	loopback(gw, from).Inject(config.Message{Username: "marker", Text: "marker"})
+	return loopback(gw, to).Sent()
+}
+
+func TestInOutRouting(t *testing.T) {
+	gw := startGateway(t, newConfig(), config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	a, b := loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a"})
+	sent := b.WaitSent(1, timeout)
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 message on b, got %#v", sent)
+	}
+	if sent[0].Channel != "b" || sent[0].Text != "hello" || sent[0].Username != "[loopback.a] <alice> " {
+		t.Errorf("unexpected message %#v", sent[0])
+	}
+	if sent := flush(gw, "loopback.b", "loopback.a"); len(sent) != 0 {
+		t.Errorf("message echoed to its origin: %#v", sent)
+	}
+}
+
+func TestInOnlyAndOutOnly(t *testing.T) {
+	gw := startGateway(t, newConfig(), config.Gateway{Name: "test", Enable: true,
+		In:    []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.c", Channel: "c"}},
+		Out:   []config.Bridge{{Account: "loopback.b", Channel: "b"}},
+		InOut: []config.Bridge{{Account: "loopback.c", Channel: "c2"}}})
+	a, b := loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	// b is only an out bridge, its messages are not relayed
+	b.Inject(config.Message{Username: "bob", Text: "from b", Channel: "b"})
+	if sent := flush(gw, "loopback.a", "loopback.c"); len(sent) != 0 {
+		t.Errorf("message from out bridge relayed: %#v", sent)
+	}
+	// a is only an in bridge, it receives nothing
+	a.Reset()
+	loopback(gw, "loopback.c").Inject(config.Message{Username: "carol", Text: "from c", Channel: "c"})
+	sent := b.WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Text != "from c" {
+		t.Fatalf("expected message from c on b, got %#v", sent)
+	}
+	if len(a.Sent()) != 0 {
+		t.Errorf("message sent to in bridge: %#v", a.Sent())
+	}
+}
+
+func TestSameAccountOtherChannel(t *testing.T) {
+	gw := startGateway(t, newConfig(), config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#one"}, {Account: "loopback.a", Channel: "#two"}}})
+	a := loopback(gw, "loopback.a")
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "#one"})
+	sent := a.WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Channel != "#two" {
+		t.Fatalf("expected the message on #two only, got %#v", sent)
+	}
+}
+
+func TestUnknownChannel(t *testing.T) {
+	gw := startGateway(t, newConfig(), config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "alice", Text: "hello", Channel: "#other"})
+	if sent := flush(gw, "loopback.a", "loopback.b"); len(sent) != 0 {
+		t.Errorf("message from unconfigured channel relayed: %#v", sent)
+	}
+}
+
+func TestJoinLeave(t *testing.T) {
+	cfg := newConfig()
+	cfg.SetAccount("loopback.b", config.Protocol{ShowJoinPart: true})
+	gw := startGateway(t, cfg, config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b1"},
+			{Account: "loopback.b", Channel: "b2"}, {Account: "loopback.c", Channel: "c"}}})
+	// an irc QUIT has no channel and is broadcasted to every out channel
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "system", Text: "alice quits", Event: config.EVENT_JOIN_LEAVE})
+	sent := loopback(gw, "loopback.b").WaitSent(2, timeout)
+	if len(sent) != 2 || sent[0].Channel == sent[1].Channel {
+		t.Fatalf("expected the quit on b1 and b2, got %#v", sent)
+	}
+	// c has ShowJoinPart disabled
+	if sent := flush(gw, "loopback.a", "loopback.c"); len(sent) != 0 {
+		t.Errorf("join/leave relayed without ShowJoinPart: %#v", sent)
+	}
+}
+
+func TestIgnoreNicks(t *testing.T) {
+	cfg := newConfig()
+	cfg.SetAccount("loopback.a", config.Protocol{IgnoreNicks: "spammer bot"})
+	gw := startGateway(t, cfg, config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	a := loopback(gw, "loopback.a")
+	a.Inject(config.Message{Username: "spammer", Text: "buy", Channel: "#a"})
+	a.Inject(config.Message{Username: "bot", Text: "beep", Channel: "#a"})
+	if sent := flush(gw, "loopback.a", "loopback.b"); len(sent) != 0 {
+		t.Errorf("ignored nick relayed: %#v", sent)
+	}
+}
+
+func TestNickFormatPrecedence(t *testing.T) {
+	cfg := newConfig()
+	cfg.General.RemoteNickFormat = "general "
+	cfg.SetAccount("loopback.c", config.Protocol{})
+	gw := startGateway(t, cfg, config.Gateway{Name: "gw", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"},
+			{Account: "loopback.b", Channel: "b"},
+			{Account: "loopback.b", Channel: "b2", Options: config.ChannelOptions{RemoteNickFormat: "{{.Gateway}}/{{.Channel}} {NICK}: "}},
+			{Account: "loopback.c", Channel: "c"}}})
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a"})
+	expected := map[string]string{"b": "[loopback.a] <alice> ", "b2": "gw/#a alice: "}
+	sent := loopback(gw, "loopback.b").WaitSent(2, timeout)
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 messages on b, got %#v", sent)
+	}
+	for _, msg := range sent {
+		if msg.Username != expected[msg.Channel] {
+			t.Errorf("channel %s: expected username %q, got %q", msg.Channel, expected[msg.Channel], msg.Username)
+		}
+	}
+	sent = loopback(gw, "loopback.c").WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Username != "general " {
+		t.Errorf("expected the general RemoteNickFormat, got %#v", sent)
+	}
+}
+
+func TestJoinPartFormat(t *testing.T) {
+	cfg := newConfig()
+	cfg.SetAccount("loopback.b", config.Protocol{ShowJoinPart: true, JoinPartFormat: "*** {{.Text}} ({{.Bridge}})"})
+	gw := startGateway(t, cfg, config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "system", Text: "alice joins", Channel: "#a", Event: config.EVENT_JOIN_LEAVE})
+	sent := loopback(gw, "loopback.b").WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Text != "*** alice joins (a)" {
+		t.Errorf("unexpected join message %#v", sent)
+	}
+}
+
+func TestColorNicks(t *testing.T) {
+	cfg := newConfig()
+	cfg.SetAccount("loopback.b", config.Protocol{ColorNicks: true, RemoteNickFormat: "<{{.Nick}}> "})
+	gw := startGateway(t, cfg, config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	// the color of the user is mapped to the closest color of the palette
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a", Color: "#f01010"})
+	sent := loopback(gw, "loopback.b").WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Username != "<\x0304a\u200blice\x03> " {
+		t.Errorf("expected alice colored red, got %#v", sent)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	gw := New(newConfig(), &config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	gw.Recorder = record.New(&buf)
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a"})
+	loopback(gw, "loopback.b").WaitSent(1, timeout)
+	gw.Stop(context.Background())
+	entries, err := record.Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %#v", entries)
+	}
+	if e := entries[0]; e.Direction != record.In || e.Account != "loopback.a" || e.Gateway != "test" || e.Message.Text != "hello" {
+		t.Errorf("unexpected inbound entry %#v", e)
+	}
+	if e := entries[1]; e.Direction != record.Out || e.Account != "loopback.b" || e.Message.Username != "[loopback.a] <alice> " {
+		t.Errorf("unexpected outbound entry %#v", e)
+	}
+}
+
+// waitJoined waits until the bridge account of gw joined channel.
+func waitJoined(t *testing.T, gw *Gateway, account string, channel string) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, c := range loopback(gw, account).Channels() {
+			if c == channel {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s did not join %s", account, channel)
+}
+
+func TestChannelPatterns(t *testing.T) {
+	gw := New(newConfig(), &config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "team-*"}, {Account: "loopback.b", Channel: "#ourorg-{name}"},
+			{Account: "loopback.c", Channel: "all"}}})
+	gw.channelRefresh = 10 * time.Millisecond
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Stop(context.Background())
+	a, b, c := loopback(gw, "loopback.a"), loopback(gw, "loopback.b"), loopback(gw, "loopback.c")
+	a.SetAvailableChannels("team-x", "random")
+	waitJoined(t, gw, "loopback.b", "#ourorg-x")
+	waitJoined(t, gw, "loopback.a", "team-x")
+
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "team-x"})
+	a.Inject(config.Message{Username: "alice", Text: "not mapped", Channel: "random"})
+	if sent := c.WaitSent(1, timeout); len(sent) != 1 || sent[0].Channel != "all" {
+		t.Errorf("expected the message on all, got %#v", sent)
+	}
+	if sent := flush(gw, "loopback.c", "loopback.b"); len(sent) != 1 || sent[0].Channel != "#ourorg-x" || sent[0].Text != "hello" {
+		t.Fatalf("expected the message on #ourorg-x, got %#v", sent)
+	}
+
+	// channels created later are mapped too, and only to their own channel
+	a.SetAvailableChannels("team-x", "team-y", "random")
+	waitJoined(t, gw, "loopback.b", "#ourorg-y")
+	a.Reset()
+	b.Reset()
+	b.Inject(config.Message{Username: "bob", Text: "for y", Channel: "#ourorg-y"})
+	sent := a.WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Channel != "team-y" {
+		t.Fatalf("expected the message on team-y only, got %#v", sent)
+	}
+	if sent := flush(gw, "loopback.a", "loopback.b"); len(sent) != 0 {
+		t.Errorf("message relayed to other mapped channels: %#v", sent)
+	}
+
+	// the messages of the configured channels are not relayed to the mapped channels
+	c.Inject(config.Message{Username: "carol", Text: "to all", Channel: "all"})
+	if sent := flush(gw, "loopback.c", "loopback.a"); len(sent) != 1 {
+		t.Errorf("message of a configured channel relayed to the mapped channels: %#v", sent)
+	}
+	if sent := flush(gw, "loopback.c", "loopback.b"); len(sent) != 0 {
+		t.Errorf("message of a configured channel relayed to the mapped channels: %#v", sent)
+	}
+}
+
+func TestAutoCreate(t *testing.T) {
+	gw := startGateway(t, newConfig(), config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"},
+			{Account: "loopback.b", Channel: "new", Options: config.ChannelOptions{AutoCreate: true}}}})
+	for account, expected := range map[string]int{"loopback.a": 0, "loopback.b": 1} {
+		channels, _ := loopback(gw, account).ListChannels()
+		if len(channels) != expected {
+			t.Errorf("%s: expected %d created channels, got %v", account, expected, channels)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	gwcfg := config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}}
+	// by default actions are relayed, nick changes are not
+	gw := startGateway(t, newConfig(), gwcfg)
+	a, b := loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	a.Inject(config.Message{Username: "system", Text: "alice is now known as bob", Event: config.EVENT_NICK_CHANGE})
+	a.Inject(config.Message{Username: "alice", Text: "waves", Channel: "#a", Event: config.EVENT_USER_ACTION})
+	sent := b.WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Event != config.EVENT_USER_ACTION || sent[0].Text != "waves" {
+		t.Fatalf("expected the action only, got %#v", sent)
+	}
+
+	// events without channel are broadcasted when enabled
+	gwcfg.Events = []string{config.EVENT_NICK_CHANGE}
+	gw = startGateway(t, newConfig(), gwcfg)
+	a, b = loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	a.Inject(config.Message{Username: "alice", Text: "waves", Channel: "#a", Event: config.EVENT_USER_ACTION})
+	a.Inject(config.Message{Username: "system", Text: "alice is now known as bob", Event: config.EVENT_NICK_CHANGE})
+	sent = b.WaitSent(1, timeout)
+	if len(sent) != 1 || sent[0].Event != config.EVENT_NICK_CHANGE || sent[0].Channel != "b" {
+		t.Fatalf("expected the nick change only, got %#v", sent)
+	}
+}
+
+func TestJoinPartActive(t *testing.T) {
+	cfg := newConfig()
+	cfg.SetAccount("loopback.b", config.Protocol{ShowJoinPart: true, JoinPartActive: 60})
+	cfg.General.Identities = []string{"loopback.a:bob loopback.c:robert"}
+	gw := startGateway(t, cfg, config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.a", Channel: "#other"},
+			{Account: "loopback.b", Channel: "b"}, {Account: "loopback.c", Channel: "c"}}})
+	a := loopback(gw, "loopback.a")
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a"})
+	a.Inject(config.Message{Username: "system", Text: "lurker parts", Channel: "#a", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"lurker"}})
+	// alice spoke on #a, not on #other
+	a.Inject(config.Message{Username: "system", Text: "alice parts", Channel: "#other", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"alice"}})
+	a.Inject(config.Message{Username: "system", Text: "alice and lurker quit", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"alice", "lurker"}})
+	// bob spoke on another bridge of the gateway as robert, the carol of
+	// loopback.c is not the carol of loopback.a
+	c := loopback(gw, "loopback.c")
+	c.Inject(config.Message{Username: "robert", Text: "hi", Channel: "c"})
+	c.Inject(config.Message{Username: "carol", Text: "hey", Channel: "c"})
+	a.Inject(config.Message{Username: "system", Text: "bob joins", Channel: "#other", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"bob"}})
+	a.Inject(config.Message{Username: "system", Text: "carol joins", Channel: "#other", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"carol"}})
+	sent := flush(gw, "loopback.a", "loopback.b")
+	if len(sent) != 5 || sent[0].Text != "hello" || sent[1].Text != "alice quits" || sent[2].Text != "hi" || sent[3].Text != "hey" ||
+		sent[4].Text != "bob joins" {
+		t.Errorf("expected the joins/parts of the active users only, got %#v", sent)
+	}
+	if len(sent) > 1 && (len(sent[1].Nicks) != 1 || sent[1].Nicks[0] != "alice") {
+		t.Errorf("expected the lurker removed from the nicks, got %v", sent[1].Nicks)
+	}
+}
+
+func TestAwayAfter(t *testing.T) {
+	cfg := newConfig()
+	gw := New(cfg, &config.Gateway{Name: "test", Enable: true, Events: []string{config.EVENT_AWAY},
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"}}})
+	gw.awayAfter = 20 * time.Millisecond
+	gw.activityCheck = 5 * time.Millisecond
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer gw.Stop(context.Background())
+	a, b := loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a"})
+	sent := b.WaitSent(2, timeout)
+	if len(sent) != 2 || sent[1].Event != config.EVENT_AWAY || sent[1].Text != "alice is now away" || sent[1].Channel != "b" {
+		t.Fatalf("expected an away event, got %#v", sent)
+	}
+	// the away event is sent once
+	time.Sleep(50 * time.Millisecond)
+	if sent := b.Sent(); len(sent) != 2 {
+		t.Errorf("expected no more messages, got %#v", sent)
+	}
+}
+
+func TestDelayed(t *testing.T) {
+	cfg := newConfig()
+	cfg.SetAccount("loopback.c", config.Protocol{DelayedThreshold: -1})
+	gw := startGateway(t, cfg, config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "#a"}, {Account: "loopback.b", Channel: "b"},
+			{Account: "loopback.c", Channel: "c"}}})
+	a := loopback(gw, "loopback.a")
+	old := time.Now().Add(-time.Hour)
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "#a", Timestamp: old})
+	a.Inject(config.Message{Username: "alice", Text: "live", Channel: "#a"})
+	sent := flush(gw, "loopback.a", "loopback.b")
+	if len(sent) != 2 || sent[0].Text != "["+old.Format("15:04")+"] (delayed) hello" || sent[1].Text != "live" {
+		t.Fatalf("expected the old message marked as delayed, got %#v", sent)
+	}
+	if sent[1].Timestamp.IsZero() {
+		t.Errorf("message without timestamp not stamped by the gateway")
+	}
+	// c disabled the marker
+	if sent := flush(gw, "loopback.a", "loopback.c"); len(sent) != 2 || sent[0].Text != "hello" {
+		t.Errorf("expected the old message unmarked, got %#v", sent)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	gw := startGateway(t, newConfig(), config.Gateway{Name: "test", Enable: true,
+		InOut: []config.Bridge{{Account: "loopback.a", Channel: "general"}, {Account: "loopback.b", Channel: "b"}}})
+	// a message relayed by another instance is formatted with its origin
+	loopback(gw, "loopback.a").Inject(config.Message{Username: "alice", Text: "hello", Channel: "general",
+		Origin: &config.Origin{Account: "irc.freenode", Protocol: "irc", Bridge: "freenode", Channel: "#test"}})
+	sent := flush(gw, "loopback.a", "loopback.b")
+	if len(sent) != 1 || sent[0].Username != "[irc.freenode] <alice> " {
+		t.Errorf("expected the nick formatted with the origin, got %#v", sent)
+	}
+}
@@ -0,0 +1,181 @@
+package gateway
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	log "github.com/Sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// patternBridge is a bridge of the gateway with a channel pattern (eg "team-*")
+// or template (eg "#ourorg-{name}").
+// Every channel matching a pattern is mapped to the channels with the same name.
+type patternBridge struct {
+	config.Bridge
+	in, out bool
+}
+
+// route is a set of channels relaying to each other.
+type route struct {
+	name string              // name matched by the patterns
+	in   map[string][]string // channels by account
+	out  map[string][]string // channels by account
+}
+
+func (r route) hasIn(account string, channel string) bool {
+	for _, c := range r.in[account] {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// isPattern returns true if channel is a pattern or template.
+func isPattern(channel string) bool {
+	return strings.Contains(channel, "*") || strings.Contains(channel, "{name}")
+}
+
+// matchPattern returns the name matched by the * of pattern in channel.
+func matchPattern(pattern string, channel string) (string, bool) {
+	i := strings.Index(pattern, "*")
+	if i == -1 {
+		return "", false
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(channel) <= len(prefix)+len(suffix) || !strings.HasPrefix(channel, prefix) || !strings.HasSuffix(channel, suffix) {
+		return "", false
+	}
+	return channel[len(prefix) : len(channel)-len(suffix)], true
+}
+
+// expandPattern returns the channel of pattern (or template) for name.
+func expandPattern(pattern string, name string) string {
+	return strings.Replace(strings.Replace(pattern, "*", name, 1), "{name}", name, -1)
+}
+
+func appendUnique(list []string, items ...string) []string {
+	for _, item := range items {
+		found := false
+		for _, existing := range list {
+			found = found || existing == item
+		}
+		if !found {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// allRoutes returns the configured channels and the channels mapped by patterns.
+func (gw *Gateway) allRoutes() []route {
+	return append([]route{{in: gw.ChannelsIn, out: gw.ChannelsOut}}, gw.routes...)
+}
+
+// startPatterns maps the channels matching the patterns of the gateway and keeps
+// looking for new channels every ChannelRefresh seconds.
+func (gw *Gateway) startPatterns() error {
+	if len(gw.patterns) == 0 {
+		return nil
+	}
+	for _, p := range gw.patterns {
+		if !strings.Contains(p.Channel, "*") {
+			continue
+		}
+		if _, ok := gw.Bridges[p.Account].Bridger.(bridge.ChannelLister); !ok {
+			return fmt.Errorf("%s can not list its channels, channel pattern %s is not supported", p.Account, p.Channel)
+		}
+	}
+	gw.addRoutes(gw.discover())
+	go gw.watchChannels()
+	return nil
+}
+
+func (gw *Gateway) watchChannels() {
+	ticker := time.NewTicker(gw.channelRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-gw.stop:
+			return
+		}
+		names := gw.discover()
+		select {
+		case gw.newNames <- names:
+		case <-gw.stop:
+			return
+		}
+	}
+}
+
+// discover returns the names of the channels matching the patterns.
+func (gw *Gateway) discover() []string {
+	var names []string
+	listed := make(map[string][]string)
+	for _, p := range gw.patterns {
+		if !strings.Contains(p.Channel, "*") {
+			continue
+		}
+		channels, ok := listed[p.Account]
+		if !ok {
+			var err error
+			channels, err = gw.Bridges[p.Account].Bridger.(bridge.ChannelLister).ListChannels()
+			if err != nil {
+				log.Errorf("%s: listing channels failed: %s", p.Account, err)
+			}
+			listed[p.Account] = channels
+		}
+		for _, channel := range channels {
+			if name, ok := matchPattern(p.Channel, channel); ok {
+				names = appendUnique(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (gw *Gateway) hasRoute(name string) bool {
+	for _, r := range gw.routes {
+		if r.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addRoutes maps the channels of the patterns for the new names and joins them.
+// The configured channels get the messages of every route, but their own
+// messages are only relayed to each other, not to every mapped channel.
+func (gw *Gateway) addRoutes(names []string) {
+	for _, name := range names {
+		if gw.hasRoute(name) {
+			continue
+		}
+		r := route{name: name, in: make(map[string][]string), out: make(map[string][]string)}
+		for account, channels := range gw.ChannelsOut {
+			r.out[account] = append(r.out[account], channels...)
+		}
+		for _, p := range gw.patterns {
+			channel := expandPattern(p.Channel, name)
+			if p.in {
+				r.in[p.Account] = appendUnique(r.in[p.Account], channel)
+			}
+			if p.out {
+				r.out[p.Account] = appendUnique(r.out[p.Account], channel)
+			}
+			if _, ok := gw.ChannelOptions[p.Account+channel]; !ok {
+				gw.ChannelOptions[p.Account+channel] = p.Options
+			}
+		}
+		log.Infof("gateway %s: mapping channels for %s", gw.Name, name)
+		gw.routes = append(gw.routes, r)
+		for _, p := range gw.patterns {
+			gw.joinChannel(gw.Bridges[p.Account], expandPattern(p.Channel, name))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"time"
+)
+
+// Relay is a message relayed by a gateway from a bridge to another, it is
+// shared by the gateway kinds.
+type Relay struct {
+	Gateway string                // name of the gateway
+	General config.Protocol       // the [general] section
+	Source  *bridge.Bridge        // bridge the message was received on
+	Dest    *bridge.Bridge        // bridge the message is sent to
+	Channel string                // channel the message was received on
+	Options config.ChannelOptions // options of the destination channel
+}
+
+// Prepare prepares msg to be sent to the destination bridge. The messages
+// sent to another matterbridge instance get their origin, the others are
+// formatted for the destination.
+func (r Relay) Prepare(msg *config.Message) {
+	if r.Dest.Protocol == "matterbridge" {
+		// the receiving instance formats the message
+		r.setOrigin(msg)
+		return
+	}
+	r.modifyUsername(msg)
+	if msg.Event == "" || msg.Event == config.EVENT_USER_ACTION {
+		msg.Text = helper.Delayed(msg.Timestamp, time.Now(), helper.DelayedThreshold(r.Dest.Config.DelayedThreshold, r.General.DelayedThreshold)) + msg.Text
+	}
+}
+
+// modifyUsername formats the username (and the text of events) of msg using the
+// templates of the destination channel, the destination account or the general section.
+func (r Relay) modifyUsername(msg *config.Message) {
+	br, dest := r.Source, r.Dest
+	data := helper.TemplateData{Nick: msg.Username, DisplayName: msg.DisplayName, Account: msg.Account,
+		Protocol: br.Protocol, Bridge: br.Name, Label: br.Config.Label, Channel: r.Channel,
+		Gateway: r.Gateway, Text: msg.Text, Event: msg.Event}
+	if o := msg.Origin; o != nil {
+		data.Account, data.Protocol, data.Bridge, data.Label, data.Channel = o.Account, o.Protocol, o.Bridge, o.Label, o.Channel
+	}
+	switch msg.Event {
+	case "", config.EVENT_USER_ACTION, config.EVENT_USER_TYPING:
+	case config.EVENT_JOIN_LEAVE:
+		if format := firstFormat(r.Options.JoinPartFormat, dest.Config.JoinPartFormat, r.General.JoinPartFormat); format != "" {
+			msg.Text = helper.Render(format, data)
+		}
+	default:
+		if format := firstFormat(r.Options.EventFormat, dest.Config.EventFormat, r.General.EventFormat); format != "" {
+			msg.Text = helper.Render(format, data)
+		}
+	}
+	msg.Username = helper.Render(firstFormat(r.Options.RemoteNickFormat, dest.Config.RemoteNickFormat, r.General.RemoteNickFormat), data)
+	if dest.Config.ColorNicks {
+		palette := helper.Palette(dest.Config.ColorPalette)
+		// the color chosen by the user (twitch), as close as the palette allows
+		if color, ok := helper.NearestColor(msg.Color, palette); ok {
+			palette = []int{color}
+		}
+		msg.Username = helper.ColorNick(msg.Username, palette, data.Nick, data.DisplayName)
+	}
+}
+
+// setOrigin sets the origin of messages sent to another matterbridge instance,
+// unless they were relayed by another instance before.
+func (r Relay) setOrigin(msg *config.Message) {
+	if msg.Origin != nil {
+		return
+	}
+	br := r.Source
+	msg.Origin = &config.Origin{Account: msg.Account, Protocol: br.Protocol, Bridge: br.Name,
+		Label: br.Config.Label, Channel: r.Channel, Gateway: r.Gateway}
+}
+
+// firstFormat returns the first non-empty format.
+func firstFormat(formats ...string) string {
+	for _, format := range formats {
+		if format != "" {
+			return format
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+// Package record writes the messages relayed by the gateways to a JSON Lines
+// file and reads them back, so problems can be replayed.
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/42wim/matterbridge/bridge/config"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	In  = "in"  // message received by a bridge
+	Out = "out" // message sent to a bridge
+)
+
+// Entry is a recorded message.
+type Entry struct {
+	Time      time.Time      `json:"time"`
+	Direction string         `json:"direction"`
+	Gateway   string         `json:"gateway"`
+	Account   string         `json:"account"`
+	Message   config.Message `json:"message"`
+}
+
+// Recorder writes entries to a JSON Lines file. It is safe for concurrent use.
+type Recorder struct {
+	w   io.Writer
+	enc *json.Encoder
+	sync.Mutex
+}
+
+// New returns a Recorder writing to w.
+func New(w io.Writer) *Recorder {
+	return &Recorder{w: w, enc: json.NewEncoder(w)}
+}
+
+// Create creates (or truncates) the file path and returns a Recorder writing to it.
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(f), nil
+}
+
+// Record writes msg received (In) or sent (Out) by account of gateway.
+// Errors are returned, but a failing recorder must not stop the gateway.
+func (r *Recorder) Record(direction string, gateway string, account string, msg config.Message) error {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.enc.Encode(Entry{Time: time.Now(), Direction: direction, Gateway: gateway, Account: account, Message: msg})
+}
+
+// Close closes the underlying writer if it is a file other than stdout or stderr.
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if f, ok := r.w.(*os.File); ok && f != os.Stdout && f != os.Stderr {
+		return f.Close()
+	}
+	return nil
+}
+
+// Read reads the entries written by a Recorder.
+func Read(rd io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// ReadFile reads the entries of the file path.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return entries, nil
+}
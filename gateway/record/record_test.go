@@ -0,0 +1,52 @@
+package record
+
+import (
+	"bytes"
+	"github.com/42wim/matterbridge/bridge/config"
+	"reflect"
+	"testing"
+)
+
+func TestRecordRead(t *testing.T) {
+	var buf bytes.Buffer
+	rec := New(&buf)
+	msg := config.Message{Username: "alice", Text: "hello\nworld", Channel: "#a", Account: "irc.freenode"}
+	if err := rec.Record(In, "gw", "irc.freenode", msg); err != nil {
+		t.Fatal(err)
+	}
+	msg.Username = "<alice> "
+	msg.Channel = "town-square"
+	if err := rec.Record(Out, "gw", "mattermost.work", msg); err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 2 {
+		t.Fatalf("expected 2 lines, got %d: %s", lines, buf.String())
+	}
+	entries, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %#v", entries)
+	}
+	if e := entries[0]; e.Direction != In || e.Gateway != "gw" || e.Account != "irc.freenode" || e.Message.Text != "hello\nworld" || e.Time.IsZero() {
+		t.Errorf("unexpected entry %#v", e)
+	}
+	if e := entries[1]; e.Direction != Out || e.Account != "mattermost.work" || !reflect.DeepEqual(e.Message, msg) {
+		t.Errorf("unexpected entry %#v", e)
+	}
+}
+
+func TestReadError(t *testing.T) {
+	_, err := Read(bytes.NewBufferString("{\"direction\":\"in\"}\n\nnot json\n"))
+	if err == nil || err.Error()[:7] != "line 3:" {
+		t.Errorf("expected an error on line 3, got %v", err)
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var rec *Recorder
+	if err := rec.Record(In, "gw", "irc.freenode", config.Message{}); err != nil {
+		t.Error(err)
+	}
+}
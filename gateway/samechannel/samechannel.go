@@ -1,10 +1,17 @@
 package samechannelgateway
 
 import (
+	"context"
+	"fmt"
 	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/helper"
+	"github.com/42wim/matterbridge/gateway"
+	"github.com/42wim/matterbridge/gateway/record"
 	log "github.com/Sirupsen/logrus"
 	"strings"
+	"sync"
+	"time"
 )
 
 type SameChannelGateway struct {
@@ -13,43 +20,97 @@ type SameChannelGateway struct {
 	Bridges     map[string]*bridge.Bridge
 	Channels    []string
 	ignoreNicks map[string][]string
+	activity    *gateway.Activity // last message of the users (JoinPartActive)
 	Name        string
+	Message     chan config.Message
+	Recorder    *record.Recorder // records the relayed messages when set
+	stop        chan struct{}
+	stopped     chan struct{}
 }
 
-func New(cfg *config.Config, gateway *config.SameChannelGateway) error {
-	c := make(chan config.Message)
+func New(cfg *config.Config, gateway *config.SameChannelGateway) *SameChannelGateway {
 	gw := &SameChannelGateway{}
 	gw.Bridges = make(map[string]*bridge.Bridge)
 	gw.Name = gateway.Name
 	gw.Config = cfg
 	gw.MyConfig = gateway
 	gw.Channels = gateway.Channels
-	for _, account := range gateway.Accounts {
+	gw.Message = make(chan config.Message)
+	gw.stop = make(chan struct{})
+	gw.stopped = make(chan struct{})
+	return gw
+}
+
+func (gw *SameChannelGateway) Start() error {
+	for _, account := range gw.MyConfig.Accounts {
 		br := config.Bridge{Account: account}
 		log.Infof("Starting bridge: %s", account)
-		gw.Bridges[account] = bridge.New(cfg, &br, c)
+		b, err := bridge.New(gw.Config, &br, gw.Message)
+		if err != nil {
+			return err
+		}
+		gw.Bridges[account] = b
 	}
 	for _, br := range gw.Bridges {
 		err := br.Connect()
 		if err != nil {
-			log.Fatalf("Bridge %s failed to start: %v", br.Account, err)
+			return fmt.Errorf("Bridge %s failed to start: %v", br.Account, err)
 		}
 		for _, channel := range gw.Channels {
 			log.Infof("%s: joining %s", br.Account, channel)
 			br.JoinChannel(channel)
 		}
 	}
-	gw.handleReceive(c)
+	gw.mapIgnores()
+	// checked when loading the config
+	identities, _ := helper.ParseIdentities(gw.Config.General.Identities)
+	gw.activity = gateway.NewActivity(gateway.ActivityWindow(gw.Bridges, gw.Config.General, 0), identities)
+	go gw.handleReceive()
 	return nil
 }
 
-func (gw *SameChannelGateway) handleReceive(c chan config.Message) {
+// Stop stops relaying messages and disconnects the bridges after they have
+// sent their queued messages. It gives up waiting when ctx is done.
+func (gw *SameChannelGateway) Stop(ctx context.Context) {
+	close(gw.stop)
+	// wait for the message being relayed
+	select {
+	case <-gw.stopped:
+	case <-ctx.Done():
+	}
+	var wg sync.WaitGroup
+	for _, br := range gw.Bridges {
+		wg.Add(1)
+		go func(br *bridge.Bridge) {
+			defer wg.Done()
+			log.Infof("Stopping bridge: %s", br.Account)
+			if err := br.Disconnect(ctx); err != nil {
+				log.Errorf("Bridge %s failed to disconnect: %v", br.Account, err)
+			}
+		}(br)
+	}
+	wg.Wait()
+}
+
+func (gw *SameChannelGateway) handleReceive() {
+	defer close(gw.stopped)
+	expire := time.NewTicker(time.Minute)
+	defer expire.Stop()
 	for {
 		select {
-		case msg := <-c:
+		case msg := <-gw.Message:
+			if msg.Timestamp.IsZero() {
+				msg.Timestamp = time.Now()
+			}
+			gw.record(record.In, msg.Account, msg)
+			gw.activity.Update(msg)
 			for _, br := range gw.Bridges {
 				gw.handleMessage(msg, br)
 			}
+		case <-expire.C:
+			gw.activity.Check(time.Now(), 0)
+		case <-gw.stop:
+			return
 		}
 	}
 }
@@ -59,28 +120,48 @@ func (gw *SameChannelGateway) handleMessage(msg config.Message, dest *bridge.Bri
 	if !gw.validChannel(msg.Channel) {
 		return
 	}
+	if gw.ignoreMessage(&msg) {
+		return
+	}
+	if !config.RelayEvent(gw.MyConfig.Events, msg.Event) {
+		return
+	}
 	// do not send the message to the bridge we come from if also the channel is the same
 	if msg.Account == dest.Account {
 		return
 	}
-	gw.modifyUsername(&msg, dest)
+	if window := gateway.JoinPartActive(dest.Config, gw.Config.General); msg.Event == config.EVENT_JOIN_LEAVE && window > 0 {
+		var active bool
+		if msg, active = gw.activity.Active(msg, window); !active {
+			return
+		}
+	}
+	gateway.Relay{Gateway: gw.Name, General: gw.Config.General, Source: gw.Bridges[msg.Account], Dest: dest,
+		Channel: msg.Channel}.Prepare(&msg)
 	log.Debugf("Sending %#v from %s (%s) to %s (%s)", msg, msg.Account, msg.Channel, dest.Account, msg.Channel)
+	gw.record(record.Out, dest.Account, msg)
 	err := dest.Send(msg)
 	if err != nil {
 		log.Error(err)
 	}
 }
 
-func (gw *SameChannelGateway) modifyUsername(msg *config.Message, dest *bridge.Bridge) {
-	br := gw.Bridges[msg.Account]
-	nick := gw.Config.General.RemoteNickFormat
-	if nick == "" {
-		nick = dest.Config.RemoteNickFormat
+func (gw *SameChannelGateway) mapIgnores() {
+	m := make(map[string][]string)
+	for _, br := range gw.Bridges {
+		m[br.Account] = strings.Fields(br.Config.IgnoreNicks)
 	}
-	nick = strings.Replace(nick, "{NICK}", msg.Username, -1)
-	nick = strings.Replace(nick, "{BRIDGE}", br.Name, -1)
-	nick = strings.Replace(nick, "{PROTOCOL}", br.Protocol, -1)
-	msg.Username = nick
+	gw.ignoreNicks = m
+}
+
+func (gw *SameChannelGateway) ignoreMessage(msg *config.Message) bool {
+	// should we discard messages ?
+	for _, entry := range gw.ignoreNicks[msg.Account] {
+		if msg.Username == entry {
+			return true
+		}
+	}
+	return false
 }
 
 func (gw *SameChannelGateway) validChannel(channel string) bool {
@@ -91,3 +172,9 @@ func (gw *SameChannelGateway) validChannel(channel string) bool {
 	}
 	return false
 }
+
+func (gw *SameChannelGateway) record(direction string, account string, msg config.Message) {
+	if err := gw.Recorder.Record(direction, gw.Name, account, msg); err != nil {
+		log.Errorf("recording message failed: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package samechannelgateway
+
+import (
+	"github.com/42wim/matterbridge/bridge/config"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"testing"
+	"time"
+)
+
+func startGateway(t *testing.T, cfg *config.Config) *SameChannelGateway {
+	gw := New(cfg, &config.SameChannelGateway{Name: "same", Enable: true,
+		Accounts: []string{"loopback.a", "loopback.b"}, Channels: []string{"one", "two"}})
+	if err := gw.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func loopback(gw *SameChannelGateway, account string) *bloopback.Bloopback {
+	return gw.Bridges[account].Bridger.(*bloopback.Bloopback)
+}
+
+func TestSameChannelRouting(t *testing.T) {
+	cfg := &config.Config{Protocols: map[string]map[string]config.Protocol{"loopback": {
+		"a": {IgnoreNicks: "spammer"},
+		"b": {RemoteNickFormat: "<{{.Nick}}@{{.Bridge}}> "},
+	}}}
+	gw := startGateway(t, cfg)
+	a, b := loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	if len(a.Channels()) != 2 || len(b.Channels()) != 2 {
+		t.Fatalf("expected both bridges to join 2 channels, got %v and %v", a.Channels(), b.Channels())
+	}
+	a.Inject(config.Message{Username: "spammer", Text: "buy", Channel: "one"})
+	a.Inject(config.Message{Username: "alice", Text: "not bridged", Channel: "three"})
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "two"})
+	sent := b.WaitSent(1, time.Second)
+	if len(sent) != 1 {
+		t.Fatalf("expected 1 message on b, got %#v", sent)
+	}
+	if sent[0].Channel != "two" || sent[0].Text != "hello" || sent[0].Username != "<alice@a> " {
+		t.Errorf("unexpected message %#v", sent[0])
+	}
+	// a marker to be sure the message from a was handled for a too
+	b.Inject(config.Message{Username: "bob", Text: "marker", Channel: "three"})
+	if len(a.Sent()) != 0 {
+		t.Errorf("message echoed to its origin: %#v", a.Sent())
+	}
+}
+
+func TestSameChannelJoinPartActive(t *testing.T) {
+	cfg := &config.Config{Protocols: map[string]map[string]config.Protocol{"loopback": {"a": {}, "b": {JoinPartActive: 60}}}}
+	gw := startGateway(t, cfg)
+	a, b := loopback(gw, "loopback.a"), loopback(gw, "loopback.b")
+	a.Inject(config.Message{Username: "alice", Text: "hello", Channel: "one"})
+	a.Inject(config.Message{Username: "system", Text: "lurker joins", Channel: "one", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"lurker"}})
+	a.Inject(config.Message{Username: "system", Text: "alice and lurker part", Channel: "one", Event: config.EVENT_JOIN_LEAVE, Nicks: []string{"alice", "lurker"}})
+	sent := b.WaitSent(2, time.Second)
+	if len(sent) != 2 || sent[1].Text != "alice parts" {
+		t.Fatalf("expected the part of the active user only, got %#v", sent)
+	}
+	// the join of the lurker was handled before the part
+	if len(b.Sent()) != 2 {
+		t.Errorf("unexpected messages %#v", b.Sent())
+	}
+}
@@ -1,59 +1,179 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/42wim/matterbridge/bridge"
 	"github.com/42wim/matterbridge/bridge/config"
+	// the bridges register their protocol in init
+	_ "github.com/42wim/matterbridge/bridge/discord"
+	_ "github.com/42wim/matterbridge/bridge/email"
+	_ "github.com/42wim/matterbridge/bridge/exec"
+	_ "github.com/42wim/matterbridge/bridge/feed"
+	_ "github.com/42wim/matterbridge/bridge/gitter"
+	_ "github.com/42wim/matterbridge/bridge/irc"
+	_ "github.com/42wim/matterbridge/bridge/matrix"
+	_ "github.com/42wim/matterbridge/bridge/matterbridge"
+	_ "github.com/42wim/matterbridge/bridge/mattermost"
+	_ "github.com/42wim/matterbridge/bridge/rocketchat"
+	_ "github.com/42wim/matterbridge/bridge/slack"
+	_ "github.com/42wim/matterbridge/bridge/telegram"
+	_ "github.com/42wim/matterbridge/bridge/webhook"
+	_ "github.com/42wim/matterbridge/bridge/xmpp"
+	_ "github.com/42wim/matterbridge/bridge/zulip"
 	"github.com/42wim/matterbridge/gateway"
+	"github.com/42wim/matterbridge/gateway/record"
 	"github.com/42wim/matterbridge/gateway/samechannel"
 	log "github.com/Sirupsen/logrus"
+	"io"
+	stdlog "log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var version = "0.9.2-dev"
 
 func init() {
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	// never log secrets from the config
+	log.SetOutput(config.RedactWriter(os.Stderr))
+	stdlog.SetOutput(config.RedactWriter(os.Stderr))
 }
 
 func main() {
 	flagConfig := flag.String("conf", "matterbridge.toml", "config file")
 	flagDebug := flag.Bool("debug", false, "enable debug")
 	flagVersion := flag.Bool("version", false, "show version")
+	flagValidate := flag.Bool("validate", false, "validate the config file and exit")
+	flagStatus := flag.Bool("status", false, "show the gateways, their accounts and the capabilities of the bridges and exit")
+	flagRecord := flag.String("record", "", "record the relayed messages to this JSON Lines file")
+	flagReplay := flag.String("replay", "", "replay the messages received in this recording against loopback bridges and exit")
 	flag.Parse()
 	if *flagVersion {
 		fmt.Println("version:", version)
 		return
 	}
 	flag.Parse()
+	if *flagValidate {
+		_, errs := config.LoadConfig(*flagConfig)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: config ok\n", *flagConfig)
+		return
+	}
+	if *flagStatus {
+		cfg, errs := config.LoadConfig(*flagConfig)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		if err := status(os.Stdout, cfg); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 	if *flagDebug {
 		log.Info("enabling debug")
 		log.SetLevel(log.DebugLevel)
 	}
-	fmt.Println("running version", version)
+	// when replaying the recording is written to stdout, print the rest to stderr
+	var out io.Writer = os.Stdout
+	if *flagReplay != "" {
+		out = os.Stderr
+	}
+	fmt.Fprintln(out, "running version", version)
 	cfg := config.NewConfig(*flagConfig)
+	var rec *record.Recorder
+	if *flagReplay != "" {
+		cfg.General.DryRun = true
+		rec = record.New(os.Stdout)
+	}
+	if *flagRecord != "" {
+		var err error
+		rec, err = record.Create(*flagRecord)
+		if err != nil {
+			log.Fatalf("recording failed: %s", err)
+		}
+	}
+	var gateways []stopper
+	// bridges by gateway name, used for replaying
+	bridges := make(map[string]map[string]*bridge.Bridge)
 	for _, gw := range cfg.SameChannelGateway {
 		if !gw.Enable {
 			continue
 		}
-		fmt.Printf("starting samechannel gateway %#v\n", gw.Name)
-		go func(gw config.SameChannelGateway) {
-			err := samechannelgateway.New(cfg, &gw)
-			if err != nil {
-				log.Fatalf("starting gateway failed %#v", err)
-			}
-		}(gw)
+		fmt.Fprintf(out, "starting samechannel gateway %#v\n", gw.Name)
+		g := samechannelgateway.New(cfg, &gw)
+		g.Recorder = rec
+		err := g.Start()
+		if err != nil {
+			log.Fatalf("starting gateway failed %#v", err)
+		}
+		gateways = append(gateways, g)
+		bridges[g.Name] = g.Bridges
 	}
 
 	for _, gw := range cfg.Gateway {
 		if !gw.Enable {
 			continue
 		}
-		fmt.Printf("starting gateway %#v\n", gw.Name)
+		fmt.Fprintf(out, "starting gateway %#v\n", gw.Name)
 		g := gateway.New(cfg, &gw)
+		g.Recorder = rec
 		err := g.Start()
 		if err != nil {
 			log.Fatalf("starting gateway failed %#v", err)
 		}
+		gateways = append(gateways, g)
+		bridges[g.Name] = g.Bridges
+	}
+
+	var replayErr error
+	if *flagReplay != "" {
+		replayErr = replay(*flagReplay, bridges)
+	} else {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Infof("received %s, shutting down", <-sig)
+	}
+	timeout := cfg.General.ShutdownTimeout
+	if timeout == 0 {
+		timeout = 10
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, gw := range gateways {
+		wg.Add(1)
+		go func(gw stopper) {
+			defer wg.Done()
+			gw.Stop(ctx)
+		}(gw)
+	}
+	wg.Wait()
+	if rec != nil {
+		if err := rec.Close(); err != nil {
+			log.Errorf("closing recording failed: %s", err)
+		}
 	}
-	select {}
+	if replayErr != nil {
+		log.Fatal(replayErr)
+	}
+	log.Info("shutdown complete")
+}
+
+// stopper is a gateway that can be stopped.
+type stopper interface {
+	Stop(ctx context.Context)
 }
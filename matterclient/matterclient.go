@@ -121,7 +121,7 @@ func (m *MMClient) Login() error {
 				return errors.New(appErr.DetailedError)
 			}
 			if myinfo.Data.(*model.User) == nil {
-				m.log.Errorf("LOGIN TOKEN: %s is invalid", m.Credentials.Pass)
+				m.log.Error("LOGIN TOKEN is invalid")
 				return errors.New("invalid " + model.SESSION_COOKIE_TOKEN)
 			}
 		} else {
@@ -212,6 +212,11 @@ func (m *MMClient) WsReceiver() {
 		}
 
 		if _, rawMsg, err = m.WsClient.ReadMessage(); err != nil {
+			// we logged out
+			if m.WsQuit {
+				m.log.Debug("exiting WsReceiver")
+				return
+			}
 			m.log.Error("error:", err)
 			// reconnect
 			m.Login()
@@ -352,6 +357,16 @@ func (m *MMClient) PostMessage(channelId string, text string) {
 	m.Client.CreatePost(post)
 }
 
+// CreateChannel creates a public channel in our (primary) team.
+func (m *MMClient) CreateChannel(name string) error {
+	m.log.Debug("Creating channel ", name)
+	channel := &model.Channel{TeamId: m.Team.Id, Name: name, DisplayName: name, Type: model.CHANNEL_OPEN}
+	if _, err := m.Client.CreateChannel(channel); err != nil {
+		return errors.New(err.DetailedError)
+	}
+	return m.UpdateChannels()
+}
+
 func (m *MMClient) JoinChannel(channelId string) error {
 	m.RLock()
 	defer m.RUnlock()
@@ -0,0 +1,114 @@
+//Package paste provides a small embedded paste server for long messages
+package paste
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paste is a stored message.
+type Paste struct {
+	Text    string
+	Created time.Time
+}
+
+// Server for pastes.
+type Server struct {
+	pastes map[string]Paste
+	sync.RWMutex
+	Config
+}
+
+// Config for server.
+type Config struct {
+	BindAddress string        // Address to listen on
+	URL         string        // Base URL the pastes are reachable on (default http://BindAddress/)
+	Retention   time.Duration // How long to keep pastes
+}
+
+// New starts a paste server, it returns an error when it can not listen
+// on BindAddress.
+func New(config Config) (*Server, error) {
+	s := &Server{pastes: make(map[string]Paste), Config: config}
+	_, _, err := net.SplitHostPort(s.BindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect bindaddress %s", s.BindAddress)
+	}
+	ln, err := net.Listen("tcp", s.BindAddress)
+	if err != nil {
+		return nil, err
+	}
+	if s.URL == "" {
+		s.URL = "http://" + ln.Addr().String() + "/"
+	}
+	if !strings.HasSuffix(s.URL, "/") {
+		s.URL += "/"
+	}
+	if s.Retention == 0 {
+		s.Retention = 24 * time.Hour
+	}
+	go s.serve(ln)
+	go s.expire()
+	return s, nil
+}
+
+// serve serves the pastes on ln.
+func (s *Server) serve(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/", s)
+	log.Printf("Paste server listening on http://%v...\n", ln.Addr())
+	if err := http.Serve(ln, mux); err != nil {
+		log.Printf("paste server stopped: %s", err)
+	}
+}
+
+// ServeHTTP implementation.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.NotFound(w, r)
+		return
+	}
+	s.RLock()
+	paste, ok := s.pastes[strings.TrimPrefix(r.URL.Path, "/")]
+	s.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(paste.Text))
+}
+
+// Store saves text and returns the URL it can be viewed on.
+func (s *Server) Store(text string) (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	s.Lock()
+	s.pastes[id] = Paste{Text: text, Created: time.Now()}
+	s.Unlock()
+	return s.URL + id, nil
+}
+
+// expire removes the pastes older than the retention time.
+func (s *Server) expire() {
+	for range time.Tick(time.Minute) {
+		s.Lock()
+		for id, paste := range s.pastes {
+			if time.Since(paste.Created) > s.Retention {
+				delete(s.pastes, id)
+			}
+		}
+		s.Unlock()
+	}
+}
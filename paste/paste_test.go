@@ -0,0 +1,53 @@
+package paste
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s, err := New(Config{BindAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := s.Store("line 1\nline 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(url, s.URL) {
+		t.Errorf("paste %s is not on %s", url, s.URL)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "line 1\nline 2" {
+		t.Errorf("got %q", body)
+	}
+	resp, err = http.Get(s.URL + "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown paste: got status %d", resp.StatusCode)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	if _, err := New(Config{BindAddress: "localhost"}); err == nil {
+		t.Errorf("expected an error for an address without port")
+	}
+	s, err := New(Config{BindAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := strings.TrimSuffix(strings.TrimPrefix(s.URL, "http://"), "/")
+	if _, err := New(Config{BindAddress: addr}); err == nil {
+		t.Errorf("expected an error for an address in use")
+	}
+}
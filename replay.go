@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/loopback"
+	"github.com/42wim/matterbridge/gateway/record"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// replay injects the messages received in the recording file into the bridges
+// of the gateways, by gateway name and account. The bridges must be loopback
+// bridges (DryRun).
+func replay(file string, bridges map[string]map[string]*bridge.Bridge) error {
+	entries, err := record.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for _, entry := range entries {
+		if entry.Direction != record.In {
+			continue
+		}
+		br, ok := bridges[entry.Gateway][entry.Account]
+		if !ok {
+			log.Warnf("replay: skipping message from %s, gateway %s is not enabled or does not use it", entry.Account, entry.Gateway)
+			continue
+		}
+		lb, ok := br.Bridger.(*bloopback.Bloopback)
+		if !ok {
+			return fmt.Errorf("replay: %s is not a loopback bridge", entry.Account)
+		}
+		// keep the delay of the message when it was recorded
+		msg := entry.Message
+		if !msg.Timestamp.IsZero() {
+			msg.Timestamp = time.Now().Add(msg.Timestamp.Sub(entry.Time))
+		}
+		lb.Inject(msg)
+		replayed++
+	}
+	log.Infof("replay: replayed %d messages", replayed)
+	return nil
+}
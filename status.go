@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/42wim/matterbridge/bridge"
+	"github.com/42wim/matterbridge/bridge/config"
+	"io"
+	"strings"
+)
+
+// status prints the enabled gateways with the accounts they use and the
+// capabilities of their bridges. The bridges are created but not connected.
+func status(w io.Writer, cfg *config.Config) error {
+	// the bridges are not used, do not start the paste server
+	cfg.General.PasteBindAddress = ""
+	cfg.General.DryRun = false
+	for _, gw := range cfg.SameChannelGateway {
+		if !gw.Enable {
+			continue
+		}
+		fmt.Fprintf(w, "samechannel gateway %s\n", gw.Name)
+		for _, account := range gw.Accounts {
+			if err := printBridge(w, cfg, account, gw.Channels); err != nil {
+				return err
+			}
+		}
+	}
+	for _, gw := range cfg.Gateway {
+		if !gw.Enable {
+			continue
+		}
+		fmt.Fprintf(w, "gateway %s\n", gw.Name)
+		var accounts []string
+		channels := make(map[string][]string)
+		for _, br := range append(append(append([]config.Bridge{}, gw.In...), gw.Out...), gw.InOut...) {
+			if _, ok := channels[br.Account]; !ok {
+				accounts = append(accounts, br.Account)
+			}
+			if !contains(channels[br.Account], br.Channel) {
+				channels[br.Account] = append(channels[br.Account], br.Channel)
+			}
+		}
+		for _, account := range accounts {
+			if err := printBridge(w, cfg, account, channels[account]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func printBridge(w io.Writer, cfg *config.Config, account string, channels []string) error {
+	br, err := bridge.New(cfg, &config.Bridge{Account: account}, make(chan config.Message))
+	if err != nil {
+		return err
+	}
+	caps, ok := br.Capabilities()
+	text := caps.String()
+	if !ok {
+		text = "no capabilities declared, messages are sent as is"
+	}
+	fmt.Fprintf(w, "  %s (%s): %s\n", account, strings.Join(channels, ", "), text)
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}